@@ -0,0 +1,101 @@
+package bitcask_go
+
+import (
+	"log"
+	"time"
+)
+
+// 自动merge失败之后重试间隔的上限
+const maxAutoMergeBackoff = time.Hour
+
+// 开启后台自动merge，需要在Options中配置AutoMergeInterval
+func (db *DB) startAutoMerge() {
+	if db.options.AutoMergeInterval <= 0 {
+		return
+	}
+	db.autoMergeStop = make(chan struct{})
+	db.autoMergeDone = make(chan struct{})
+	go func() {
+		defer close(db.autoMergeDone)
+		ticker := time.NewTicker(db.options.AutoMergeInterval)
+		defer ticker.Stop()
+		var backoff time.Duration
+		var retryAt time.Time
+		for {
+			select {
+			case <-db.autoMergeStop:
+				return
+			case now := <-ticker.C:
+				if now.Before(retryAt) {
+					continue
+				}
+				//未达到条件时等待下一次检查，失败时间隔成倍增加之后重试
+				err := db.autoMerge(now)
+				if err == ErrMergeRationUnreached || err == ErrMergeIsProgress {
+					continue
+				}
+				db.reportAutoMerge(err)
+				if err == nil {
+					backoff, retryAt = 0, time.Time{}
+					continue
+				}
+				backoff = min(max(2*backoff, db.options.AutoMergeInterval), maxAutoMergeBackoff)
+				retryAt = now.Add(backoff)
+			}
+		}
+	}()
+}
+
+// 停止后台自动merge，并等待正在进行的merge完成
+func (db *DB) stopAutoMerge() {
+	if db.autoMergeStop == nil {
+		return
+	}
+	close(db.autoMergeStop)
+	<-db.autoMergeDone
+	db.autoMergeStop = nil
+}
+
+// 检查是否满足自动merge的条件，满足则进行merge
+func (db *DB) autoMerge(now time.Time) error {
+	if !db.inAutoMergeWindow(now) {
+		return nil
+	}
+	db.mu.RLock()
+	reclaimSize := db.reclaimSize
+	db.mu.RUnlock()
+	if reclaimSize < db.options.AutoMergeMinReclaimSize {
+		return ErrMergeRationUnreached
+	}
+	return db.Merge()
+}
+
+// 记录自动merge的结果，失败时调用AutoMergeErrorHook，为空时记录到标准日志中
+func (db *DB) reportAutoMerge(err error) {
+	db.mu.Lock()
+	db.autoMergeErr = err
+	db.mu.Unlock()
+	if err == nil {
+		return
+	}
+	if db.options.AutoMergeErrorHook != nil {
+		db.options.AutoMergeErrorHook(err)
+		return
+	}
+	log.Printf("bitcask: auto merge failed: %v", err)
+}
+
+// 判断当前时间是否在允许自动merge的时间段内
+func (db *DB) inAutoMergeWindow(now time.Time) bool {
+	start, end := db.options.AutoMergeWindowStart, db.options.AutoMergeWindowEnd
+	if start == end {
+		return true
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+	if start < end {
+		return offset >= start && offset < end
+	}
+	//时间段跨越零点
+	return offset >= start || offset < end
+}
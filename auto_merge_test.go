@@ -0,0 +1,94 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_AutoMerge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-auto-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.AutoMergeInterval = 10 * time.Millisecond
+	opts.AutoMergeMinReclaimSize = 1024
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 1000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	//后台merge之后无效数据被回收
+	assert.Eventually(t, func() bool {
+		return db.Stat().ReclaimableSize < 1024
+	}, 5*time.Second, 10*time.Millisecond)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_AutoMergeWindow(t *testing.T) {
+	db := &DB{options: DefaultOptions}
+	db.options.AutoMergeWindowStart = 22 * time.Hour
+	db.options.AutoMergeWindowEnd = 2 * time.Hour
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	assert.True(t, db.inAutoMergeWindow(day.Add(23*time.Hour)))
+	assert.True(t, db.inAutoMergeWindow(day.Add(time.Hour)))
+	assert.False(t, db.inAutoMergeWindow(day.Add(12*time.Hour)))
+
+	db.options.AutoMergeWindowStart = 2 * time.Hour
+	db.options.AutoMergeWindowEnd = 4 * time.Hour
+	assert.True(t, db.inAutoMergeWindow(day.Add(3*time.Hour)))
+	assert.False(t, db.inAutoMergeWindow(day.Add(4*time.Hour)))
+}
+
+func TestDB_AutoMergeError(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-auto-merge-error")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	var failures atomic.Int32
+	opts.AutoMergeErrorHook = func(err error) {
+		failures.Add(1)
+	}
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	//损坏第一个数据文件，merge读取时失败
+	file, err := os.OpenFile(data.GetDataFileName(dir, 0), os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.WriteAt([]byte("corrupted"), 0)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	//写入完成之后再开启自动merge，避免损坏之前已经merge过
+	db.options.AutoMergeInterval = 10 * time.Millisecond
+	db.startAutoMerge()
+
+	//失败之后重试的间隔成倍增加，错误可以从统计信息中获取
+	time.Sleep(500 * time.Millisecond)
+	assert.GreaterOrEqual(t, failures.Load(), int32(1))
+	assert.LessOrEqual(t, failures.Load(), int32(8))
+	assert.NotNil(t, db.Stat().AutoMergeError)
+	err = db.Close()
+	assert.Nil(t, err)
+}
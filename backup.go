@@ -0,0 +1,198 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 备份目录中记录备份文件信息的文件
+const backupManifestName = "backup-manifest"
+
+// BackupManifest 一次备份包含的所有文件
+type BackupManifest struct {
+	CreatedAt int64        `json:"created_at"` //备份时间，UnixNano时间戳
+	Files     []BackupFile `json:"files"`
+}
+
+// BackupFile 备份中的一个文件
+type BackupFile struct {
+	Name     string  `json:"name"`
+	Fid      *uint32 `json:"fid,omitempty"` //数据文件、hint文件和blob文件对应的文件id
+	Size     int64   `json:"size"`
+	ModTime  int64   `json:"mod_time"` //备份时原文件的修改时间，UnixNano时间戳
+	Checksum uint32  `json:"checksum"` //文件内容的crc32校验值
+	Dir      string  `json:"dir"`      //文件所在的备份目录，为相对于当前备份目录的路径
+}
+
+// BackUpIncremental 增量备份数据库到dir中，baseDir为之前的一次备份目录
+// 和之前的备份相比没有变化的数据文件和hint文件不会重新拷贝，只在清单中引用之前的备份
+// 增量备份的目录不能直接打开，需要使用Restore恢复，之前的备份目录需要一起保留
+func (db *DB) BackUpIncremental(dir string, baseDir string) (*BackupManifest, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.backUp(dir, baseDir)
+}
+
+// 备份数据库，baseDir为空时拷贝所有的文件
+// 在访问此方法前必须得有读锁
+func (db *DB) backUp(dir string, baseDir string) (*BackupManifest, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	//之前备份中的文件
+	baseFiles := make(map[string]BackupFile)
+	if baseDir != "" {
+		base, err := ReadBackupManifest(baseDir)
+		if err != nil {
+			return nil, err
+		}
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range base.Files {
+			fileDir, err := filepath.Abs(filepath.Join(baseDir, file.Dir))
+			if err != nil {
+				return nil, err
+			}
+			if file.Dir, err = filepath.Rel(absDir, fileDir); err != nil {
+				return nil, err
+			}
+			baseFiles[file.Name] = file
+		}
+	}
+	entries, err := os.ReadDir(db.options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &BackupManifest{CreatedAt: time.Now().UnixNano()}
+	for _, entry := range entries {
+		fileName := entry.Name()
+		if entry.IsDir() || fileName == fileLockName {
+			continue
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		fid := backupFileId(fileName)
+		//数据文件、hint文件和blob文件写满之后不会再修改，merge替换之后修改时间会变化
+		if baseFile, ok := baseFiles[fileName]; ok && fid != nil &&
+			baseFile.Size == fileInfo.Size() && baseFile.ModTime == fileInfo.ModTime().UnixNano() {
+			manifest.Files = append(manifest.Files, baseFile)
+			continue
+		}
+		size, checksum, err := utils.CopyFile(filepath.Join(db.options.DirPath, fileName), filepath.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, BackupFile{
+			Name:     fileName,
+			Fid:      fid,
+			Size:     size,
+			ModTime:  fileInfo.ModTime().UnixNano(),
+			Checksum: checksum,
+			Dir:      ".",
+		})
+	}
+	if err := writeBackupManifest(dir, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Restore 从备份目录中恢复数据库到targetDir，恢复时会校验每个文件的大小和校验值
+// targetDir必须不存在或者为空，恢复完成之后可以直接打开，校验失败时不会留下不完整的targetDir
+func Restore(backupDir string, targetDir string) error {
+	entries, err := os.ReadDir(targetDir)
+	if err == nil && len(entries) > 0 {
+		return ErrRestoreDirNotEmpty
+	}
+	targetExists := err == nil
+	manifest, err := ReadBackupManifest(backupDir)
+	if err != nil {
+		return err
+	}
+	//先恢复到同一目录下的临时目录中，全部校验通过之后再重命名为targetDir
+	targetDir = filepath.Clean(targetDir)
+	if err := os.MkdirAll(filepath.Dir(targetDir), os.ModePerm); err != nil {
+		return err
+	}
+	tmpDir, err := os.MkdirTemp(filepath.Dir(targetDir), filepath.Base(targetDir)+"-restore")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	for _, file := range manifest.Files {
+		src := filepath.Join(backupDir, file.Dir, file.Name)
+		size, checksum, err := utils.CopyFile(src, filepath.Join(tmpDir, file.Name))
+		if err != nil {
+			return err
+		}
+		if size != file.Size || checksum != file.Checksum {
+			return ErrBackupChecksumMismatch
+		}
+	}
+	//空的targetDir需要先删除才能重命名
+	if targetExists {
+		if err := os.Remove(targetDir); err != nil {
+			return err
+		}
+	}
+	//临时目录的权限只有当前用户可以访问
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmpDir, targetDir)
+}
+
+// ReadBackupManifest 读取备份目录中的备份清单
+func ReadBackupManifest(backupDir string) (*BackupManifest, error) {
+	buf, err := os.ReadFile(filepath.Join(backupDir, backupManifestName))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &BackupManifest{}
+	if err := json.Unmarshal(buf, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// 写入备份清单，先写临时文件再重命名，保证清单是完整的
+func writeBackupManifest(dir string, manifest *BackupManifest) error {
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	tmpName := filepath.Join(dir, backupManifestName+".tmp")
+	if err := os.WriteFile(tmpName, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filepath.Join(dir, backupManifestName))
+}
+
+// 数据文件、hint文件和blob文件对应的文件id，其他文件返回nil
+func backupFileId(fileName string) *uint32 {
+	name := fileName
+	for _, suffix := range []string{data.DataFileNameSuffix, data.DataHintFileSuffix, data.BlobFileSuffix} {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	if name == fileName {
+		return nil
+	}
+	fid, err := strconv.ParseUint(name, 10, 32)
+	if err != nil {
+		return nil
+	}
+	fileId := uint32(fid)
+	return &fileId
+}
@@ -0,0 +1,85 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_BackUpIncremental(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup-incremental")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	backupRoot, _ := os.MkdirTemp("", "bitcask-go-backups")
+	defer os.RemoveAll(backupRoot)
+	full := filepath.Join(backupRoot, "full")
+	incremental := filepath.Join(backupRoot, "incremental")
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	err = db.BackUp(full)
+	assert.Nil(t, err)
+	manifest, err := ReadBackupManifest(full)
+	assert.Nil(t, err)
+	for _, file := range manifest.Files {
+		assert.Equal(t, ".", file.Dir)
+	}
+
+	for i := 1000; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	manifest, err = db.BackUpIncremental(incremental, full)
+	assert.Nil(t, err)
+	//之前备份过的旧数据文件不会重新拷贝
+	var reused int
+	for _, file := range manifest.Files {
+		_, err := os.Stat(filepath.Join(incremental, file.Name))
+		if file.Dir == "." {
+			assert.Nil(t, err)
+			continue
+		}
+		reused++
+		assert.Equal(t, filepath.Join("..", "full"), file.Dir)
+		assert.True(t, os.IsNotExist(err))
+	}
+	assert.Greater(t, reused, 0)
+	assert.Nil(t, db.Close())
+
+	//恢复之后可以直接打开
+	target := filepath.Join(backupRoot, "target")
+	err = Restore(incremental, target)
+	assert.Nil(t, err)
+	err = Restore(incremental, target)
+	assert.Equal(t, ErrRestoreDirNotEmpty, err)
+	opts.DirPath = target
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 2000, len(db2.ListKeys()))
+	assert.Nil(t, db2.Close())
+
+	//之前备份中的文件损坏，恢复时校验失败
+	fileName := data.GetDataFileName(full, 0)
+	buf, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	buf[0] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, buf, 0644))
+	err = Restore(incremental, filepath.Join(backupRoot, "target2"))
+	assert.Equal(t, ErrBackupChecksumMismatch, err)
+	//校验失败时不会留下不完整的目录
+	_, err = os.Stat(filepath.Join(backupRoot, "target2"))
+	assert.True(t, os.IsNotExist(err))
+	entries, err := os.ReadDir(backupRoot)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(entries))
+}
@@ -16,11 +16,17 @@ type WriteBatch struct {
 	options       WriteBatchOptions
 	mu            *sync.Mutex
 	db            *DB
+	family        *ColumnFamily              //Put和Delete默认写入的列族
 	pendingWrites map[string]*data.LogRecord //暂存用户写入的数据
 }
 
 // NewWriteBatch初始化WriteBatch
 func (db *DB) NewWriteBatch(opts WriteBatchOptions) *WriteBatch {
+	return db.newWriteBatch(db.defaultFamily, opts)
+}
+
+// 初始化默认写入指定列族的WriteBatch
+func (db *DB) newWriteBatch(cf *ColumnFamily, opts WriteBatchOptions) *WriteBatch {
 	if db.options.IndexType == BPlusTree && !db.seqNoFileExists && !db.isInitial {
 		panic("cannot use write batch,seq no file not exists")
 	}
@@ -28,24 +34,35 @@ func (db *DB) NewWriteBatch(opts WriteBatchOptions) *WriteBatch {
 		options:       opts,
 		mu:            new(sync.Mutex),
 		db:            db,
+		family:        cf,
 		pendingWrites: make(map[string]*data.LogRecord),
 	}
 }
 
 // Put批量写数据
 func (wb *WriteBatch) Put(key []byte, value []byte) error {
+	return wb.PutCF(wb.family, key, value)
+}
+
+// PutCF批量写数据到指定的列族，同一个批次中可以写入多个列族
+func (wb *WriteBatch) PutCF(cf *ColumnFamily, key []byte, value []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
 	//暂存LogRecord
-	logRecord := &data.LogRecord{Key: key, Value: value}
-	wb.pendingWrites[string(key)] = logRecord
+	logRecord := &data.LogRecord{Key: key, Value: value, FamilyId: cf.id}
+	wb.pendingWrites[pendingKey(cf.id, key)] = logRecord
 	return nil
 }
 
 func (wb *WriteBatch) Delete(key []byte) error {
+	return wb.DeleteCF(wb.family, key)
+}
+
+// DeleteCF批量删除指定列族中的数据
+func (wb *WriteBatch) DeleteCF(cf *ColumnFamily, key []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
@@ -53,15 +70,15 @@ func (wb *WriteBatch) Delete(key []byte) error {
 	defer wb.mu.Unlock()
 
 	//数据不存在则直接返回
-	logRecordPos := wb.db.index.Get(key)
+	logRecordPos := cf.index.Get(key)
 	if logRecordPos == nil {
-		if wb.pendingWrites[string(key)] != nil {
-			delete(wb.pendingWrites, string(key))
+		if wb.pendingWrites[pendingKey(cf.id, key)] != nil {
+			delete(wb.pendingWrites, pendingKey(cf.id, key))
 		}
 	}
 	//暂存LogRecord
-	logRecord := &data.LogRecord{Key: key, Type: data.LogRecordDeleted}
-	wb.pendingWrites[string(key)] = logRecord
+	logRecord := &data.LogRecord{Key: key, Type: data.LogRecordDeleted, FamilyId: cf.id}
+	wb.pendingWrites[pendingKey(cf.id, key)] = logRecord
 	return nil
 }
 
@@ -79,52 +96,77 @@ func (wb *WriteBatch) Commit() error {
 	//加锁保证事务提交的串形化
 	wb.db.mu.Lock()
 	defer wb.db.mu.Unlock()
+	if err := wb.db.commitTxnRecords(wb.pendingWrites, wb.options.SyncWrites); err != nil {
+		return err
+	}
+	//清空暂存数据
+	wb.pendingWrites = make(map[string]*data.LogRecord)
+	return nil
+}
+
+// 将暂存的数据作为一个事务写到数据文件中，并更新内存索引
+// 在访问此方法前必须得有互斥锁
+func (db *DB) commitTxnRecords(pendingWrites map[string]*data.LogRecord, syncWrites bool) error {
 	//获取当前最新的事务序列号
-	seqNo := atomic.AddUint64(&wb.db.seqNo, 1)
+	seqNo := atomic.AddUint64(&db.seqNo, 1)
 	//开始写数据到数据文件中
 	position := make(map[string]*data.LogRecordPos)
-	for _, record := range wb.pendingWrites {
-		logRecordPos, err := wb.db.appendLogRecord(&data.LogRecord{
-			Key:   logRecordKeyWithSeq(record.Key, seqNo),
-			Value: record.Value,
-			Type:  record.Type,
+	for key, record := range pendingWrites {
+		logRecordPos, err := db.appendLogRecord(&data.LogRecord{
+			Key:      logRecordKeyWithSeq(record.Key, seqNo),
+			Value:    record.Value,
+			Type:     record.Type,
+			Expire:   record.Expire,
+			FamilyId: record.FamilyId,
 		})
 		if err != nil {
 			return err
 		}
-		position[string(record.Key)] = logRecordPos
+		position[key] = logRecordPos
 	}
 	//写一条标识事务完成的数据
 	finishedRecord := &data.LogRecord{
 		Key:  logRecordKeyWithSeq(txnFinKey, seqNo),
 		Type: data.LogRecordTxnFinished,
 	}
-	if _, err := wb.db.appendLogRecord(finishedRecord); err != nil {
+	finishedPos, err := db.appendLogRecord(finishedRecord)
+	if err != nil {
 		return err
 	}
+	db.markGarbage(finishedPos)
 	//根据配置进行持久化
-	if wb.options.SyncWrites && wb.db.activeFile != nil {
-		err := wb.db.activeFile.Sync()
+	if syncWrites && db.activeFile != nil {
+		err := db.activeFile.Sync()
 		if err != nil {
 			return err
 		}
 	}
 	//更新内存索引
-	for _, record := range wb.pendingWrites {
-		pos := position[string(record.Key)]
+	version := db.nextWriteVersion()
+	for key, record := range pendingWrites {
+		pos := position[key]
+		familyIndex, err := db.getFamilyIndex(record.FamilyId)
+		if err != nil {
+			return err
+		}
 		var oldPos *data.LogRecordPos
+		event := &WatchEvent{Key: record.Key, SeqNo: version}
 		if record.Type == data.LogRecordNormal {
-			oldPos = wb.db.index.Put(record.Key, pos)
+			oldPos = familyIndex.Put(record.Key, pos)
+			db.markLive(pos)
+			event.Type, event.Value = WatchPut, record.Value
 		}
 		if record.Type == data.LogRecordDeleted {
-			oldPos, _ = wb.db.index.Delete(record.Key)
+			oldPos, _ = familyIndex.Delete(record.Key)
+			db.markGarbage(pos)
+			event.Type = WatchDelete
 		}
 		if oldPos != nil {
-			wb.db.reclaimSize += int64(oldPos.Size)
+			db.markStale(oldPos)
 		}
+		db.recordKeyWrite(record.FamilyId, record.Key)
+		db.watchers.notify(record.FamilyId, event)
 	}
-	//清空暂存数据
-	wb.pendingWrites = make(map[string]*data.LogRecord)
 	return nil
 }
 
@@ -138,6 +180,11 @@ func logRecordKeyWithSeq(key []byte, seqNo uint64) []byte {
 	return encKey
 }
 
+// 暂存数据使用的key，区分不同列族中相同的key
+func pendingKey(familyId uint32, key []byte) string {
+	return string(logRecordKeyWithSeq(key, uint64(familyId)))
+}
+
 // 解析LogRecord的key，获取实际的key和事务序列号
 func parseLogRecordKey(key []byte) ([]byte, uint64) {
 	seqNo, n := binary.Uvarint(key)
@@ -0,0 +1,441 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const blobFileIdKey = "blob-file-id"
+
+// 加载数据目录中的blob文件
+// 重启之后不会继续写入之前的blob文件，末尾可能有写入过程中被中断的记录
+// 删除的blob文件id可能仍然被旧的记录引用，新的blob文件不会复用这些id
+func (db *DB) loadBlobFiles() error {
+	//流式写入过程中被中断的value没有被引用
+	if err := os.RemoveAll(filepath.Join(db.options.DirPath, streamStagingDirName)); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), data.BlobFileSuffix) {
+			continue
+		}
+		fid, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), data.BlobFileSuffix))
+		if err != nil {
+			return ErrDataDirectoryCorrupted
+		}
+		blobFile, err := data.OpenBlobFile(db.options.DirPath, uint32(fid))
+		if err != nil {
+			return err
+		}
+		blobFile.Cipher = db.cipher
+		db.blobFiles[uint32(fid)] = blobFile
+		if uint32(fid) >= db.nextBlobFileId {
+			db.nextBlobFileId = uint32(fid) + 1
+		}
+	}
+	nextBlobFileId, err := db.loadMaxFileValue(data.BlobFileIdFileName, data.OpenBlobFileIdFile)
+	if err != nil {
+		return err
+	}
+	db.nextBlobFileId = max(db.nextBlobFileId, nextBlobFileId)
+	return nil
+}
+
+// 根据索引中仍然引用的value重新计算blob文件中可以回收的数据量
+// merge之后指向blob记录的旧记录被清理了，不能从加载的数据文件中累加
+func (db *DB) loadBlobStats() error {
+	if len(db.blobFiles) == 0 {
+		return nil
+	}
+	liveSize := make(map[uint32]int64)
+	addLive := func(pos *data.LogRecordPos) error {
+		if pos.Blob != nil {
+			liveSize[pos.Blob.Fid] += int64(pos.Blob.Size)
+			return nil
+		}
+		if db.options.MergeOperator == nil {
+			return nil
+		}
+		//合并操作数链表末尾的完整值可能存储在blob文件中
+		chain, err := db.mergeOperandChain(pos)
+		if err != nil || len(chain) == 1 {
+			return err
+		}
+		base := chain[len(chain)-1]
+		dataFile := db.getDataFile(base.Fid)
+		if dataFile == nil {
+			return ErrDataFileNotFound
+		}
+		logRecord, _, err := dataFile.ReadLogRecord(base.Offset)
+		if err != nil {
+			return err
+		}
+		if logRecord.Blob {
+			blobPos := data.DecodeLogRecordPos(logRecord.Value)
+			liveSize[blobPos.Fid] += int64(blobPos.Size)
+		}
+		return nil
+	}
+	for _, cf := range db.families {
+		iterator := cf.index.Iterator(false)
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			if err := addLive(iterator.Value()); err != nil {
+				iterator.Close()
+				return err
+			}
+		}
+		iterator.Close()
+	}
+	db.blobStats = make(map[uint32]*fileStat, len(db.blobFiles))
+	for fid, blobFile := range db.blobFiles {
+		size, err := blobFile.IoManager.Size()
+		if err != nil {
+			return err
+		}
+		db.blobStats[fid] = &fileStat{reclaimableSize: max(size-liveSize[fid], 0)}
+	}
+	return nil
+}
+
+// 判断写入的记录是否需要将value存储到blob文件中
+func (db *DB) isBlobRecord(logRecord *data.LogRecord) bool {
+	return db.options.BlobValueThreshold > 0 && logRecord.Type == data.LogRecordNormal &&
+		!logRecord.Blob && len(logRecord.Value) >= db.options.BlobValueThreshold
+}
+
+// 将value写入到blob文件中，返回value为blob记录位置的新记录
+// 在访问此方法前必须得有互斥锁
+func (db *DB) appendBlobRecord(logRecord *data.LogRecord) (*data.LogRecord, error) {
+	blobRecord := &data.LogRecord{
+		Key:        logRecord.Key,
+		Value:      logRecord.Value,
+		Type:       data.LogRecordNormal,
+		Expire:     logRecord.Expire,
+		FamilyId:   logRecord.FamilyId,
+		Compressed: db.options.Compression && len(logRecord.Value) >= db.options.CompressionMinSize,
+	}
+	encRecord, size := data.EncodeLogRecord(blobRecord)
+	size += db.cipher.Overhead()
+	if err := db.prepareActiveBlobFile(size); err != nil {
+		return nil, err
+	}
+	blobPos := &data.LogRecordPos{Fid: db.activeBlobFile.FileId, Offset: db.activeBlobFile.WriteOff, Size: uint32(size)}
+	if err := db.activeBlobFile.Write(encRecord); err != nil {
+		return nil, err
+	}
+	//blob记录需要在指向它的记录之前持久化
+	if db.options.SyncWrites {
+		if err := db.activeBlobFile.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	return &data.LogRecord{
+		Key:      logRecord.Key,
+		Value:    data.EncodeLogRecordPos(blobPos),
+		Type:     logRecord.Type,
+		Expire:   logRecord.Expire,
+		FamilyId: logRecord.FamilyId,
+		Blob:     true,
+	}, nil
+}
+
+// 准备写入size字节的blob文件，blob文件写满之后打开新的blob文件
+// 在访问此方法前必须得有互斥锁
+func (db *DB) prepareActiveBlobFile(size int64) error {
+	if db.activeBlobFile != nil && db.activeBlobFile.WriteOff+size > db.options.BlobFileSize {
+		if err := db.activeBlobFile.Sync(); err != nil {
+			return err
+		}
+		db.activeBlobFile = nil
+	}
+	if db.activeBlobFile == nil {
+		blobFile, err := data.OpenBlobFile(db.options.DirPath, db.nextBlobFileId)
+		if err != nil {
+			return err
+		}
+		blobFile.Cipher = db.cipher
+		db.blobFiles[db.nextBlobFileId] = blobFile
+		db.activeBlobFile = blobFile
+		db.nextBlobFileId++
+	}
+	return nil
+}
+
+// 读取记录在blob文件中的value
+func readBlobValue(getBlobFile func(fid uint32) *data.DataFile, logRecord *data.LogRecord) ([]byte, error) {
+	blobPos := data.DecodeLogRecordPos(logRecord.Value)
+	blobFile := getBlobFile(blobPos.Fid)
+	if blobFile == nil {
+		return nil, ErrDataFileNotFound
+	}
+	blobRecord, _, err := blobFile.ReadLogRecord(blobPos.Offset)
+	if err != nil {
+		return nil, err
+	}
+	if !isBlobRecordOf(blobRecord, logRecord) {
+		return nil, ErrBlobRecordMismatch
+	}
+	return blobRecord.Value, nil
+}
+
+// 判断blob记录是否是logRecord指向的value，两者的key和列族需要相同
+// 事务提交和merge重写的记录的序列号可能不同，只比较实际的key
+func isBlobRecordOf(blobRecord *data.LogRecord, logRecord *data.LogRecord) bool {
+	blobKey, _ := parseLogRecordKey(blobRecord.Key)
+	realKey, _ := parseLogRecordKey(logRecord.Key)
+	return blobRecord.FamilyId == logRecord.FamilyId && bytes.Equal(blobKey, realKey)
+}
+
+// 根据文件id找到对应的blob文件
+// 在访问此方法前必须得有互斥锁
+func (db *DB) getBlobFile(fid uint32) *data.DataFile {
+	return db.blobFiles[fid]
+}
+
+// 引用当前所有的blob文件，需要和pinDataFiles一起调用
+// 在访问此方法前必须得有互斥锁
+func (db *DB) pinBlobFiles() map[uint32]*data.DataFile {
+	blobFiles := make(map[uint32]*data.DataFile, len(db.blobFiles))
+	for fid, blobFile := range db.blobFiles {
+		blobFiles[fid] = blobFile
+		db.fileRefs[blobFile]++
+	}
+	return blobFiles
+}
+
+// 所有blob文件的大小
+// 在访问此方法前必须得有互斥锁
+func (db *DB) blobFilesSize() int64 {
+	var size int64
+	for _, blobFile := range db.blobFiles {
+		if fileSize, err := blobFile.IoManager.Size(); err == nil {
+			size += fileSize
+		}
+	}
+	return size
+}
+
+// 索引中指向pos的key失效了，value所在的blob记录可以被回收
+// 在访问此方法前必须得有互斥锁
+func (db *DB) markBlobStale(pos *data.LogRecordPos) {
+	if pos.Blob == nil {
+		return
+	}
+	if stat := db.blobStats[pos.Blob.Fid]; stat != nil {
+		stat.reclaimableSize += int64(pos.Blob.Size)
+	} else {
+		db.blobStats[pos.Blob.Fid] = &fileStat{reclaimableSize: int64(pos.Blob.Size)}
+	}
+}
+
+// 所有blob文件的统计信息，按照文件id排序，blob文件不统计LiveKeys
+// 在访问此方法前必须得有互斥锁
+func (db *DB) getBlobFileStats() []FileStat {
+	var stats []FileStat
+	for fid, blobFile := range db.blobFiles {
+		fileStat := FileStat{Fid: fid}
+		if size, err := blobFile.IoManager.Size(); err == nil {
+			fileStat.Size = size
+		}
+		if stat := db.blobStats[fid]; stat != nil {
+			fileStat.ReclaimableSize = stat.reclaimableSize
+		}
+		stats = append(stats, fileStat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Fid < stats[j].Fid
+	})
+	return stats
+}
+
+// 判断blob文件是否需要使用当前的密钥重新加密，merge数据文件时只重写blob记录的位置
+// 一个blob文件只在一次打开期间写入，所有的记录使用相同的密钥，只需要检查第一条记录
+// 在访问此方法前必须得有互斥锁
+func (db *DB) blobFileNeedsReencryption(blobFile *data.DataFile) (bool, error) {
+	need, err := blobFile.NeedsReencryption(0)
+	//空文件或者只有写入过程中被中断的记录
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+	return need, err
+}
+
+// 重写使用之前的密钥加密或者没有加密的blob文件，在merge数据文件之后调用
+// 在访问此方法前必须得有isMergeing标识
+func (db *DB) reencryptBlobFiles() error {
+	db.mu.Lock()
+	var candidates []uint32
+	for fid, blobFile := range db.blobFiles {
+		if blobFile == db.activeBlobFile {
+			continue
+		}
+		need, err := db.blobFileNeedsReencryption(blobFile)
+		if err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		if need {
+			candidates = append(candidates, fid)
+		}
+	}
+	db.mu.Unlock()
+	return db.compactBlobFiles(candidates)
+}
+
+// MergeBlobFiles 回收无效数据占比达到garbageRatio的blob文件，需要重新加密的blob文件也会被回收
+// 文件中仍然有效的value会重写到当前的blob文件中，并写入指向新位置的记录
+func (db *DB) MergeBlobFiles(garbageRatio float32) error {
+	db.mu.Lock()
+	if db.isMergeing {
+		db.mu.Unlock()
+		return ErrMergeIsProgress
+	}
+	var candidates []uint32
+	for fid, blobFile := range db.blobFiles {
+		//正在写入的blob文件不回收
+		if blobFile == db.activeBlobFile {
+			continue
+		}
+		size, err := blobFile.IoManager.Size()
+		if err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		var reclaimableSize int64
+		if stat := db.blobStats[fid]; stat != nil {
+			reclaimableSize = stat.reclaimableSize
+		}
+		need, err := db.blobFileNeedsReencryption(blobFile)
+		if err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		if need || size == 0 || float32(reclaimableSize)/float32(size) >= garbageRatio {
+			candidates = append(candidates, fid)
+		}
+	}
+	db.isMergeing = true
+	db.mu.Unlock()
+	defer func() {
+		db.mu.Lock()
+		db.isMergeing = false
+		db.mu.Unlock()
+	}()
+	return db.compactBlobFiles(candidates)
+}
+
+// 依次处理每个文件，处理单个文件期间阻塞写入
+// 在访问此方法前必须得有isMergeing标识
+func (db *DB) compactBlobFiles(candidates []uint32) error {
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i] < candidates[j]
+	})
+	for _, fid := range candidates {
+		db.mu.Lock()
+		err := db.compactBlobFile(fid)
+		db.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 将blob文件中的有效value重写到当前的blob文件中，然后删除这个blob文件
+// 在访问此方法前必须得有互斥锁
+func (db *DB) compactBlobFile(fid uint32) error {
+	blobFile := db.blobFiles[fid]
+	if blobFile == nil {
+		return nil
+	}
+	now := time.Now().UnixNano()
+	var offset int64 = 0
+	for {
+		blobRecord, size, err := blobFile.ReadLogRecord(offset)
+		if err != nil {
+			//文件末尾写入过程中被中断的记录没有被引用
+			if err == io.EOF || err == io.ErrUnexpectedEOF || err == data.ErrInvalidCRC {
+				break
+			}
+			return err
+		}
+		blobOffset := offset
+		offset += size
+		realKey, _ := parseLogRecordKey(blobRecord.Key)
+		cf := db.families[blobRecord.FamilyId]
+		if cf == nil {
+			return ErrDataDirectoryCorrupted
+		}
+		logRecordPos := cf.index.Get(realKey)
+		if logRecordPos == nil || logRecordPos.IsExpired(now) {
+			continue
+		}
+		isBlob := func(pos *data.LogRecordPos) bool {
+			return pos.Blob != nil && pos.Blob.Fid == fid && pos.Blob.Offset == blobOffset
+		}
+		if !isBlob(logRecordPos) {
+			//value仍然被合并操作数的链表引用时，将链表合并为完整的值
+			chain, err := db.mergeOperandChain(logRecordPos)
+			if err != nil {
+				return err
+			}
+			for _, pos := range chain[1:] {
+				if isBlob(pos) {
+					if err := db.collapseMergeOperands(cf, realKey, chain); err != nil {
+						return err
+					}
+					break
+				}
+			}
+			continue
+		}
+		//重新写入value，写入时会存储到当前的blob文件中
+		pos, err := db.appendLogRecord(&data.LogRecord{
+			Key:      logRecordKeyWithSeq(realKey, nonTransactionSeqNo),
+			Value:    blobRecord.Value,
+			Type:     data.LogRecordNormal,
+			Expire:   blobRecord.Expire,
+			FamilyId: blobRecord.FamilyId,
+		})
+		if err != nil {
+			return err
+		}
+		db.markLive(pos)
+		if oldPos := cf.index.Put(realKey, pos); oldPos != nil {
+			db.markStale(oldPos)
+		}
+	}
+
+	//重写的数据持久化之后才能删除blob文件
+	if db.activeBlobFile != nil {
+		if err := db.activeBlobFile.Sync(); err != nil {
+			return err
+		}
+	}
+	if db.activeFile != nil {
+		if err := db.activeFile.Sync(); err != nil {
+			return err
+		}
+	}
+	//删除之后重启时也不能复用这个文件id
+	if err := db.appendFileValue(data.OpenBlobFileIdFile, blobFileIdKey, db.nextBlobFileId); err != nil {
+		return err
+	}
+	delete(db.blobFiles, fid)
+	delete(db.blobStats, fid)
+	if err := db.closeObsoleteFile(blobFile); err != nil {
+		return err
+	}
+	return os.Remove(data.GetBlobFileName(db.options.DirPath, fid))
+}
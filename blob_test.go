@@ -0,0 +1,224 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 追加合并，操作数依次追加到已有的值之后
+type appendMergeOperator struct{}
+
+func (appendMergeOperator) Merge(key []byte, existing []byte, operands [][]byte) ([]byte, error) {
+	value := append([]byte(nil), existing...)
+	for _, operand := range operands {
+		value = append(value, operand...)
+	}
+	return value, nil
+}
+
+func blobTestValue(i int, n int) []byte {
+	return bytes.Repeat([]byte{byte('a' + i%26)}, n)
+}
+
+func countBlobFiles(t *testing.T, dir string) int {
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	var count int
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), data.BlobFileSuffix) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestDB_BlobFiles(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-blob")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.BlobValueThreshold = 1024
+	opts.BlobFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), blobTestValue(i, 4096)))
+	}
+	//小于阈值的value仍然写入数据文件
+	assert.Nil(t, db.Put([]byte("small"), []byte("value")))
+	assert.Greater(t, countBlobFiles(t, dir), 1)
+	info, err := os.Stat(data.GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	assert.Less(t, info.Size(), int64(16*1024))
+	value, err := db.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, blobTestValue(10, 4096), value)
+
+	//快照读取时blob文件被回收也不受影响
+	snapshot := db.NewSnapshot()
+	for i := 0; i < 80; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), blobTestValue(i+1, 4096)))
+	}
+	stat := db.Stat()
+	var reclaimable int64
+	for _, fileStat := range stat.BlobFileStats {
+		reclaimable += fileStat.ReclaimableSize
+	}
+	assert.Greater(t, reclaimable, int64(80*4096))
+	blobFiles := countBlobFiles(t, dir)
+	assert.Nil(t, db.MergeBlobFiles(0.5))
+	assert.Less(t, countBlobFiles(t, dir), blobFiles)
+	value, err = snapshot.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, blobTestValue(0, 4096), value)
+	snapshot.Release()
+
+	//merge只重写blob记录的位置
+	assert.Nil(t, db.Merge())
+	for i := 0; i < 100; i++ {
+		value, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		if i < 80 {
+			assert.Equal(t, blobTestValue(i+1, 4096), value)
+		} else {
+			assert.Equal(t, blobTestValue(i, 4096), value)
+		}
+	}
+	assert.Nil(t, db.Close())
+
+	//重启之后从hint文件和数据文件中恢复blob记录的位置
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 101, len(db.ListKeys()))
+	assert.Nil(t, db.Delete(utils.GetTestKey(99)))
+	assert.Nil(t, db.MergeBlobFiles(0))
+	value, err = db.Get(utils.GetTestKey(90))
+	assert.Nil(t, err)
+	assert.Equal(t, blobTestValue(90, 4096), value)
+	value, err = db.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, blobTestValue(1, 4096), value)
+	_, err = db.Get(utils.GetTestKey(99))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_MergeBlobFiles_MergeOperand(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-blob-operand")
+	opts.DirPath = dir
+	opts.MergeOperator = appendMergeOperator{}
+	opts.BlobValueThreshold = 1024
+	opts.BlobFileSize = 16 * 1024
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+
+	//合并操作数的链表引用blob文件中的value
+	key := []byte("operand")
+	assert.Nil(t, db.Put(key, blobTestValue(0, 4096)))
+	assert.Nil(t, db.MergeValue(key, []byte("-suffix")))
+	for i := 1; i < 10; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), blobTestValue(i, 4096)))
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.MergeBlobFiles(0))
+	_, err = os.Stat(filepath.Join(dir, "000000000"+data.BlobFileSuffix))
+	assert.True(t, os.IsNotExist(err))
+	value, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, append(blobTestValue(0, 4096), []byte("-suffix")...), value)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_BlobFiles_Restart(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-blob-restart")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.BlobValueThreshold = 1024
+	opts.BlobFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), blobTestValue(i, 4096)))
+	}
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), blobTestValue(i+1, 4096)))
+	}
+	//merge清理了指向旧的blob记录的记录，重启之后仍然可以统计blob文件中的无效数据
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	var reclaimable int64
+	var maxFid uint32
+	for _, fileStat := range db.Stat().BlobFileStats {
+		reclaimable += fileStat.ReclaimableSize
+		maxFid = max(maxFid, fileStat.Fid)
+	}
+	assert.GreaterOrEqual(t, reclaimable, int64(50*4096))
+
+	//删除所有的blob文件之后，新的blob文件不会复用之前的文件id
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.MergeBlobFiles(0))
+	assert.Equal(t, 0, countBlobFiles(t, dir))
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(0), blobTestValue(0, 4096)))
+	stats := db.Stat().BlobFileStats
+	assert.Equal(t, 1, len(stats))
+	assert.Greater(t, stats[0].Fid, maxFid)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_BlobFiles_KeyMismatch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-blob-mismatch")
+	opts.DirPath = dir
+	opts.BlobValueThreshold = 1024
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	assert.Nil(t, db.Put(utils.GetTestKey(1), blobTestValue(1, 4096)))
+	//key 0的记录指向key 1的blob记录，例如blob文件id被复用
+	db.mu.Lock()
+	pos, err := db.appendLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeq(utils.GetTestKey(0), nonTransactionSeqNo),
+		Value: data.EncodeLogRecordPos(db.index.Get(utils.GetTestKey(1)).Blob),
+		Type:  data.LogRecordNormal,
+		Blob:  true,
+	})
+	assert.Nil(t, err)
+	db.index.Put(utils.GetTestKey(0), pos)
+	db.mu.Unlock()
+
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrBlobRecordMismatch, err)
+	_, err = db.GetReader(utils.GetTestKey(0))
+	assert.Equal(t, ErrBlobRecordMismatch, err)
+	value, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, blobTestValue(1, 4096), value)
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,126 @@
+package bitcask_go
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// 读缓存的分片数量，不同分片使用不同的锁
+const readCacheShards = 16
+
+// 每个缓存项除value之外额外占用的内存，用于估算缓存的大小
+const readCacheEntryOverhead = 64
+
+// 读缓存中value的位置，数据文件只会追加写入，同一个位置的value不会改变
+type readCacheKey struct {
+	fid    uint32
+	offset int64
+}
+
+type readCacheEntry struct {
+	key   readCacheKey
+	value []byte
+}
+
+// 读缓存，按照value所在的位置缓存读取到的value，每个分片使用LRU淘汰
+// key被覆盖之后索引指向新的位置，旧的缓存项不会再被访问，最终会被淘汰
+type readCache struct {
+	shards [readCacheShards]*readCacheShard
+	hits   uint64
+	misses uint64
+}
+
+type readCacheShard struct {
+	mu       *sync.Mutex
+	capacity int64 //分片可以使用的内存大小
+	size     int64 //分片已经使用的内存大小
+	lru      *list.List
+	items    map[readCacheKey]*list.Element
+}
+
+// 创建读缓存，capacity为所有分片总共可以使用的内存大小，小于等于0表示不缓存
+func newReadCache(capacity int64) *readCache {
+	if capacity <= 0 {
+		return nil
+	}
+	c := &readCache{}
+	for i := range c.shards {
+		c.shards[i] = &readCacheShard{
+			mu:       new(sync.Mutex),
+			capacity: capacity / readCacheShards,
+			lru:      list.New(),
+			items:    make(map[readCacheKey]*list.Element),
+		}
+	}
+	return c
+}
+
+func (c *readCache) shard(key readCacheKey) *readCacheShard {
+	h := key.fid*0x9e3779b1 ^ uint32(key.offset) ^ uint32(key.offset>>32)
+	return c.shards[(h^h>>16)%readCacheShards]
+}
+
+// 读取缓存的value，返回的value可以被调用者修改
+func (c *readCache) get(fid uint32, offset int64) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	key := readCacheKey{fid: fid, offset: offset}
+	s := c.shard(key)
+	s.mu.Lock()
+	elem, ok := s.items[key]
+	var value []byte
+	if ok {
+		s.lru.MoveToFront(elem)
+		value = append([]byte(nil), elem.Value.(*readCacheEntry).value...)
+	}
+	s.mu.Unlock()
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+	return value, ok
+}
+
+// 缓存value，超过分片大小的value不缓存
+func (c *readCache) put(fid uint32, offset int64, value []byte) {
+	if c == nil {
+		return
+	}
+	key := readCacheKey{fid: fid, offset: offset}
+	s := c.shard(key)
+	charge := int64(len(value)) + readCacheEntryOverhead
+	if charge > s.capacity {
+		return
+	}
+	value = append([]byte(nil), value...)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.items[key]; ok {
+		s.lru.MoveToFront(elem)
+		return
+	}
+	s.items[key] = s.lru.PushFront(&readCacheEntry{key: key, value: value})
+	s.size += charge
+	//淘汰最久没有访问的缓存项
+	for s.size > s.capacity {
+		s.remove(s.lru.Back())
+	}
+}
+
+// 在访问此方法前必须得有分片的互斥锁
+func (s *readCacheShard) remove(elem *list.Element) {
+	entry := s.lru.Remove(elem).(*readCacheEntry)
+	delete(s.items, entry.key)
+	s.size -= int64(len(entry.value)) + readCacheEntryOverhead
+}
+
+// 缓存命中和未命中的次数
+func (c *readCache) stats() (hits uint64, misses uint64) {
+	if c == nil {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
@@ -0,0 +1,143 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadCache(t *testing.T) {
+	//每个分片可以缓存两个value
+	c := newReadCache(readCacheShards * 2 * (100 + readCacheEntryOverhead))
+	shard := c.shard(readCacheKey{fid: 1, offset: 0})
+	var offsets []int64
+	for offset := int64(0); len(offsets) < 3; offset++ {
+		if c.shard(readCacheKey{fid: 1, offset: offset}) == shard {
+			offsets = append(offsets, offset)
+		}
+	}
+	c.put(1, offsets[0], utils.RandomValue(100)[:100])
+	c.put(1, offsets[1], utils.RandomValue(100)[:100])
+	_, ok := c.get(1, offsets[0])
+	assert.True(t, ok)
+	//淘汰最久没有访问的value
+	c.put(1, offsets[2], utils.RandomValue(100)[:100])
+	_, ok = c.get(1, offsets[1])
+	assert.False(t, ok)
+	_, ok = c.get(1, offsets[0])
+	assert.True(t, ok)
+
+	//返回的value被修改不影响缓存
+	value, _ := c.get(1, offsets[2])
+	value[0] ^= 0xff
+	cached, _ := c.get(1, offsets[2])
+	assert.NotEqual(t, value, cached)
+
+	hits, misses := c.stats()
+	assert.Equal(t, uint64(4), hits)
+	assert.Equal(t, uint64(1), misses)
+
+	//未配置缓存
+	var empty *readCache
+	empty.put(1, 0, []byte("a"))
+	_, ok = empty.get(1, 0)
+	assert.False(t, ok)
+}
+
+func TestDB_ReadCache(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-read-cache")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.ReadCacheSize = 1024 * 1024
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 1000; i++ {
+		values[i] = utils.RandomValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	for j := 0; j < 2; j++ {
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, values[1], val)
+	}
+	stat := db.Stat()
+	assert.Equal(t, uint64(1), stat.CacheHits)
+	assert.Equal(t, uint64(1), stat.CacheMisses)
+
+	//覆盖之后读取新的value
+	values[1] = []byte("new value")
+	assert.Nil(t, db.Put(utils.GetTestKey(1), values[1]))
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, values[1], val)
+
+	//merge生成的文件使用新的文件id，缓存的旧位置不会被读取
+	for i := 0; i < 1000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 1000; i += 2 {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	for i := 1; i < 1000; i += 2 {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_ReadCache_Concurrent(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-read-cache-concurrent")
+	opts.DirPath = dir
+	opts.ReadCacheSize = 1024 * 1024
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.PutWithTTL(utils.GetTestKey(100), utils.GetTestKey(100), time.Millisecond))
+	time.Sleep(2 * time.Millisecond)
+
+	//读取只持有读锁，可以和写入以及过期key的删除并发执行
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				val, err := db.Get(utils.GetTestKey(i))
+				assert.Nil(t, err)
+				assert.Equal(t, utils.GetTestKey(i), val)
+				_, err = db.Get(utils.GetTestKey(100))
+				assert.Equal(t, ErrKeyNotFound, err)
+				if i%10 == g {
+					assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Equal(t, 100, len(db.ListKeys()))
+	assert.Nil(t, db.Close())
+}
+
+func TestOpen_InvalidReadCacheSize(t *testing.T) {
+	opts := DefaultOptions
+	opts.ReadCacheSize = -1
+	_, err := Open(opts)
+	assert.NotNil(t, err)
+}
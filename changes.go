@@ -0,0 +1,358 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const changesHorizonKey = "changes-horizon"
+
+// ChangePosition 变更流中的位置，即数据文件id和文件中的偏移
+type ChangePosition struct {
+	Fid    uint32
+	Offset int64
+}
+
+// Change 一条已经提交的数据变更
+type Change struct {
+	Type     WatchEventType //变更类型，和Watch的事件类型一致
+	Key      []byte
+	Value    []byte         //WatchPut为新的值，WatchDeleteRange为结束key，WatchMerge为操作数
+	FamilyId uint32         //所属的列族id
+	SeqNo    uint64         //WriteBatch和事务提交时的事务序列号，非事务写入为0
+	Pos      ChangePosition //变更记录在数据文件中的位置
+}
+
+// ChangeIterator 按照写入顺序遍历已经提交的数据变更
+// 迭代器会引用数据文件，使用完毕之后需要调用Close释放
+type ChangeIterator struct {
+	db           *DB
+	files        map[uint32]*data.DataFile //迭代器引用的数据文件
+	blobs        map[uint32]*data.DataFile //迭代器引用的blob文件
+	merged       *mergeInfo                //创建迭代器时最近一次merge的信息，merge生成的文件中没有新的变更
+	fid          uint32                    //当前读取的文件id
+	offset       int64                     //当前读取的偏移
+	resume       ChangePosition            //已经返回的变更之后的位置
+	curr         *Change                   //当前的变更
+	pending      []*Change                 //已经提交的事务中还没有返回的变更
+	pendingBegin ChangePosition            //当前事务开始的位置
+	pendingEnd   ChangePosition            //当前事务之后的位置
+	txnStart     map[uint64]ChangePosition //暂存的事务第一条记录的位置
+	txnChanges   map[uint64][]*Change      //暂存的还没有读到完成标记的事务
+	err          error
+	closed       bool
+}
+
+// ChangesSince 从指定的位置开始遍历已经提交的数据变更，事务中的变更在读到事务完成的标记之后才会返回
+// merge会删除之前的数据文件，位置在最近一次merge之前时返回ErrChangesUnavailable
+// 位置超出了数据文件的末尾时返回ErrInvalidChangePosition
+func (db *DB) ChangesSince(pos ChangePosition) *ChangeIterator {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	it := &ChangeIterator{
+		db:         db,
+		fid:        pos.Fid,
+		offset:     pos.Offset,
+		resume:     pos,
+		txnStart:   make(map[uint64]ChangePosition),
+		txnChanges: make(map[uint64][]*Change),
+	}
+	if pos.Fid < db.mergeHorizon || db.mergeInfo.isMergeFile(pos.Fid) {
+		it.err = ErrChangesUnavailable
+		it.closed = true
+		return it
+	}
+	if !db.validChangePosition(pos) {
+		it.err = ErrInvalidChangePosition
+		it.closed = true
+		return it
+	}
+	it.merged = db.mergeInfo
+	it.files = db.pinDataFiles()
+	it.blobs = db.pinBlobFiles()
+	return it
+}
+
+// 判断位置是否在已经写入的数据范围内，不存在的数据文件只能从头开始读取
+// 在访问此方法前必须得有互斥锁
+func (db *DB) validChangePosition(pos ChangePosition) bool {
+	if pos.Offset < 0 {
+		return false
+	}
+	dataFile := db.getDataFile(pos.Fid)
+	if dataFile == nil {
+		if pos.Offset > 0 {
+			return false
+		}
+		return db.activeFile == nil || pos.Fid <= db.activeFile.FileId
+	}
+	if dataFile == db.activeFile {
+		return pos.Offset <= dataFile.WriteOff
+	}
+	size, err := dataFile.IoManager.Size()
+	return err == nil && pos.Offset <= size
+}
+
+// ChangesHorizon 最早可以读取变更的位置，之前的数据文件已经被merge了
+func (db *DB) ChangesHorizon() ChangePosition {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return ChangePosition{Fid: db.mergeHorizon}
+}
+
+// Next读取下一条变更，没有更多的变更或者出错时返回false
+func (it *ChangeIterator) Next() bool {
+	if it.closed || it.err != nil {
+		return false
+	}
+	if len(it.pending) > 0 {
+		it.curr, it.pending = it.pending[0], it.pending[1:]
+		if len(it.pending) == 0 {
+			it.resume = it.pendingEnd
+		}
+		return true
+	}
+	for {
+		dataFile, limit, err := it.currentFile()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if dataFile == nil {
+			return false
+		}
+		//活跃文件已经读完，等待后续写入
+		if limit >= 0 && it.offset >= limit {
+			return false
+		}
+		logRecord, size, err := dataFile.ReadLogRecord(it.offset)
+		if err != nil {
+			if err == io.EOF {
+				if !it.nextFile() {
+					return false
+				}
+				continue
+			}
+			it.err = err
+			return false
+		}
+		if logRecord.Blob {
+			if logRecord.Value, err = readBlobValue(it.blobFile, logRecord); err != nil {
+				it.err = err
+				return false
+			}
+		}
+		pos := ChangePosition{Fid: it.fid, Offset: it.offset}
+		it.offset += size
+		end := ChangePosition{Fid: it.fid, Offset: it.offset}
+		realKey, seqNo := parseLogRecordKey(logRecord.Key)
+
+		if seqNo == nonTransactionSeqNo {
+			it.curr, it.resume = newChange(logRecord, realKey, seqNo, pos), end
+			return true
+		}
+		//事务完成，返回事务中所有的变更
+		if logRecord.Type == data.LogRecordTxnFinished {
+			changes := it.txnChanges[seqNo]
+			delete(it.txnChanges, seqNo)
+			if len(changes) == 0 {
+				it.resume = end
+				continue
+			}
+			it.curr, it.pending = changes[0], changes[1:]
+			it.pendingBegin, it.pendingEnd = it.txnStart[seqNo], end
+			delete(it.txnStart, seqNo)
+			if len(it.pending) == 0 {
+				it.resume = end
+			}
+			return true
+		}
+		if _, ok := it.txnStart[seqNo]; !ok {
+			it.txnStart[seqNo] = pos
+		}
+		it.txnChanges[seqNo] = append(it.txnChanges[seqNo], newChange(logRecord, realKey, seqNo, pos))
+	}
+}
+
+// Change当前的变更
+func (it *ChangeIterator) Change() *Change {
+	return it.curr
+}
+
+// Position下一次开始读取变更的位置，可以作为ChangesSince的参数继续读取
+// 事务中的变更没有全部返回时，位置为事务开始的位置
+func (it *ChangeIterator) Position() ChangePosition {
+	if len(it.pending) > 0 {
+		return it.pendingBegin
+	}
+	return it.resume
+}
+
+// Err遍历过程中出现的错误
+func (it *ChangeIterator) Err() error {
+	return it.err
+}
+
+// Close关闭迭代器，释放对数据文件的引用
+func (it *ChangeIterator) Close() {
+	if it.closed {
+		return
+	}
+	it.closed = true
+	it.db.unpinFiles(it.files, it.blobs)
+	it.files, it.blobs = nil, nil
+}
+
+// 获取value所在的blob文件，迭代器创建之后新生成的blob文件从数据库中获取并引用
+func (it *ChangeIterator) blobFile(fid uint32) *data.DataFile {
+	if blobFile := it.blobs[fid]; blobFile != nil {
+		return blobFile
+	}
+	it.db.mu.Lock()
+	defer it.db.mu.Unlock()
+	blobFile := it.db.getBlobFile(fid)
+	if blobFile != nil {
+		it.blobs[fid] = blobFile
+		it.db.fileRefs[blobFile]++
+	}
+	return blobFile
+}
+
+// 获取当前读取的数据文件，以及可以读取的上限，-1表示读取到文件末尾
+func (it *ChangeIterator) currentFile() (*data.DataFile, int64, error) {
+	it.db.mu.RLock()
+	if dataFile := it.files[it.fid]; dataFile != nil {
+		var limit int64 = -1
+		if it.db.activeFile == dataFile {
+			limit = dataFile.WriteOff
+		}
+		it.db.mu.RUnlock()
+		return dataFile, limit, nil
+	}
+	it.db.mu.RUnlock()
+
+	//需要引用新的数据文件
+	it.db.mu.Lock()
+	defer it.db.mu.Unlock()
+	for {
+		dataFile := it.files[it.fid]
+		if dataFile == nil {
+			//没有引用的文件已经被merge替换了
+			if it.fid < it.db.mergeHorizon {
+				return nil, 0, ErrChangesUnavailable
+			}
+			//迭代器创建之后新生成的数据文件
+			dataFile = it.db.getDataFile(it.fid)
+		}
+		if dataFile == nil {
+			//位置所在的文件不存在，从下一个文件开始读取
+			next := it.nextFileId()
+			if next == nil {
+				return nil, 0, nil
+			}
+			it.fid, it.offset = *next, 0
+			continue
+		}
+		if it.files[it.fid] == nil {
+			it.files[it.fid] = dataFile
+			it.db.fileRefs[dataFile]++
+		}
+		if it.db.activeFile == dataFile {
+			return dataFile, dataFile.WriteOff, nil
+		}
+		return dataFile, -1, nil
+	}
+}
+
+// 跳转到下一个数据文件，没有更新的文件时返回false
+func (it *ChangeIterator) nextFile() bool {
+	it.db.mu.RLock()
+	defer it.db.mu.RUnlock()
+	next := it.nextFileId()
+	if next == nil {
+		return false
+	}
+	it.fid, it.offset = *next, 0
+	return true
+}
+
+// 找到比当前文件id大的最小的文件id
+// 在访问此方法前必须得有数据库的读锁
+func (it *ChangeIterator) nextFileId() *uint32 {
+	var next *uint32
+	consider := func(fid uint32) {
+		//merge生成的文件中是重写的旧数据
+		if it.merged.isMergeFile(fid) || it.db.mergeInfo.isMergeFile(fid) {
+			return
+		}
+		if fid > it.fid && (next == nil || fid < *next) {
+			fid := fid
+			next = &fid
+		}
+	}
+	for fid := range it.files {
+		consider(fid)
+	}
+	for fid := range it.db.olderFiles {
+		consider(fid)
+	}
+	if it.db.activeFile != nil {
+		consider(it.db.activeFile.FileId)
+	}
+	return next
+}
+
+// 根据数据文件中的记录构造变更
+func newChange(logRecord *data.LogRecord, key []byte, seqNo uint64, pos ChangePosition) *Change {
+	change := &Change{
+		Key:      key,
+		Value:    logRecord.Value,
+		FamilyId: logRecord.FamilyId,
+		SeqNo:    seqNo,
+		Pos:      pos,
+	}
+	switch logRecord.Type {
+	case data.LogRecordNormal:
+		change.Type = WatchPut
+	case data.LogRecordDeleted:
+		change.Type, change.Value = WatchDelete, nil
+	case data.LogRecordRangeDeleted:
+		change.Type = WatchDeleteRange
+	case data.LogRecordMergeOperand:
+		change.Type = WatchMerge
+		_, change.Value = data.DecodeMergeOperand(logRecord.Value)
+	}
+	return change
+}
+
+// 加载最近一次merge的信息以及之后最早可以读取变更的文件id
+func (db *DB) loadMergeHorizon() error {
+	mergeFinFileName := filepath.Join(db.options.DirPath, data.MergeFinishedFileName)
+	if _, err := os.Stat(mergeFinFileName); os.IsNotExist(err) {
+		return nil
+	}
+	info, err := db.readMergeInfo(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	db.mergeInfo, db.mergeHorizon = info, max(db.mergeHorizon, info.nonMergeFileId)
+	return nil
+}
+
+// 加载单独merge数据文件之后记录的变更起点
+func (db *DB) loadChangesHorizon() error {
+	horizon, err := db.loadMaxFileValue(data.ChangesHorizonFileName, data.OpenChangesHorizonFile)
+	if err != nil {
+		return err
+	}
+	db.mergeHorizon = max(db.mergeHorizon, horizon)
+	return nil
+}
+
+// 持久化单独merge数据文件之后的变更起点
+// 在访问此方法前必须得有互斥锁
+func (db *DB) writeChangesHorizon(horizon uint32) error {
+	return db.appendFileValue(data.OpenChangesHorizonFile, changesHorizonKey, horizon)
+}
@@ -0,0 +1,134 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_ChangesSince(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-changes")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 500; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	err = db.Delete(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(utils.GetTestKey(1000), []byte("a"))
+	assert.Nil(t, err)
+	err = wb.Put(utils.GetTestKey(1001), []byte("b"))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	//从头读取所有的变更，跨越多个数据文件
+	it := db.ChangesSince(ChangePosition{})
+	var changes []*Change
+	for it.Next() {
+		changes = append(changes, it.Change())
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, 503, len(changes))
+	assert.Equal(t, WatchDelete, changes[500].Type)
+	assert.Equal(t, utils.GetTestKey(0), changes[500].Key)
+	assert.Equal(t, db.seqNo, changes[501].SeqNo)
+	assert.Equal(t, db.seqNo, changes[502].SeqNo)
+	pos := it.Position()
+	it.Close()
+
+	//从上一次的位置继续读取
+	err = db.Put(utils.GetTestKey(2000), []byte("c"))
+	assert.Nil(t, err)
+	it = db.ChangesSince(pos)
+	assert.True(t, it.Next())
+	assert.Equal(t, WatchPut, it.Change().Type)
+	assert.Equal(t, utils.GetTestKey(2000), it.Change().Key)
+	assert.Equal(t, []byte("c"), it.Change().Value)
+	assert.False(t, it.Next())
+	pos = it.Position()
+	it.Close()
+
+	//merge之后之前的位置不再可用
+	err = db.Merge()
+	assert.Nil(t, err)
+	it = db.ChangesSince(ChangePosition{})
+	assert.False(t, it.Next())
+	assert.Equal(t, ErrChangesUnavailable, it.Err())
+	it.Close()
+	horizon := db.ChangesHorizon()
+	assert.True(t, horizon.Fid > pos.Fid)
+
+	err = db.Put(utils.GetTestKey(3000), []byte("d"))
+	assert.Nil(t, err)
+	it = db.ChangesSince(horizon)
+	assert.True(t, it.Next())
+	assert.Equal(t, utils.GetTestKey(3000), it.Change().Key)
+	it.Close()
+
+	//超出数据文件末尾的位置
+	it = db.ChangesSince(ChangePosition{Fid: horizon.Fid, Offset: 1 << 30})
+	assert.False(t, it.Next())
+	assert.Equal(t, ErrInvalidChangePosition, it.Err())
+	it.Close()
+	it = db.ChangesSince(ChangePosition{Fid: horizon.Fid + 100})
+	assert.False(t, it.Next())
+	assert.Equal(t, ErrInvalidChangePosition, it.Err())
+	it.Close()
+	it = db.ChangesSince(ChangePosition{Fid: horizon.Fid, Offset: -1})
+	assert.False(t, it.Next())
+	assert.Equal(t, ErrInvalidChangePosition, it.Err())
+	it.Close()
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_ChangesSince_PinNewFiles(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-changes-pin")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	it := db.ChangesSince(ChangePosition{})
+	//迭代器创建之后生成了多个新的数据文件
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	var count int
+	for it.Next() {
+		count++
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, 2000, count)
+
+	//关闭迭代器不会释放快照对数据文件的引用
+	snapshot := db.NewSnapshot()
+	it.Close()
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.Merge())
+	for i := 0; i < 2000; i++ {
+		_, err := snapshot.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	snapshot.Release()
+	assert.Empty(t, db.fileRefs)
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,70 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Checkpoint 在dir中创建数据库的检查点，可以作为独立的数据库打开
+// 旧的数据文件和hint文件使用硬链接，不需要拷贝数据，dir必须不存在或者为空
+// 检查点和数据库共享的文件都不会再被修改，之后任何一方的写入都不会影响另一方
+func (db *DB) Checkpoint(dir string) error {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return ErrCheckpointDirNotEmpty
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	//持久化并转换活跃文件，之后所有的数据都在旧的数据文件中
+	if db.activeFile != nil && db.activeFile.WriteOff > 0 {
+		if err := db.rotateActiveFile(); err != nil {
+			return err
+		}
+	}
+	//之后的value写入到新的blob文件中，已有的blob文件都不会再被修改
+	if db.activeBlobFile != nil {
+		if err := db.activeBlobFile.Sync(); err != nil {
+			return err
+		}
+		db.activeBlobFile = nil
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fileName := entry.Name()
+		if entry.IsDir() || fileName == fileLockName || fileName == data.SeqNoFileName {
+			continue
+		}
+		src, dest := filepath.Join(db.options.DirPath, fileName), filepath.Join(dir, fileName)
+		//新的活跃文件是空的，检查点打开之后会写入这个文件，需要单独拷贝
+		isActiveFile := db.activeFile != nil &&
+			src == data.GetDataFileName(db.options.DirPath, db.activeFile.FileId)
+		if !isActiveFile && checkpointCanLink(fileName) {
+			if err := os.Link(src, dest); err == nil {
+				continue
+			}
+			//不支持硬链接时，例如不在同一个文件系统中，直接拷贝
+		}
+		if _, _, err := utils.CopyFile(src, dest); err != nil {
+			return err
+		}
+	}
+	//保存当前事务序列号
+	return db.writeSeqNoFile(dir)
+}
+
+// 判断文件写入之后是否不会再被修改，这样的文件可以使用硬链接
+// 旧的数据文件、hint文件、blob文件和merge生成的Hint文件只会被替换或者删除，不会原地修改
+func checkpointCanLink(fileName string) bool {
+	return strings.HasSuffix(fileName, data.DataFileNameSuffix) ||
+		strings.HasSuffix(fileName, data.DataHintFileSuffix) ||
+		strings.HasSuffix(fileName, data.BlobFileSuffix) ||
+		fileName == data.HintFileName
+}
@@ -0,0 +1,66 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Checkpoint(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-checkpoint")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	checkpointDir, _ := os.MkdirTemp("", "bitcask-go-checkpoint-dir")
+	defer os.RemoveAll(checkpointDir)
+	err = db.Checkpoint(checkpointDir)
+	assert.Nil(t, err)
+	err = db.Checkpoint(checkpointDir)
+	assert.Equal(t, ErrCheckpointDirNotEmpty, err)
+
+	//旧的数据文件使用硬链接，和原数据库共享同一个文件
+	info1, err := os.Stat(data.GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	info2, err := os.Stat(data.GetDataFileName(checkpointDir, 0))
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(info1, info2))
+	_, err = os.Stat(filepath.Join(checkpointDir, fileLockName))
+	assert.True(t, os.IsNotExist(err))
+
+	//检查点之后的写入互不影响
+	for i := 1000; i < 1500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	opts2 := opts
+	opts2.DirPath = checkpointDir
+	db2, err := Open(opts2)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(db2.ListKeys()))
+	assert.Nil(t, db2.Delete(utils.GetTestKey(0)))
+	assert.Nil(t, db2.Put([]byte("checkpoint"), utils.RandomValue(64)))
+	assert.Equal(t, 1000, len(db2.ListKeys()))
+	assert.Nil(t, db2.Close())
+
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("checkpoint"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1500, len(db.ListKeys()))
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,230 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/index"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultFamilyName        = "default"
+	defaultFamilyId   uint32 = 0
+)
+
+// ColumnFamily 列族，同一个数据目录中相互独立的命名空间
+// 所有的列族共享数据文件，每个列族使用单独的内存索引
+type ColumnFamily struct {
+	id    uint32        //列族id，会写入到每条LogRecord中
+	name  string        //列族名称
+	db    *DB           //所属的数据库实例
+	index index.Indexer //列族的内存索引
+}
+
+// CreateColumnFamily创建一个新的列族
+func (db *DB) CreateColumnFamily(name string) (*ColumnFamily, error) {
+	if name == "" {
+		return nil, ErrColumnFamilyNameEmpty
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.findColumnFamily(name) != nil {
+		return nil, ErrColumnFamilyExists
+	}
+	//分配新的列族id
+	var familyId uint32 = defaultFamilyId
+	for id := range db.families {
+		if id > familyId {
+			familyId = id
+		}
+	}
+	familyId++
+	//持久化列族信息，保证重启之后可以找到列族对应的数据
+	familyFile, err := data.OpenColumnFamilyFile(db.options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	familyFile.Cipher = db.cipher
+	defer func() {
+		_ = familyFile.Close()
+	}()
+	record := &data.LogRecord{
+		Key:   []byte(name),
+		Value: []byte(strconv.FormatUint(uint64(familyId), 10)),
+	}
+	encRecord, _ := data.EncodeLogRecord(record)
+	if err := familyFile.Write(encRecord); err != nil {
+		return nil, err
+	}
+	if err := familyFile.Sync(); err != nil {
+		return nil, err
+	}
+	cf := db.newColumnFamily(familyId, name)
+	db.families[familyId] = cf
+	return cf, nil
+}
+
+// ColumnFamily根据名称获取已经存在的列族
+func (db *DB) ColumnFamily(name string) (*ColumnFamily, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	cf := db.findColumnFamily(name)
+	if cf == nil {
+		return nil, ErrColumnFamilyNotFound
+	}
+	return cf, nil
+}
+
+// 根据名称查找列族，在访问此方法前必须得有互斥锁
+func (db *DB) findColumnFamily(name string) *ColumnFamily {
+	for _, cf := range db.families {
+		if cf.name == name {
+			return cf
+		}
+	}
+	return nil
+}
+
+func (db *DB) newColumnFamily(familyId uint32, name string) *ColumnFamily {
+	return &ColumnFamily{
+		id:    familyId,
+		name:  name,
+		db:    db,
+		index: index.NewFamilyIndexer(db.options.IndexType, db.options.DirPath, familyId, db.options.SyncWrites, db.options.BloomFilterFalsePositiveRate),
+	}
+}
+
+// 根据列族id获取对应的索引，列族不存在说明数据目录被损坏了
+func (db *DB) getFamilyIndex(familyId uint32) (index.Indexer, error) {
+	cf := db.families[familyId]
+	if cf == nil {
+		return nil, ErrDataDirectoryCorrupted
+	}
+	return cf.index, nil
+}
+
+// 将所有的列族信息写入到dirPath中，merge时使用当前的密钥重新加密
+// 在访问此方法前必须得有互斥锁
+func (db *DB) writeColumnFamilies(dirPath string) error {
+	familyFile, err := data.OpenColumnFamilyFile(dirPath)
+	if err != nil {
+		return err
+	}
+	familyFile.Cipher = db.cipher
+	defer func() {
+		_ = familyFile.Close()
+	}()
+	for id, cf := range db.families {
+		if id == defaultFamilyId {
+			continue
+		}
+		record := &data.LogRecord{
+			Key:   []byte(cf.name),
+			Value: []byte(strconv.FormatUint(uint64(id), 10)),
+		}
+		encRecord, _ := data.EncodeLogRecord(record)
+		if err := familyFile.Write(encRecord); err != nil {
+			return err
+		}
+	}
+	return familyFile.Sync()
+}
+
+// 从磁盘中加载列族信息
+func (db *DB) loadColumnFamilies() error {
+	db.families = map[uint32]*ColumnFamily{
+		defaultFamilyId: {id: defaultFamilyId, name: defaultFamilyName, db: db, index: db.index},
+	}
+	db.defaultFamily = db.families[defaultFamilyId]
+	fileName := filepath.Join(db.options.DirPath, data.ColumnFamilyFileName)
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return nil
+	}
+	familyFile, err := data.OpenColumnFamilyFile(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	familyFile.Cipher = db.cipher
+	defer func() {
+		_ = familyFile.Close()
+	}()
+	var offset int64 = 0
+	for {
+		record, size, err := familyFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		familyId, err := strconv.ParseUint(string(record.Value), 10, 32)
+		if err != nil {
+			return ErrDataDirectoryCorrupted
+		}
+		db.families[uint32(familyId)] = db.newColumnFamily(uint32(familyId), string(record.Key))
+		offset += size
+	}
+	return nil
+}
+
+// Name列族名称
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// Put写入key/value数据到列族中
+func (cf *ColumnFamily) Put(key []byte, value []byte) error {
+	return cf.db.put(cf, key, value, 0)
+}
+
+// PutWithTTL写入key/value数据到列族中，数据在ttl时间之后过期
+func (cf *ColumnFamily) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return cf.db.put(cf, key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// Get根据key读取列族中的数据
+func (cf *ColumnFamily) Get(key []byte) ([]byte, error) {
+	return cf.db.get(cf, key)
+}
+
+// Delete根据key删除列族中的数据
+func (cf *ColumnFamily) Delete(key []byte) error {
+	return cf.db.delete(cf, key)
+}
+
+// MergeValue写入列族中key的一个合并操作数
+func (cf *ColumnFamily) MergeValue(key []byte, operand []byte) error {
+	return cf.db.mergeValue(cf, key, operand)
+}
+
+// DeleteRange删除列族中[start,end)范围内的所有数据
+func (cf *ColumnFamily) DeleteRange(start []byte, end []byte) error {
+	return cf.db.deleteRange(cf, start, end)
+}
+
+// DeletePrefix删除列族中所有以prefix为前缀的数据
+func (cf *ColumnFamily) DeletePrefix(prefix []byte) error {
+	return cf.db.deleteRange(cf, prefix, prefixEnd(prefix))
+}
+
+// Watch订阅列族中key以prefix为前缀的数据变更
+func (cf *ColumnFamily) Watch(ctx context.Context, prefix []byte) <-chan *WatchEvent {
+	return cf.db.watch(ctx, cf, prefix)
+}
+
+// NewIterator初始化列族的迭代器
+func (cf *ColumnFamily) NewIterator(opts IteratorOptions) *Iterator {
+	return cf.db.newIterator(cf, opts)
+}
+
+// NewWriteBatch初始化WriteBatch，Put和Delete默认写入当前列族
+func (cf *ColumnFamily) NewWriteBatch(opts WriteBatchOptions) *WriteBatch {
+	return cf.db.newWriteBatch(cf, opts)
+}
@@ -0,0 +1,138 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_ColumnFamily(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-column-family")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	users, err := db.CreateColumnFamily("users")
+	assert.Nil(t, err)
+	_, err = db.CreateColumnFamily("users")
+	assert.Equal(t, ErrColumnFamilyExists, err)
+	_, err = db.ColumnFamily("orders")
+	assert.Equal(t, ErrColumnFamilyNotFound, err)
+
+	//不同列族中相同的key互不影响
+	err = db.Put(utils.GetTestKey(1), []byte("default"))
+	assert.Nil(t, err)
+	err = users.Put(utils.GetTestKey(1), []byte("users"))
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("default"), val)
+	val, err = users.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("users"), val)
+
+	err = users.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_, err = users.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("default"), val)
+
+	//跨列族的原子批量写
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put(utils.GetTestKey(2), []byte("default"))
+	assert.Nil(t, err)
+	err = wb.PutCF(users, utils.GetTestKey(2), []byte("users"))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	iter := users.NewIterator(DefalutIteratorOptinos)
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		count++
+	}
+	iter.Close()
+	assert.Equal(t, 1, count)
+	assert.Equal(t, uint(3), db.Stat().KeyNum)
+
+	//重启之后列族和数据仍然存在
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	users2, err := db2.ColumnFamily("users")
+	assert.Nil(t, err)
+	val, err = users2.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("users"), val)
+	_, err = users2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db2.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("default"), val)
+	err = db2.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_ColumnFamily_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-column-family-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	users, err := db.CreateColumnFamily("users")
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+		assert.Nil(t, users.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("default")))
+		assert.Nil(t, users.Put(utils.GetTestKey(i), []byte("users")))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, users.Delete(utils.GetTestKey(i)))
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	check := func(db *DB, users *ColumnFamily) {
+		assert.Equal(t, 1000, len(db.ListKeys()))
+		for i := 0; i < 1000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("default"), val)
+			val, err = users.Get(utils.GetTestKey(i))
+			if i < 500 {
+				assert.Equal(t, ErrKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, []byte("users"), val)
+			}
+		}
+	}
+	check(db, users)
+
+	//重启之后从hint文件中加载各个列族的索引
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	users2, err := db2.ColumnFamily("users")
+	assert.Nil(t, err)
+	check(db2, users2)
+	err = db2.Close()
+	assert.Nil(t, err)
+}
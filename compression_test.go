@@ -0,0 +1,71 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Compression(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-compression")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.Compression = true
+	opts.CompressionMinSize = 32
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	jsonValue := func(i int) []byte {
+		item := `{"name":"bitcask-go","type":"kv","enabled":true}`
+		return []byte(fmt.Sprintf(`{"id":%d,"items":[%s,%s,%s,%s]}`, i, item, item, item, item))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), jsonValue(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 1000; i < 1500; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), jsonValue(i)))
+	}
+	assert.Nil(t, wb.Commit())
+	//小于阈值的value不压缩
+	assert.Nil(t, db.Put([]byte("small"), []byte("value")))
+	stat := db.Stat()
+	assert.Greater(t, stat.CompressionRatio, float64(1))
+
+	//覆盖一半的数据之后merge
+	for i := 0; i < 750; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), jsonValue(i+1)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	//关闭压缩之后重新打开，压缩和未压缩的记录共存
+	opts.Compression = false
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(1), db.Stat().CompressionRatio)
+	for i := 1500; i < 1600; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), jsonValue(i)))
+	}
+	assert.Equal(t, float64(1), db.Stat().CompressionRatio)
+	for i := 0; i < 1600; i++ {
+		value, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		if i < 750 {
+			assert.Equal(t, jsonValue(i+1), value)
+		} else {
+			assert.Equal(t, jsonValue(i), value)
+		}
+	}
+	value, err := db.Get([]byte("small"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), value)
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,49 @@
+package data
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+// 记录类型的最高位标识value是否经过压缩，压缩和未压缩的记录可以共存
+const logRecordCompressedFlag LogRecordType = 0x80
+
+// flate的压缩器初始化开销较大，复用已经创建的压缩器
+var flateWriterPool = sync.Pool{
+	New: func() any {
+		writer, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return writer
+	},
+}
+
+// 使用flate压缩value
+func compressValue(value []byte) []byte {
+	var buf bytes.Buffer
+	writer := flateWriterPool.Get().(*flate.Writer)
+	defer flateWriterPool.Put(writer)
+	writer.Reset(&buf)
+	_, _ = writer.Write(value)
+	_ = writer.Close()
+	return buf.Bytes()
+}
+
+// 解压使用flate压缩的value
+func decompressValue(value []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(value))
+	defer reader.Close()
+	buf, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, ErrInvalidCompressedValue
+	}
+	return buf, nil
+}
+
+// EncodedLogRecordSize 不压缩时LogRecord编码之后的长度
+func EncodedLogRecordSize(logRecord *LogRecord) int64 {
+	header := make([]byte, maxLogRecordHeaderSize)
+	index := encodeLogRecordHeader(header, logRecord.Type, int64(len(logRecord.Key)), int64(len(logRecord.Value)),
+		logRecord.Expire, logRecord.FamilyId)
+	return int64(index + len(logRecord.Key) + len(logRecord.Value))
+}
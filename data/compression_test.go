@@ -0,0 +1,45 @@
+package data
+
+import (
+	"bitcask-go/fio"
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeLogRecord_Compressed(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-compression")
+	defer os.RemoveAll(dir)
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	defer dataFile.Close()
+
+	//可以压缩的value
+	value := bytes.Repeat([]byte(`{"name":"bitcask-go","type":"kv"}`), 32)
+	rec1 := &LogRecord{Key: []byte("name"), Value: value, Type: LogRecordNormal, Compressed: true}
+	enc1, size1 := EncodeLogRecord(rec1)
+	assert.Less(t, size1, EncodedLogRecordSize(rec1))
+	assert.Nil(t, dataFile.Write(enc1))
+
+	//压缩之后没有变小的value按照原始数据存储
+	rec2 := &LogRecord{Key: []byte("name"), Value: []byte("a"), Type: LogRecordDeleted, Compressed: true}
+	enc2, size2 := EncodeLogRecord(rec2)
+	assert.Equal(t, EncodedLogRecordSize(rec2), size2)
+	assert.Nil(t, dataFile.Write(enc2))
+
+	logRecord, readSize, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, size1, readSize)
+	assert.Equal(t, value, logRecord.Value)
+	assert.Equal(t, LogRecordNormal, logRecord.Type)
+	assert.True(t, logRecord.Compressed)
+
+	logRecord, readSize, err = dataFile.ReadLogRecord(size1)
+	assert.Nil(t, err)
+	assert.Equal(t, size2, readSize)
+	assert.Equal(t, []byte("a"), logRecord.Value)
+	assert.Equal(t, LogRecordDeleted, logRecord.Type)
+	assert.False(t, logRecord.Compressed)
+}
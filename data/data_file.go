@@ -2,6 +2,7 @@ package data
 
 import (
 	"bitcask-go/fio"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
@@ -10,14 +11,23 @@ import (
 )
 
 var (
-	ErrInvalidCRC = errors.New("invalid crc value,log record maybe corrupted")
+	ErrInvalidCRC             = errors.New("invalid crc value,log record maybe corrupted")
+	ErrInvalidCompressedValue = errors.New("invalid compressed value,log record maybe corrupted")
+	ErrWrongEncryptionKey     = errors.New("the encryption key is wrong or not set,can not decrypt log record")
+	ErrInvalidEncryptionKey   = errors.New("invalid encryption key,the key length must be 16, 24 or 32 bytes")
+	ErrValueNotStreamable     = errors.New("the value is compressed or encrypted,can not be read as stream")
 )
 
 const (
-	DataFileNameSuffix    = ".data"
-	HintFileName          = "hint-index"
-	MergeFinishedFileName = "merge-finished"
-	SeqNoFileName         = "seq-no"
+	DataFileNameSuffix     = ".data"
+	DataHintFileSuffix     = ".hint"
+	BlobFileSuffix         = ".blob"
+	HintFileName           = "hint-index"
+	MergeFinishedFileName  = "merge-finished"
+	SeqNoFileName          = "seq-no"
+	ColumnFamilyFileName   = "column-families"
+	ChangesHorizonFileName = "changes-horizon"
+	BlobFileIdFileName     = "blob-file-id"
 )
 
 // DataFile数据文件
@@ -25,6 +35,7 @@ type DataFile struct {
 	FileId    uint32        //文件id
 	WriteOff  int64         //文件写到了那个位置
 	IoManager fio.IOManager //io读写管理
+	Cipher    *Cipher       //记录的加密配置，为空表示不加密
 }
 
 // OpenDataFile 打开新的数据文件
@@ -40,6 +51,18 @@ func OpenHintFile(dirPath string) (*DataFile, error) {
 	return newDataFile(fileName, 0, fio.StandardFIO)
 }
 
+// OpenDataHintFile 打开数据文件对应的hint文件
+func OpenDataHintFile(dirPath string, fileId uint32) (*DataFile, error) {
+	fileName := GetDataHintFileName(dirPath, fileId)
+	return newDataFile(fileName, fileId, fio.StandardFIO)
+}
+
+// OpenBlobFile 打开存储较大value的blob文件
+func OpenBlobFile(dirPath string, fileId uint32) (*DataFile, error) {
+	fileName := GetBlobFileName(dirPath, fileId)
+	return newDataFile(fileName, fileId, fio.StandardFIO)
+}
+
 // OpenMergeFinishedFile打开表示Merge完成的文件
 func OpenMergeFinishedFile(dirPath string) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, MergeFinishedFileName)
@@ -52,28 +75,174 @@ func OpenSeqNoFile(dirPath string) (*DataFile, error) {
 	return newDataFile(fileName, 0, fio.StandardFIO)
 }
 
+// OpenColumnFamilyFile 打开存储列族信息的文件
+func OpenColumnFamilyFile(dirPath string) (*DataFile, error) {
+	fileName := filepath.Join(dirPath, ColumnFamilyFileName)
+	return newDataFile(fileName, 0, fio.StandardFIO)
+}
+
+// OpenChangesHorizonFile 打开存储可以读取变更的最小文件id的文件
+func OpenChangesHorizonFile(dirPath string) (*DataFile, error) {
+	fileName := filepath.Join(dirPath, ChangesHorizonFileName)
+	return newDataFile(fileName, 0, fio.StandardFIO)
+}
+
+// OpenBlobFileIdFile 打开存储下一个blob文件id的文件
+func OpenBlobFileIdFile(dirPath string) (*DataFile, error) {
+	fileName := filepath.Join(dirPath, BlobFileIdFileName)
+	return newDataFile(fileName, 0, fio.StandardFIO)
+}
+
 func GetDataFileName(dirPath string, fileId uint32) string {
 	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+DataFileNameSuffix)
 }
+
+// GetDataHintFileName 数据文件对应的hint文件名称
+func GetDataHintFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+DataHintFileSuffix)
+}
+
+// GetBlobFileName blob文件名称
+func GetBlobFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+BlobFileSuffix)
+}
+
 func newDataFile(fileName string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
 	//初始化IOManager管理器对象
 	ioManager, err := fio.NewIOManager(fileName, ioType)
 	if err != nil {
 		return nil, err
 	}
+	//文件以追加的方式写入，从文件的末尾开始写
+	size, err := ioManager.Size()
+	if err != nil {
+		return nil, err
+	}
 	return &DataFile{
 		FileId:    fileId,
-		WriteOff:  0,
+		WriteOff:  size,
 		IoManager: ioManager,
 	}, nil
 }
 
 // ReadLogRecord根据offset从数据文件中读取LogRecord
+// 加密的记录校验通过但是无法解密时返回ErrWrongEncryptionKey，同时返回记录的大小，便于跳过这条记录
 func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
-	fileSize, err := df.IoManager.Size()
+	header, headerBuf, fileSize, err := df.readLogRecordHeader(offset)
 	if err != nil {
 		return nil, 0, err
 	}
+	headerSize := int64(len(headerBuf))
+	//取出对应的key和value的长度
+	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
+	recordSize := logRecordSize(header, headerSize)
+	encrypted := header.recordType&logRecordEncryptedFlag != 0
+	stream := header.recordType&logRecordStreamFlag != 0
+	//记录超出了文件末尾，说明写入过程中被中断了
+	if offset+recordSize > fileSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	logRecord := &LogRecord{
+		Type:       header.recordType &^ logRecordFlags,
+		Expire:     header.expire,
+		FamilyId:   header.familyId,
+		Compressed: header.recordType&logRecordCompressedFlag != 0,
+		Blob:       header.recordType&logRecordBlobFlag != 0,
+	}
+	if encrypted && stream {
+		kvBuf, err := df.readBytes(recordSize-headerSize, offset+headerSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		if logRecord.Key, logRecord.Value, err = df.openLogRecordStream(header, headerBuf, kvBuf); err != nil {
+			return nil, decryptFailedSize(err, recordSize), err
+		}
+	} else if encrypted {
+		//加密的记录先校验crc，校验通过之后解密失败说明密钥不正确
+		kvBuf, err := df.readBytes(recordSize-headerSize, offset+headerSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		crc := crc32.ChecksumIEEE(headerBuf[crc32.Size:headerSize])
+		if crc32.Update(crc, crc32.IEEETable, kvBuf) != header.crc {
+			return nil, 0, ErrInvalidCRC
+		}
+		if kvBuf, err = df.Cipher.decryptLogRecord(headerBuf[crc32.Size:headerSize], kvBuf); err != nil {
+			return nil, decryptFailedSize(err, recordSize), err
+		}
+		logRecord.Key = kvBuf[:keySize]
+		logRecord.Value = kvBuf[keySize:]
+	} else {
+		//开始读取用户实际存储的key/value数据
+		if recordSize > headerSize {
+			kvBuf, err := df.readBytes(recordSize-headerSize, offset+headerSize)
+			if err != nil {
+				return nil, 0, err
+			}
+			//超出key和value
+			logRecord.Key = kvBuf[:keySize]
+			logRecord.Value = kvBuf[keySize : keySize+valueSize]
+			//流式写入的记录value的crc校验值在记录的末尾
+			if stream && crc32.ChecksumIEEE(logRecord.Value) != binary.LittleEndian.Uint32(kvBuf[keySize+valueSize:]) {
+				return nil, 0, ErrInvalidCRC
+			}
+		}
+		//校验数值的有效性，流式写入的记录header中的crc不包含value
+		var crc uint32
+		if stream {
+			crc = getLogRecordCRC(&LogRecord{Key: logRecord.Key}, headerBuf[crc32.Size:headerSize])
+		} else {
+			crc = getLogRecordCRC(logRecord, headerBuf[crc32.Size:headerSize])
+		}
+		if crc != header.crc {
+			return nil, 0, ErrInvalidCRC
+		}
+	}
+	//校验通过之后再解压value
+	if logRecord.Compressed {
+		if logRecord.Value, err = decompressValue(logRecord.Value); err != nil {
+			return nil, 0, err
+		}
+	}
+	return logRecord, recordSize, nil
+}
+
+// 读取offset处记录的header，返回header、header的原始数据和文件大小
+// ReadLogRecordSize 只读取offset处记录的header，返回header中记录的大小，不校验记录的crc
+func (df *DataFile) ReadLogRecordSize(offset int64) (int64, error) {
+	header, headerBuf, _, err := df.readLogRecordHeader(offset)
+	if err != nil {
+		return 0, err
+	}
+	return logRecordSize(header, int64(len(headerBuf))), nil
+}
+
+// 根据header计算记录在文件中的大小
+func logRecordSize(header *LogRecordHeader, headerSize int64) int64 {
+	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
+	var recordSize = headerSize + keySize + valueSize
+	stream := header.recordType&logRecordStreamFlag != 0
+	if header.recordType&logRecordEncryptedFlag != 0 {
+		recordSize += encryptionNonceSize + encryptionTagSize
+		//流式写入的加密记录每个value分块都有认证标签
+		if stream {
+			recordSize += streamChunks(valueSize) * encryptionTagSize
+		}
+	}
+	if stream {
+		recordSize += crc32.Size
+	}
+	return recordSize
+}
+
+func (df *DataFile) readLogRecordHeader(offset int64) (*LogRecordHeader, []byte, int64, error) {
+	fileSize, err := df.IoManager.Size()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if offset >= fileSize {
+		return nil, nil, 0, io.EOF
+	}
 	//如果读取的最大header长度已经超过了文件的长度，则只需要读取到文件的末尾即可
 	var headerBytes int64 = maxLogRecordHeaderSize
 	if offset+maxLogRecordHeaderSize > fileSize {
@@ -82,37 +251,35 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	//读取Header数据
 	headerBuf, err := df.readBytes(headerBytes, offset)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, 0, err
 	}
 	header, headerSize := DecodeLogRecordHeader(headerBuf)
 	if header == nil {
-		return nil, 0, io.EOF
+		//文件末尾只写入了部分header
+		if headerBytes > 0 {
+			return nil, nil, 0, io.ErrUnexpectedEOF
+		}
+		return nil, nil, 0, io.EOF
 	}
 	if header.crc == 0 && header.keySize == 0 && header.valueSize == 0 {
-		return nil, 0, io.EOF
+		return nil, nil, 0, io.EOF
 	}
-	//取出对应的key和value的长度
-	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
-	var recordSize = headerSize + keySize + valueSize
-	logRecord := &LogRecord{Type: header.recordType}
-	//开始读取用户实际存储的key/value数据
-	if keySize > 0 || valueSize > 0 {
-		kvBuf, err := df.readBytes(keySize+valueSize, offset+headerSize)
-		if err != nil {
-			return nil, 0, err
-		}
-		//超出key和value
-		logRecord.Key = kvBuf[:keySize]
-		logRecord.Value = kvBuf[keySize:]
+	if headerSize <= crc32.Size {
+		return nil, nil, 0, ErrInvalidCRC
 	}
-	//校验数值的有效性
-	crc := getLogRecordCRC(logRecord, headerBuf[crc32.Size:headerSize])
-	if crc != header.crc {
-		return nil, 0, ErrInvalidCRC
-	}
-	return logRecord, recordSize, nil
+	return header, headerBuf[:headerSize], fileSize, nil
 }
+
 func (df *DataFile) Write(buf []byte) error {
+	//配置了密钥时写入的记录需要加密
+	if df.Cipher.Overhead() > 0 {
+		buf = df.encryptLogRecords(buf)
+	}
+	return df.writeRaw(buf)
+}
+
+// 直接写入已经编码好的数据，不会加密
+func (df *DataFile) writeRaw(buf []byte) error {
 	n, err := df.IoManager.Write(buf)
 	if err != nil {
 		return err
@@ -122,10 +289,22 @@ func (df *DataFile) Write(buf []byte) error {
 }
 
 // WriteHintRecord写入索引信息到Hint文件夹
-func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
+func (df *DataFile) WriteHintRecord(key []byte, familyId uint32, pos *LogRecordPos) error {
+	record := &LogRecord{
+		Key:      key,
+		Value:    EncodeLogRecordPos(pos),
+		FamilyId: familyId,
+	}
+	encRecord, _ := EncodeLogRecord(record)
+	return df.Write(encRecord)
+}
+
+// WriteHintDeletedRecord写入key已经被删除的标记到Hint文件
+func (df *DataFile) WriteHintDeletedRecord(key []byte, familyId uint32) error {
 	record := &LogRecord{
-		Key:   key,
-		Value: EncodeLogRecordPos(pos),
+		Key:      key,
+		Type:     LogRecordDeleted,
+		FamilyId: familyId,
 	}
 	encRecord, _ := EncodeLogRecord(record)
 	return df.Write(encRecord)
@@ -2,6 +2,9 @@ package data
 
 import (
 	"bitcask-go/fio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
 	"os"
 	"testing"
 
@@ -112,3 +115,71 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 	assert.Equal(t, rec3, readRec3)
 	assert.Equal(t, size3, readSize3)
 }
+
+func TestDataFile_ReadLogRecord_OldFormat(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-old-format")
+	defer os.RemoveAll(dir)
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	defer dataFile.Close()
+
+	//之前版本写入的记录header中只有key和value的长度
+	key, value := []byte("name"), []byte("bitcask-go")
+	buf := []byte{0, 0, 0, 0, LogRecordNormal, 8, 20}
+	buf = append(append(buf, key...), value...)
+	binary.LittleEndian.PutUint32(buf[:4], crc32.ChecksumIEEE(buf[4:]))
+	err = dataFile.Write(buf)
+	assert.Nil(t, err)
+	//之后写入的记录带有过期时间和列族id
+	rec := &LogRecord{Key: []byte("ttl"), Value: []byte("v"), Expire: 100, FamilyId: 2}
+	res, size := EncodeLogRecord(rec)
+	err = dataFile.Write(res)
+	assert.Nil(t, err)
+
+	readRec, readSize, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(buf)), readSize)
+	assert.Equal(t, key, readRec.Key)
+	assert.Equal(t, value, readRec.Value)
+	assert.Equal(t, LogRecordNormal, readRec.Type)
+
+	readRec, readSize, err = dataFile.ReadLogRecord(int64(len(buf)))
+	assert.Nil(t, err)
+	assert.Equal(t, size, readSize)
+	assert.Equal(t, rec, readRec)
+}
+
+func TestDataFile_ReadLogRecord_Incomplete(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-incomplete")
+	defer os.RemoveAll(dir)
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	assert.NotNil(t, dataFile)
+
+	rec := &LogRecord{
+		Key:   []byte("name"),
+		Value: []byte("bitcask kv go"),
+	}
+	res, size := EncodeLogRecord(rec)
+	err = dataFile.Write(res)
+	assert.Nil(t, err)
+	//写入过程中被中断，只有部分数据
+	err = dataFile.Write(res[:size-3])
+	assert.Nil(t, err)
+	_, _, err = dataFile.ReadLogRecord(size)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	//只写入了部分header
+	dataFile2, err := OpenDataFile(dir, 1, fio.StandardFIO)
+	assert.Nil(t, err)
+	err = dataFile2.Write(res[:3])
+	assert.Nil(t, err)
+	_, _, err = dataFile2.ReadLogRecord(0)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	//读取的位置在文件末尾或者之后
+	_, _, err = dataFile.ReadLogRecord(size*2 - 3)
+	assert.Equal(t, io.EOF, err)
+	_, _, err = dataFile.ReadLogRecord(size * 10)
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,224 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+)
+
+// 记录类型的次高位标识key和value经过加密
+const logRecordEncryptedFlag LogRecordType = 0x40
+
+// 加密之后在header之后追加的随机nonce的长度，以及在key和value之后追加的认证标签长度
+const (
+	encryptionNonceSize = 12
+	encryptionTagSize   = 16
+)
+
+// Cipher 使用AES-GCM加密写入文件的记录，只加密key和value，header作为附加数据参与认证
+type Cipher struct {
+	aead     cipher.AEAD   //当前的密钥，为空表示新写入的记录不加密
+	previous []cipher.AEAD //之前的密钥，只用于解密，merge之后数据会使用当前的密钥重新加密
+}
+
+// NewCipher 创建加密配置，密钥长度必须为16、24或32字节，分别对应AES-128、AES-192和AES-256
+func NewCipher(key []byte, previousKeys [][]byte) (*Cipher, error) {
+	c := &Cipher{}
+	if len(key) > 0 {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		c.aead = aead
+	}
+	for _, previousKey := range previousKeys {
+		aead, err := newAEAD(previousKey)
+		if err != nil {
+			return nil, err
+		}
+		c.previous = append(c.previous, aead)
+	}
+	return c, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrInvalidEncryptionKey
+	}
+	return cipher.NewGCM(block)
+}
+
+// Overhead 加密之后每条记录增加的长度
+func (c *Cipher) Overhead() int64 {
+	if c == nil || c.aead == nil {
+		return 0
+	}
+	return encryptionNonceSize + encryptionTagSize
+}
+
+// 加密编码之后的记录，每条记录使用随机生成的nonce，重新计算包含nonce和认证标签的crc校验值
+// header nonce 加密之后的key和value 认证标签
+func (c *Cipher) encryptLogRecord(encRecord []byte, headerSize int64) []byte {
+	buf := make([]byte, headerSize+encryptionNonceSize, int64(len(encRecord))+c.Overhead())
+	copy(buf, encRecord[:headerSize])
+	buf[4] |= logRecordEncryptedFlag
+	nonce := buf[headerSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	additionalData := append([]byte(nil), buf[crc32.Size:headerSize]...)
+	buf = c.aead.Seal(buf, nonce, encRecord[headerSize:], additionalData)
+	binary.LittleEndian.PutUint32(buf[:crc32.Size], crc32.ChecksumIEEE(buf[crc32.Size:]))
+	return buf
+}
+
+// 解密记录中的key和value，依次尝试当前的密钥和之前的密钥
+// ciphertext以记录的nonce开头
+func (c *Cipher) decryptLogRecord(header []byte, ciphertext []byte) ([]byte, error) {
+	if c == nil {
+		return nil, ErrWrongEncryptionKey
+	}
+	nonce, ciphertext := ciphertext[:encryptionNonceSize], ciphertext[encryptionNonceSize:]
+	if c.aead != nil {
+		if plaintext, err := c.aead.Open(nil, nonce, ciphertext, header); err == nil {
+			return plaintext, nil
+		}
+	}
+	for _, aead := range c.previous {
+		if plaintext, err := aead.Open(nil, nonce, ciphertext, header); err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, ErrWrongEncryptionKey
+}
+
+// 流式写入的记录的加密状态，key和每个value分块使用同一个随机nonce和递增的计数器生成各自的nonce
+// header作为每个分块的附加数据参与认证，分块的数量由header中的value长度确定，不能被删除或者调换顺序
+type streamCipher struct {
+	aead           cipher.AEAD
+	nonce          []byte
+	additionalData []byte
+	counter        uint64
+}
+
+// 下一个分块使用的nonce，即随机nonce的后8个字节和计数器异或
+func (sc *streamCipher) nextNonce() []byte {
+	nonce := append([]byte(nil), sc.nonce...)
+	counter := binary.BigEndian.Uint64(nonce[encryptionNonceSize-8:]) ^ sc.counter
+	binary.BigEndian.PutUint64(nonce[encryptionNonceSize-8:], counter)
+	sc.counter++
+	return nonce
+}
+
+// 加密下一个分块，追加到dst之后
+func (sc *streamCipher) seal(dst []byte, plaintext []byte) []byte {
+	return sc.aead.Seal(dst, sc.nextNonce(), plaintext, sc.additionalData)
+}
+
+// 解密下一个分块，追加到dst之后
+func (sc *streamCipher) open(dst []byte, ciphertext []byte) ([]byte, error) {
+	plaintext, err := sc.aead.Open(dst, sc.nextNonce(), ciphertext, sc.additionalData)
+	if err != nil {
+		return nil, ErrWrongEncryptionKey
+	}
+	return plaintext, nil
+}
+
+// 加密流式写入的记录的header和key，返回加密value分块使用的streamCipher
+// header nonce 加密之后的key 认证标签，header中的crc包含nonce和加密之后的key
+func (c *Cipher) sealStreamHeader(encHeader []byte, keySize int64) ([]byte, *streamCipher) {
+	headerSize := int64(len(encHeader)) - keySize
+	buf := make([]byte, headerSize+encryptionNonceSize, int64(len(encHeader))+c.Overhead())
+	copy(buf, encHeader[:headerSize])
+	buf[4] |= logRecordEncryptedFlag
+	nonce := buf[headerSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	sc := &streamCipher{
+		aead:           c.aead,
+		nonce:          append([]byte(nil), nonce...),
+		additionalData: append([]byte(nil), buf[crc32.Size:headerSize]...),
+	}
+	buf = sc.seal(buf, encHeader[headerSize:])
+	binary.LittleEndian.PutUint32(buf[:crc32.Size], crc32.ChecksumIEEE(buf[crc32.Size:]))
+	return buf, sc
+}
+
+// 解密流式写入的记录的key，返回解密value分块使用的streamCipher
+// 依次尝试当前的密钥和之前的密钥，能够解密key的密钥用于解密所有的value分块
+func (c *Cipher) openStreamHeader(header []byte, sealedKey []byte) ([]byte, *streamCipher, error) {
+	if c == nil {
+		return nil, nil, ErrWrongEncryptionKey
+	}
+	aeads := c.previous
+	if c.aead != nil {
+		aeads = append([]cipher.AEAD{c.aead}, aeads...)
+	}
+	for _, aead := range aeads {
+		sc := &streamCipher{
+			aead:           aead,
+			nonce:          sealedKey[:encryptionNonceSize],
+			additionalData: header,
+		}
+		if key, err := sc.open(nil, sealedKey[encryptionNonceSize:]); err == nil {
+			return key, sc, nil
+		}
+	}
+	return nil, nil, ErrWrongEncryptionKey
+}
+
+// NeedsReencryption 判断offset处的记录是否需要使用当前的密钥重新加密
+// 没有配置密钥时不需要，没有加密或者只能使用之前的密钥解密的记录需要重新加密
+func (df *DataFile) NeedsReencryption(offset int64) (bool, error) {
+	if df.Cipher.Overhead() == 0 {
+		return false, nil
+	}
+	header, headerBuf, _, err := df.readLogRecordHeader(offset)
+	if err != nil {
+		return false, err
+	}
+	if header.recordType&logRecordEncryptedFlag == 0 {
+		return true, nil
+	}
+	headerSize, keySize := int64(len(headerBuf)), int64(header.keySize)
+	current := &Cipher{aead: df.Cipher.aead}
+	//流式写入的记录只需要解密key就可以确定使用的密钥
+	if header.recordType&logRecordStreamFlag != 0 {
+		sealedKey, err := df.readBytes(encryptionNonceSize+keySize+encryptionTagSize, offset+headerSize)
+		if err != nil {
+			return false, err
+		}
+		_, _, err = current.openStreamHeader(headerBuf[crc32.Size:], sealedKey)
+		return err != nil, nil
+	}
+	kvBuf, err := df.readBytes(encryptionNonceSize+keySize+int64(header.valueSize)+encryptionTagSize, offset+headerSize)
+	if err != nil {
+		return false, err
+	}
+	_, err = current.decryptLogRecord(headerBuf[crc32.Size:], kvBuf)
+	return err != nil, nil
+}
+
+// 加密写入文件的数据，buf中包含一条或者多条完整的编码之后的记录
+func (df *DataFile) encryptLogRecords(buf []byte) []byte {
+	encBuf := make([]byte, 0, len(buf))
+	for len(buf) > 0 {
+		header, headerSize := DecodeLogRecordHeader(buf)
+		recordSize := headerSize + int64(header.keySize) + int64(header.valueSize)
+		encBuf = append(encBuf, df.Cipher.encryptLogRecord(buf[:recordSize], headerSize)...)
+		buf = buf[recordSize:]
+	}
+	return encBuf
+}
+
+// 无法解密时返回记录的大小，其他错误返回0
+func decryptFailedSize(err error, recordSize int64) int64 {
+	if err == ErrWrongEncryptionKey {
+		return recordSize
+	}
+	return 0
+}
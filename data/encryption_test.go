@@ -0,0 +1,80 @@
+package data
+
+import (
+	"bitcask-go/fio"
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDataFile_Encryption(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption")
+	defer os.RemoveAll(dir)
+	key1, key2 := bytes.Repeat([]byte("a"), 32), bytes.Repeat([]byte("b"), 16)
+	_, err := NewCipher([]byte("short"), nil)
+	assert.Equal(t, ErrInvalidEncryptionKey, err)
+	cipher1, err := NewCipher(key1, nil)
+	assert.Nil(t, err)
+
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	dataFile.Cipher = cipher1
+	rec1 := &LogRecord{Key: []byte("name"), Value: []byte("bitcask-go"), Type: LogRecordNormal}
+	enc1, _ := EncodeLogRecord(rec1)
+	rec2 := &LogRecord{Key: []byte("name"), Type: LogRecordDeleted}
+	enc2, _ := EncodeLogRecord(rec2)
+	//一次写入多条记录
+	assert.Nil(t, dataFile.Write(append(enc1, enc2...)))
+	assert.Equal(t, int64(len(enc1)+len(enc2))+2*cipher1.Overhead(), dataFile.WriteOff)
+	assert.Nil(t, dataFile.Close())
+
+	buf, err := os.ReadFile(GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(buf, []byte("bitcask-go")))
+
+	//相同的文件id和偏移重新写入相同的记录，每次使用不同的nonce
+	otherDir, _ := os.MkdirTemp("", "bitcask-go-encryption")
+	defer os.RemoveAll(otherDir)
+	otherFile, err := OpenDataFile(otherDir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	otherFile.Cipher = cipher1
+	assert.Nil(t, otherFile.Write(append(enc1, enc2...)))
+	assert.Nil(t, otherFile.Close())
+	otherBuf, err := os.ReadFile(GetDataFileName(otherDir, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, len(buf), len(otherBuf))
+	assert.NotEqual(t, buf, otherBuf)
+
+	//重新打开之后使用之前的密钥读取
+	dataFile, err = OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	defer dataFile.Close()
+	dataFile.Cipher, err = NewCipher(key2, [][]byte{key1})
+	assert.Nil(t, err)
+	logRecord, size1, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, rec1.Key, logRecord.Key)
+	assert.Equal(t, rec1.Value, logRecord.Value)
+	assert.Equal(t, LogRecordNormal, logRecord.Type)
+	logRecord, _, err = dataFile.ReadLogRecord(size1)
+	assert.Nil(t, err)
+	assert.Equal(t, LogRecordDeleted, logRecord.Type)
+
+	//密钥不正确或者没有配置密钥
+	dataFile.Cipher, _ = NewCipher(key2, nil)
+	_, _, err = dataFile.ReadLogRecord(0)
+	assert.Equal(t, ErrWrongEncryptionKey, err)
+	dataFile.Cipher = nil
+	_, size, err := dataFile.ReadLogRecord(0)
+	assert.Equal(t, ErrWrongEncryptionKey, err)
+	assert.Equal(t, size1, size)
+
+	//数据损坏时仍然返回crc错误
+	buf[len(buf)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(GetDataFileName(dir, 0), buf, 0644))
+	dataFile.Cipher = cipher1
+	_, _, err = dataFile.ReadLogRecord(size1)
+	assert.Equal(t, ErrInvalidCRC, err)
+}
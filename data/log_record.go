@@ -11,18 +11,38 @@ const (
 	LogRecordNormal LogRecordType = iota
 	LogRecordDeleted
 	LogRecordTxnFinished
+	LogRecordRangeDeleted //范围删除，key为起始key，value为结束key（不包含），value为空表示没有上界
+	LogRecordMergeOperand //合并操作数，value中包含key之前记录的位置和操作数
 )
 
-// crc 4byte type 1byte keySize static valueSize static
-// 4+1+5+5
-const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
+// 记录类型的第三高位标识value为blob文件中记录的位置
+const logRecordBlobFlag LogRecordType = 0x20
+
+// 记录类型的第五高位标识header中包含过期时间和列族id，没有该标识的header按照之前的格式解析
+// 过期时间和列族id都为0时不写入这两个字段，和之前版本写入的记录格式相同
+const logRecordExtendedFlag LogRecordType = 0x08
+
+// 记录类型中所有的标识位，去掉之后是记录实际的类型
+const logRecordFlags = logRecordCompressedFlag | logRecordEncryptedFlag | logRecordBlobFlag | logRecordStreamFlag |
+	logRecordExtendedFlag
+
+// crc 4byte type 1byte keySize static valueSize static expire static familyId static
+// 过期时间和列族id只在type包含logRecordExtendedFlag时存在
+// 4+1+5+5+10+5
+const maxLogRecordHeaderSize = binary.MaxVarintLen32*3 + binary.MaxVarintLen64 + 5
 
 // 写入到数据文件的记录
 // /日志（数据文件的数据是追加的，类似日志的格式)
 type LogRecord struct {
-	Key   []byte
-	Value []byte
-	Type  LogRecordType
+	Key      []byte
+	Value    []byte
+	Type     LogRecordType
+	Expire   int64  //过期时间，UnixNano时间戳，为0表示永不过期
+	FamilyId uint32 //所属的列族id
+	//value是否压缩存储，压缩之后没有变小时按照原始数据存储，读取时value已经解压
+	Compressed bool
+	//value为blob文件中记录的位置，实际的value存储在blob文件中
+	Blob bool
 }
 
 // LogRecord的头部信息
@@ -31,13 +51,28 @@ type LogRecordHeader struct {
 	recordType LogRecordType //标识LogRecord的类型
 	keySize    uint32        //key的长度
 	valueSize  uint32        //value的长度
+	expire     int64         //过期时间
+	familyId   uint32        //所属的列族id
 }
 
 // LogRecordPos 数据内村索引，主要是描述数据在磁盘上的位置
 type LogRecordPos struct {
-	Fid    uint32 //文件id，表示将数据存储到了那个文件当中
-	Offset int64  //偏移，表示将数据存储到了数据文件中的那个位置
-	Size   uint32 //标识数据在磁盘上的大小
+	Fid    uint32        //文件id，表示将数据存储到了那个文件当中
+	Offset int64         //偏移，表示将数据存储到了数据文件中的那个位置
+	Size   uint32        //标识数据在磁盘上的大小
+	Expire int64         //过期时间，为0表示永不过期
+	Blob   *LogRecordPos //value存储在blob文件中时，blob记录的位置
+	Prev   *LogRecordPos //合并操作数的记录之前的记录的位置，只保存在内存中
+}
+
+// IsExpired判断数据在给定的时间是否已经过期
+func (pos *LogRecordPos) IsExpired(now int64) bool {
+	return pos.Expire > 0 && pos.Expire <= now
+}
+
+// IsExpired判断数据在给定的时间是否已经过期
+func (lr *LogRecord) IsExpired(now int64) bool {
+	return lr.Expire > 0 && lr.Expire <= now
 }
 
 // TransactionRecord 暂存的事务相关的数据
@@ -47,25 +82,30 @@ type TransactionRecord struct {
 }
 
 // EncodeLogRecord对LogRecord进行编码，返回字符数组及长度
-// crc校验值 type类型 keysize valuesize key value
-// 4字节 1字节 变长（最大5字节）（最大5字节） 变长 变长
+// crc校验值 type类型 keysize valuesize expire familyId key value
+// 4字节 1字节 变长（最大5字节）（最大5字节）（最大10字节）（最大5字节） 变长 变长
+// type的最高位为1表示value经过压缩
 func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
+	value, recordType := logRecord.Value, logRecord.Type
+	if logRecord.Blob {
+		recordType |= logRecordBlobFlag
+	}
+	if logRecord.Compressed {
+		if compressed := compressValue(value); len(compressed) < len(value) {
+			value, recordType = compressed, recordType|logRecordCompressedFlag
+		}
+	}
 	//初始化一个header部分的字节数组
 	header := make([]byte, maxLogRecordHeaderSize)
-	//第五个字节存储Type
-	header[4] = logRecord.Type
-	var index = 5
-	//5之后存放key和value的变长信息
-	//使用变长类型，节省空间
-	index += binary.PutVarint(header[index:], int64(len(logRecord.Key)))
-	index += binary.PutVarint(header[index:], int64(len(logRecord.Value)))
-	var size = index + len(logRecord.Key) + len(logRecord.Value)
+	index := encodeLogRecordHeader(header, recordType, int64(len(logRecord.Key)), int64(len(value)),
+		logRecord.Expire, logRecord.FamilyId)
+	var size = index + len(logRecord.Key) + len(value)
 	encBytes := make([]byte, size)
 	//将header部分的内容拷贝过来
 	copy(encBytes[:index], header[:index])
 	//将key和value数据拷贝到字节数组中
 	copy(encBytes[index:], logRecord.Key)
-	copy(encBytes[index+len(logRecord.Key):], logRecord.Value)
+	copy(encBytes[index+len(logRecord.Key):], value)
 	//对整个LogRecord的数据进行CRC校验
 	crc := crc32.ChecksumIEEE(encBytes[4:])
 	binary.LittleEndian.PutUint32(encBytes[:4], crc)
@@ -74,28 +114,129 @@ func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
 	return encBytes, int64(size)
 }
 
+// 编码header中crc之外的部分，返回header的长度
+// 第五个字节存储Type，之后存放key和value的变长信息，使用变长类型，节省空间
+func encodeLogRecordHeader(header []byte, recordType LogRecordType, keySize int64, valueSize int64,
+	expire int64, familyId uint32) int {
+	extended := expire != 0 || familyId != 0
+	if extended {
+		recordType |= logRecordExtendedFlag
+	}
+	header[4] = recordType
+	var index = 5
+	index += binary.PutVarint(header[index:], keySize)
+	index += binary.PutVarint(header[index:], valueSize)
+	if extended {
+		index += binary.PutVarint(header[index:], expire)
+		index += binary.PutVarint(header[index:], int64(familyId))
+	}
+	return index
+}
+
 // EncodeLogRecordPos对位置信息进行编码
 func EncodeLogRecordPos(pos *LogRecordPos) []byte {
-	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64)
+	buf := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64*2)
 	var index = 0
 	index += binary.PutVarint(buf[index:], int64(pos.Fid))
 	index += binary.PutVarint(buf[index:], pos.Offset)
 	index += binary.PutVarint(buf[index:], int64(pos.Size))
+	index += binary.PutVarint(buf[index:], pos.Expire)
+	//blob记录的位置只有在value存储在blob文件中时才存在
+	if pos.Blob != nil {
+		buf = append(buf[:index], make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64)...)
+		index += binary.PutVarint(buf[index:], int64(pos.Blob.Fid))
+		index += binary.PutVarint(buf[index:], pos.Blob.Offset)
+		index += binary.PutVarint(buf[index:], int64(pos.Blob.Size))
+	}
 	return buf[:index]
 }
 
 // DecodeLogRecordPos解码LogRecordPos
+// EncodeMergeOperand对合并操作数进行编码，prev为key之前记录的位置，为空表示没有之前的记录
+// prev长度 prev位置信息 操作数
+func EncodeMergeOperand(prev *LogRecordPos, operand []byte) []byte {
+	var prevBuf []byte
+	if prev != nil {
+		prevBuf = EncodeLogRecordPos(prev)
+	}
+	buf := make([]byte, binary.MaxVarintLen32+len(prevBuf)+len(operand))
+	index := binary.PutUvarint(buf, uint64(len(prevBuf)))
+	index += copy(buf[index:], prevBuf)
+	index += copy(buf[index:], operand)
+	return buf[:index]
+}
+
+// DecodeMergeOperand解码合并操作数，返回之前记录的位置和操作数
+func DecodeMergeOperand(buf []byte) (*LogRecordPos, []byte) {
+	prevSize, n := binary.Uvarint(buf)
+	var prev *LogRecordPos
+	if prevSize > 0 {
+		prev = DecodeLogRecordPos(buf[n : n+int(prevSize)])
+	}
+	return prev, buf[n+int(prevSize):]
+}
+
+// EncodeDataHintRecord 构造数据文件中记录对应的hint记录，hint记录只保存位置信息，不保存value
+// 范围删除记录的结束key保存在位置信息之后
+func EncodeDataHintRecord(logRecord *LogRecord, pos *LogRecordPos) *LogRecord {
+	var end []byte
+	if logRecord.Type == LogRecordRangeDeleted {
+		end = logRecord.Value
+	}
+	posBuf := EncodeLogRecordPos(pos)
+	buf := make([]byte, binary.MaxVarintLen32+len(posBuf)+len(end))
+	index := binary.PutUvarint(buf, uint64(len(posBuf)))
+	index += copy(buf[index:], posBuf)
+	index += copy(buf[index:], end)
+	return &LogRecord{
+		Key:      logRecord.Key,
+		Value:    buf[:index],
+		Type:     logRecord.Type,
+		Expire:   logRecord.Expire,
+		FamilyId: logRecord.FamilyId,
+	}
+}
+
+// DecodeDataHintRecord 解码hint记录，返回不包含value的数据记录和位置信息
+func DecodeDataHintRecord(hintRecord *LogRecord) (*LogRecord, *LogRecordPos) {
+	posSize, n := binary.Uvarint(hintRecord.Value)
+	pos := DecodeLogRecordPos(hintRecord.Value[n : n+int(posSize)])
+	logRecord := &LogRecord{
+		Key:      hintRecord.Key,
+		Type:     hintRecord.Type,
+		Expire:   hintRecord.Expire,
+		FamilyId: hintRecord.FamilyId,
+	}
+	if end := hintRecord.Value[n+int(posSize):]; len(end) > 0 {
+		logRecord.Value = end
+	}
+	return logRecord, pos
+}
+
 func DecodeLogRecordPos(buf []byte) *LogRecordPos {
 	var index = 0
 	fileId, n := binary.Varint(buf[index:])
 	index += n
 	offset, n := binary.Varint(buf[index:])
 	index += n
-	size, _ := binary.Varint(buf[index:])
-	return &LogRecordPos{Fid: uint32(fileId), Offset: offset, Size: uint32(size)}
+	size, n := binary.Varint(buf[index:])
+	index += n
+	expire, n := binary.Varint(buf[index:])
+	index += n
+	pos := &LogRecordPos{Fid: uint32(fileId), Offset: offset, Size: uint32(size), Expire: expire}
+	if index < len(buf) {
+		blobFileId, n := binary.Varint(buf[index:])
+		index += n
+		blobOffset, n := binary.Varint(buf[index:])
+		index += n
+		blobSize, _ := binary.Varint(buf[index:])
+		pos.Blob = &LogRecordPos{Fid: uint32(blobFileId), Offset: blobOffset, Size: uint32(blobSize)}
+	}
+	return pos
 }
 
 // 对字节数组中的Header信息进行解码
+// 变长编码的长度溢出说明header已经损坏，返回的header长度为0
 func DecodeLogRecordHeader(buf []byte) (*LogRecordHeader, int64) {
 	if len(buf) <= 4 {
 		return nil, 0
@@ -107,12 +248,36 @@ func DecodeLogRecordHeader(buf []byte) (*LogRecordHeader, int64) {
 	var index = 5
 	//取出keySize
 	keySize, n := binary.Varint(buf[index:])
+	if n < 0 {
+		return header, 0
+	}
 	header.keySize = uint32(keySize)
 	index += n
 	//取出valueSize
 	valueSize, n := binary.Varint(buf[index:])
+	if n < 0 {
+		return header, 0
+	}
 	header.valueSize = uint32(valueSize)
 	index += n
+	//之前格式的header中没有过期时间和列族id
+	if header.recordType&logRecordExtendedFlag == 0 {
+		return header, int64(index)
+	}
+	//取出过期时间
+	expire, n := binary.Varint(buf[index:])
+	if n < 0 {
+		return header, 0
+	}
+	header.expire = expire
+	index += n
+	//取出列族id
+	familyId, n := binary.Varint(buf[index:])
+	if n < 0 {
+		return header, 0
+	}
+	header.familyId = uint32(familyId)
+	index += n
 	return header, int64(index)
 }
 func getLogRecordCRC(lr *LogRecord, header []byte) uint32 {
@@ -1,6 +1,7 @@
 package data
 
 import (
+	"bytes"
 	"hash/crc32"
 	"testing"
 
@@ -55,6 +56,28 @@ func TestDecodeLogRecordHeader(t *testing.T) {
 	assert.Equal(t, uint32(4), h2.keySize)
 	assert.Equal(t, uint32(0), h2.valueSize)
 }
+func TestDecodeLogRecordHeader_Extended(t *testing.T) {
+	//没有过期时间和列族id的记录和之前版本的格式相同
+	rec := &LogRecord{Key: []byte("name"), Value: []byte("bitcask-go")}
+	res, _ := EncodeLogRecord(rec)
+	assert.Equal(t, []byte{104, 82, 240, 150, 0, 8, 20}, res[:7])
+
+	rec = &LogRecord{Key: []byte("name"), Value: []byte("bitcask-go"), Expire: 100, FamilyId: 3}
+	res, _ = EncodeLogRecord(rec)
+	header, _ := DecodeLogRecordHeader(res)
+	assert.Equal(t, LogRecordNormal|logRecordExtendedFlag, header.recordType)
+	assert.Equal(t, int64(100), header.expire)
+	assert.Equal(t, uint32(3), header.familyId)
+}
+
+func TestDecodeLogRecordHeader_Corrupted(t *testing.T) {
+	//损坏的header中变长编码的长度溢出
+	buf := append([]byte{1, 2, 3, 4, 0}, bytes.Repeat([]byte{0xff}, 20)...)
+	header, headerSize := DecodeLogRecordHeader(buf)
+	assert.NotNil(t, header)
+	assert.Equal(t, int64(0), headerSize)
+}
+
 func TestGetLogRecordCRC(t *testing.T) {
 	rec1 := &LogRecord{
 		Key:   []byte("name"),
@@ -73,3 +96,59 @@ func TestGetLogRecordCRC(t *testing.T) {
 	crc2 := getLogRecordCRC(rec2, headerBuf2[crc32.Size:])
 	assert.Equal(t, uint32(240712713), crc2)
 }
+
+func TestEncodeLogRecord_Expire(t *testing.T) {
+	rec := &LogRecord{
+		Key:    []byte("name"),
+		Value:  []byte("bitcask-go"),
+		Type:   LogRecordNormal,
+		Expire: 1700000000000000000,
+	}
+	res, n := EncodeLogRecord(rec)
+	header, headerSize := DecodeLogRecordHeader(res)
+	assert.NotNil(t, header)
+	assert.Equal(t, int64(len(rec.Key)+len(rec.Value))+headerSize, n)
+	assert.Equal(t, rec.Expire, header.expire)
+	assert.True(t, rec.IsExpired(rec.Expire))
+	assert.False(t, rec.IsExpired(rec.Expire-1))
+
+	pos := DecodeLogRecordPos(EncodeLogRecordPos(&LogRecordPos{Fid: 1, Offset: 10, Size: 20, Expire: rec.Expire}))
+	assert.Equal(t, rec.Expire, pos.Expire)
+}
+
+func TestEncodeDataHintRecord(t *testing.T) {
+	pos := &LogRecordPos{Fid: 3, Offset: 100, Size: 40, Expire: 1700000000000000000}
+	rec := &LogRecord{
+		Key:      []byte("name"),
+		Value:    []byte("bitcask-go"),
+		Type:     LogRecordNormal,
+		Expire:   pos.Expire,
+		FamilyId: 2,
+	}
+	logRecord, hintPos := DecodeDataHintRecord(EncodeDataHintRecord(rec, pos))
+	assert.Equal(t, pos, hintPos)
+	assert.Equal(t, rec.Key, logRecord.Key)
+	assert.Equal(t, rec.Type, logRecord.Type)
+	assert.Equal(t, rec.FamilyId, logRecord.FamilyId)
+	//hint记录中不保存value
+	assert.Nil(t, logRecord.Value)
+
+	//范围删除需要保留结束key
+	rec = &LogRecord{Key: []byte("a"), Value: []byte("b"), Type: LogRecordRangeDeleted}
+	logRecord, _ = DecodeDataHintRecord(EncodeDataHintRecord(rec, pos))
+	assert.Equal(t, []byte("b"), logRecord.Value)
+}
+
+func TestEncodeLogRecordPos_Blob(t *testing.T) {
+	pos := &LogRecordPos{Fid: 3, Offset: 128, Size: 20, Expire: 100}
+	assert.Equal(t, pos, DecodeLogRecordPos(EncodeLogRecordPos(pos)))
+
+	pos.Blob = &LogRecordPos{Fid: 7, Offset: 4096, Size: 1 << 20}
+	decoded := DecodeLogRecordPos(EncodeLogRecordPos(pos))
+	assert.Equal(t, pos, decoded)
+
+	//blob记录的位置可以和合并操作数一起编码
+	prev, operand := DecodeMergeOperand(EncodeMergeOperand(pos, []byte("operand")))
+	assert.Equal(t, pos, prev)
+	assert.Equal(t, []byte("operand"), operand)
+}
@@ -0,0 +1,270 @@
+package data
+
+import (
+	"bitcask-go/fio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// 记录类型的第四高位标识记录是流式写入的，value之后追加了value的crc校验值
+// 写入header时value还没有读取，header中的crc只校验header和key
+const logRecordStreamFlag LogRecordType = 0x10
+
+// 流式读写value时每次读写的长度
+const streamChunkSize = 64 * 1024
+
+// 编码流式写入的记录的header和key，header中的crc只包含header和key
+func encodeLogRecordStreamHeader(logRecord *LogRecord, valueSize int64) []byte {
+	buf := make([]byte, maxLogRecordHeaderSize+len(logRecord.Key))
+	index := encodeLogRecordHeader(buf, logRecord.Type|logRecordStreamFlag, int64(len(logRecord.Key)), valueSize,
+		logRecord.Expire, logRecord.FamilyId)
+	index += copy(buf[index:], logRecord.Key)
+	binary.LittleEndian.PutUint32(buf[:crc32.Size], crc32.ChecksumIEEE(buf[crc32.Size:index]))
+	return buf[:index]
+}
+
+// value按照streamChunkSize分块的数量
+func streamChunks(valueSize int64) int64 {
+	return (valueSize + streamChunkSize - 1) / streamChunkSize
+}
+
+// StreamLogRecordSize 流式写入的记录编码之后的长度，c为写入文件的加密配置
+// 加密的记录中key和每个value分块都有单独的认证标签
+func StreamLogRecordSize(logRecord *LogRecord, valueSize int64, c *Cipher) int64 {
+	size := int64(len(encodeLogRecordStreamHeader(logRecord, valueSize))) + valueSize + crc32.Size
+	if c.Overhead() > 0 {
+		size += c.Overhead() + streamChunks(valueSize)*encryptionTagSize
+	}
+	return size
+}
+
+// WriteLogRecordStream 流式写入记录，value从r中读取valueSize个字节，不需要完整地加载到内存中
+// 流式写入的value不压缩，r中的数据不足valueSize时返回io.ErrUnexpectedEOF，文件中会残留写入了一部分的记录
+// 配置了密钥时value分块加密，记录末尾的crc校验加密之后的value
+func (df *DataFile) WriteLogRecordStream(logRecord *LogRecord, r io.Reader, valueSize int64) error {
+	headerBuf := encodeLogRecordStreamHeader(logRecord, valueSize)
+	var sc *streamCipher
+	if df.Cipher.Overhead() > 0 {
+		headerBuf, sc = df.Cipher.sealStreamHeader(headerBuf, int64(len(logRecord.Key)))
+	}
+	if err := df.writeRaw(headerBuf); err != nil {
+		return err
+	}
+	var crc uint32
+	buf := make([]byte, streamChunkSize)
+	var sealed []byte
+	for remaining := valueSize; remaining > 0; {
+		n := int64(len(buf))
+		if remaining < n {
+			n = remaining
+		}
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		chunk := buf[:n]
+		if sc != nil {
+			sealed = sc.seal(sealed[:0], chunk)
+			chunk = sealed
+		}
+		if err := df.writeRaw(chunk); err != nil {
+			return err
+		}
+		crc = crc32.Update(crc, crc32.IEEETable, chunk)
+		remaining -= n
+	}
+	var crcBuf [crc32.Size]byte
+	binary.LittleEndian.PutUint32(crcBuf[:], crc)
+	return df.writeRaw(crcBuf[:])
+}
+
+// 校验并解密流式写入的加密记录，返回key和value
+// kvBuf为header之后的nonce、加密之后的key、加密之后的value分块和value分块的crc
+func (df *DataFile) openLogRecordStream(header *LogRecordHeader, headerBuf []byte, kvBuf []byte) ([]byte, []byte, error) {
+	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
+	sealedKeySize := encryptionNonceSize + keySize + encryptionTagSize
+	crc := crc32.ChecksumIEEE(headerBuf[crc32.Size:])
+	if crc32.Update(crc, crc32.IEEETable, kvBuf[:sealedKeySize]) != header.crc {
+		return nil, nil, ErrInvalidCRC
+	}
+	chunks := kvBuf[sealedKeySize : len(kvBuf)-crc32.Size]
+	if crc32.ChecksumIEEE(chunks) != binary.LittleEndian.Uint32(kvBuf[len(kvBuf)-crc32.Size:]) {
+		return nil, nil, ErrInvalidCRC
+	}
+	key, sc, err := df.Cipher.openStreamHeader(headerBuf[crc32.Size:], kvBuf[:sealedKeySize])
+	if err != nil {
+		return nil, nil, err
+	}
+	value := make([]byte, 0, valueSize)
+	for len(chunks) > 0 {
+		n := min(int64(len(chunks)), streamChunkSize+encryptionTagSize)
+		if value, err = sc.open(value, chunks[:n]); err != nil {
+			return nil, nil, err
+		}
+		chunks = chunks[n:]
+	}
+	return key, value, nil
+}
+
+// ValueReader 直接从文件中流式读取记录的value，读取到末尾时校验crc
+type ValueReader struct {
+	ioManager fio.IOManager
+	offset    int64  //下一次读取的位置
+	remaining int64  //value剩余未读取的长度
+	crc       uint32 //已经读取的数据的crc
+	expected  uint32 //记录中保存的crc校验值
+	//加密的记录依次读取并解密每个value分块，sc为空表示没有加密
+	sc     *streamCipher
+	sealed int64  //加密的value分块剩余未读取的长度
+	buf    []byte //读取分块使用的缓冲区
+	chunk  []byte //已经解密但是还没有被读取的数据
+}
+
+// OpenValueReader 读取offset处记录的header和key，返回不包含value的记录和value的读取器
+// 压缩的记录以及不是流式写入的加密记录需要完整读取之后才能还原value，返回ErrValueNotStreamable
+func (df *DataFile) OpenValueReader(offset int64) (*LogRecord, *ValueReader, error) {
+	header, headerBuf, fileSize, err := df.readLogRecordHeader(offset)
+	if err != nil {
+		return nil, nil, err
+	}
+	stream := header.recordType&logRecordStreamFlag != 0
+	encrypted := header.recordType&logRecordEncryptedFlag != 0
+	if header.recordType&logRecordCompressedFlag != 0 || (encrypted && !stream) {
+		return nil, nil, ErrValueNotStreamable
+	}
+	headerSize := int64(len(headerBuf))
+	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
+	recordSize := logRecordSize(header, headerSize)
+	if offset+recordSize > fileSize {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	logRecord := &LogRecord{
+		Type:     header.recordType &^ logRecordFlags,
+		Expire:   header.expire,
+		FamilyId: header.familyId,
+		Blob:     header.recordType&logRecordBlobFlag != 0,
+	}
+	if encrypted {
+		return df.openSealedValueReader(logRecord, header, headerBuf, offset, recordSize)
+	}
+	key, err := df.readBytes(keySize, offset+headerSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	logRecord.Key = key
+	reader := &ValueReader{
+		ioManager: df.IoManager,
+		offset:    offset + headerSize + keySize,
+		remaining: valueSize,
+		crc:       getLogRecordCRC(&LogRecord{Key: key}, headerBuf[crc32.Size:]),
+		expected:  header.crc,
+	}
+	//流式写入的记录先校验header和key，value的crc校验值在value之后
+	if stream {
+		if reader.crc != header.crc {
+			return nil, nil, ErrInvalidCRC
+		}
+		crcBuf, err := df.readBytes(crc32.Size, reader.offset+valueSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		reader.crc, reader.expected = 0, binary.LittleEndian.Uint32(crcBuf)
+	}
+	return logRecord, reader, nil
+}
+
+// 校验并解密流式写入的加密记录的key，返回逐个解密value分块的读取器
+func (df *DataFile) openSealedValueReader(logRecord *LogRecord, header *LogRecordHeader, headerBuf []byte,
+	offset int64, recordSize int64) (*LogRecord, *ValueReader, error) {
+	headerSize := int64(len(headerBuf))
+	sealedKeySize := encryptionNonceSize + int64(header.keySize) + encryptionTagSize
+	sealedKey, err := df.readBytes(sealedKeySize, offset+headerSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	crc := crc32.ChecksumIEEE(headerBuf[crc32.Size:])
+	if crc32.Update(crc, crc32.IEEETable, sealedKey) != header.crc {
+		return nil, nil, ErrInvalidCRC
+	}
+	key, sc, err := df.Cipher.openStreamHeader(headerBuf[crc32.Size:], sealedKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	crcBuf, err := df.readBytes(crc32.Size, offset+recordSize-crc32.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+	logRecord.Key = key
+	return logRecord, &ValueReader{
+		ioManager: df.IoManager,
+		offset:    offset + headerSize + sealedKeySize,
+		remaining: int64(header.valueSize),
+		expected:  binary.LittleEndian.Uint32(crcBuf),
+		sc:        sc,
+		sealed:    recordSize - headerSize - sealedKeySize - crc32.Size,
+	}, nil
+}
+
+// Size value的剩余长度
+func (vr *ValueReader) Size() int64 {
+	return vr.remaining
+}
+
+// Read 读取value，读取到末尾时crc校验失败返回ErrInvalidCRC
+func (vr *ValueReader) Read(p []byte) (int, error) {
+	if vr.remaining == 0 {
+		if vr.crc != vr.expected {
+			return 0, ErrInvalidCRC
+		}
+		return 0, io.EOF
+	}
+	if vr.sc != nil {
+		return vr.readSealed(p)
+	}
+	if int64(len(p)) > vr.remaining {
+		p = p[:vr.remaining]
+	}
+	n, err := vr.ioManager.Read(p, vr.offset)
+	vr.crc = crc32.Update(vr.crc, crc32.IEEETable, p[:n])
+	vr.offset += int64(n)
+	vr.remaining -= int64(n)
+	//读取到文件末尾时value应该已经读取完毕，否则说明文件被截断了
+	if err == io.EOF {
+		err = nil
+		if vr.remaining > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+// 读取加密的value，上一个分块的数据读取完毕之后读取并解密下一个分块
+// 分块的crc在读取到末尾时校验，key已经解密成功，分块解密失败说明数据损坏了
+func (vr *ValueReader) readSealed(p []byte) (int, error) {
+	if len(vr.chunk) == 0 {
+		if vr.buf == nil {
+			vr.buf = make([]byte, streamChunkSize+encryptionTagSize)
+		}
+		sealed := vr.buf[:min(vr.sealed, streamChunkSize+encryptionTagSize)]
+		n, err := vr.ioManager.Read(sealed, vr.offset)
+		if n < len(sealed) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		vr.crc = crc32.Update(vr.crc, crc32.IEEETable, sealed)
+		vr.offset += int64(n)
+		vr.sealed -= int64(n)
+		if vr.chunk, err = vr.sc.open(sealed[:0], sealed); err != nil {
+			return 0, ErrInvalidCRC
+		}
+	}
+	n := copy(p, vr.chunk)
+	vr.chunk = vr.chunk[n:]
+	vr.remaining -= int64(n)
+	return n, nil
+}
@@ -0,0 +1,172 @@
+package data
+
+import (
+	"bitcask-go/fio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDataFile_WriteLogRecordStream(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-stream")
+	defer os.RemoveAll(dir)
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	defer dataFile.Close()
+
+	value := bytes.Repeat([]byte("bitcask-go"), 20000)
+	rec := &LogRecord{Key: []byte("name"), Type: LogRecordNormal, Expire: 100}
+	size := StreamLogRecordSize(rec, int64(len(value)), nil)
+	assert.Nil(t, dataFile.WriteLogRecordStream(rec, bytes.NewReader(value), int64(len(value))))
+	assert.Equal(t, size, dataFile.WriteOff)
+
+	//数据不足时返回错误
+	err = dataFile.WriteLogRecordStream(rec, bytes.NewReader(value[:10]), 100)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	logRecord, readSize, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, size, readSize)
+	assert.Equal(t, []byte("name"), logRecord.Key)
+	assert.Equal(t, value, logRecord.Value)
+	assert.Equal(t, LogRecordNormal, logRecord.Type)
+	assert.Equal(t, int64(100), logRecord.Expire)
+
+	logRecord, reader, err := dataFile.OpenValueReader(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("name"), logRecord.Key)
+	assert.Equal(t, int64(len(value)), reader.Size())
+	buf, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, value, buf)
+}
+
+func TestDataFile_WriteLogRecordStream_Encryption(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-stream-encryption")
+	defer os.RemoveAll(dir)
+	key1, key2 := bytes.Repeat([]byte("a"), 32), bytes.Repeat([]byte("b"), 16)
+	cipher1, err := NewCipher(key1, nil)
+	assert.Nil(t, err)
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	dataFile.Cipher = cipher1
+
+	//value分为多个分块加密，最后一个分块不满
+	value := bytes.Repeat([]byte("bitcask-go"), 20000)
+	rec := &LogRecord{Key: []byte("name"), Type: LogRecordNormal, Expire: 100}
+	size := StreamLogRecordSize(rec, int64(len(value)), cipher1)
+	assert.Nil(t, dataFile.WriteLogRecordStream(rec, bytes.NewReader(value), int64(len(value))))
+	assert.Equal(t, size, dataFile.WriteOff)
+	empty := &LogRecord{Key: []byte("empty"), Type: LogRecordNormal}
+	assert.Nil(t, dataFile.WriteLogRecordStream(empty, bytes.NewReader(nil), 0))
+	assert.Nil(t, dataFile.Close())
+
+	buf, err := os.ReadFile(GetDataFileName(dir, 0))
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(buf, []byte("bitcask-go")))
+	assert.False(t, bytes.Contains(buf, []byte("name")))
+
+	//轮换密钥之后仍然可以使用之前的密钥读取
+	cipher2, err := NewCipher(key2, [][]byte{key1})
+	assert.Nil(t, err)
+	dataFile, err = OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	dataFile.Cipher = cipher2
+	logRecord, readSize, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, size, readSize)
+	assert.Equal(t, []byte("name"), logRecord.Key)
+	assert.Equal(t, value, logRecord.Value)
+	assert.Equal(t, int64(100), logRecord.Expire)
+	logRecord, _, err = dataFile.ReadLogRecord(size)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("empty"), logRecord.Key)
+	assert.Equal(t, 0, len(logRecord.Value))
+	//流式读取时逐个解密value分块
+	logRecord, reader, err := dataFile.OpenValueReader(0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("name"), logRecord.Key)
+	assert.Equal(t, int64(len(value)), reader.Size())
+	var streamed []byte
+	readBuf := make([]byte, 1000)
+	for {
+		n, err := reader.Read(readBuf)
+		streamed = append(streamed, readBuf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, value, streamed)
+	logRecord, reader, err = dataFile.OpenValueReader(size)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("empty"), logRecord.Key)
+	streamed, err = io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(streamed))
+	assert.Nil(t, dataFile.Close())
+
+	//调换两个分块并重新计算crc之后解密失败
+	chunk := streamChunkSize + encryptionTagSize
+	end := int(size) - crc32.Size
+	start := end - (len(value)%streamChunkSize + encryptionTagSize) - 2*chunk
+	swapped := append([]byte(nil), buf...)
+	copy(swapped[start:], buf[start+chunk:start+2*chunk])
+	copy(swapped[start+chunk:], buf[start:start+chunk])
+	chunksStart := end - len(value)/streamChunkSize*chunk - (len(value)%streamChunkSize + encryptionTagSize)
+	binary.LittleEndian.PutUint32(swapped[end:], crc32.ChecksumIEEE(swapped[chunksStart:end]))
+	assert.Nil(t, os.WriteFile(GetDataFileName(dir, 0), swapped, 0644))
+	dataFile, err = OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	defer dataFile.Close()
+	dataFile.Cipher = cipher1
+	_, _, err = dataFile.ReadLogRecord(0)
+	assert.Equal(t, ErrWrongEncryptionKey, err)
+	_, reader, err = dataFile.OpenValueReader(0)
+	assert.Nil(t, err)
+	_, err = io.ReadAll(reader)
+	assert.Equal(t, ErrInvalidCRC, err)
+}
+
+func TestDataFile_OpenValueReader(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-stream")
+	defer os.RemoveAll(dir)
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+
+	value := bytes.Repeat([]byte("bitcask-go"), 20000)
+	enc1, size1 := EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: value})
+	assert.Nil(t, dataFile.Write(enc1))
+	enc2, _ := EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: value, Compressed: true})
+	assert.Nil(t, dataFile.Write(enc2))
+
+	_, reader, err := dataFile.OpenValueReader(0)
+	assert.Nil(t, err)
+	buf, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, value, buf)
+
+	//压缩的记录不能流式读取
+	_, _, err = dataFile.OpenValueReader(size1)
+	assert.Equal(t, ErrValueNotStreamable, err)
+	assert.Nil(t, dataFile.Close())
+
+	//value损坏时读取到末尾返回crc错误
+	fileName := GetDataFileName(dir, 0)
+	fileData, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	fileData[size1-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, fileData, 0644))
+	dataFile, err = OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	defer dataFile.Close()
+	_, reader, err = dataFile.OpenValueReader(0)
+	assert.Nil(t, err)
+	_, err = io.ReadAll(reader)
+	assert.Equal(t, ErrInvalidCRC, err)
+}
@@ -5,15 +5,18 @@ import (
 	"bitcask-go/fio"
 	"bitcask-go/index"
 	"bitcask-go/utils"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gofrs/flock"
 )
@@ -25,36 +28,74 @@ const (
 
 // DB bitcask存储引擎实例
 type DB struct {
-	options         Options
-	mu              *sync.RWMutex
-	fileIds         []int                     //文件id，只能在加载索引时使用
-	activeFile      *data.DataFile            //当前活跃文件，可以用于写入
-	olderFiles      map[uint32]*data.DataFile //旧的数据文件，只能用于用于可读
-	index           index.Indexer             //内容索引
-	seqNo           uint64                    //事务序列号，全局递增
-	isMergeing      bool                      //是否正在Mergeing
-	seqNoFileExists bool                      //存储事务序列号的文件是否存在
-	isInitial       bool                      //是否是第一次初始化此数据目录
-	fileLock        *flock.Flock              //文件锁保证多进程之间的互斥
-	bytesWrite      uint                      //累计写了多少个字节
-	reclaimSize     int64                     //表示有多少数据时无效的
+	options          Options
+	mu               *sync.RWMutex
+	fileIds          []int                     //文件id，只能在加载索引时使用
+	activeFile       *data.DataFile            //当前活跃文件，可以用于写入
+	olderFiles       map[uint32]*data.DataFile //旧的数据文件，只能用于用于可读
+	index            index.Indexer             //内容索引
+	seqNo            uint64                    //事务序列号，全局递增
+	isMergeing       bool                      //是否正在Mergeing
+	seqNoFileExists  bool                      //存储事务序列号的文件是否存在
+	isInitial        bool                      //是否是第一次初始化此数据目录
+	fileLock         *flock.Flock              //文件锁保证多进程之间的互斥
+	bytesWrite       uint                      //累计写了多少个字节
+	reclaimSize      int64                     //表示有多少数据时无效的
+	writeSize        int64                     //写入的记录不压缩时的大小
+	writeDiskSize    int64                     //写入的记录实际占用的磁盘大小
+	fileStats        map[uint32]*fileStat      //每个数据文件的统计信息
+	cipher           *data.Cipher              //记录的加密配置，为空表示不加密
+	activeBlobFile   *data.DataFile            //当前写入的blob文件
+	blobFiles        map[uint32]*data.DataFile //所有的blob文件，包括当前写入的blob文件
+	blobStats        map[uint32]*fileStat      //每个blob文件的统计信息
+	nextBlobFileId   uint32                    //下一个blob文件的id
+	activeHints      []byte                    //活跃文件中记录的hint，活跃文件写满之后写入hint文件
+	activeHintsValid bool                      //activeHints是否包含了活跃文件中所有的记录
+	fileRefs         map[*data.DataFile]int    //每个数据文件和blob文件被快照、迭代器引用的次数
+	obsoleteFiles    map[*data.DataFile]bool   //已经被替换，等待引用释放后关闭的文件
+	writeVersion     uint64                    //用户写入的版本号，每次写入递增，也是订阅事件的序号
+	activeTxns       map[uint64]int            //未结束的事务开始时的写入版本号及其数量
+	keyVersions      map[string]uint64         //有事务未结束时默认列族中key最后一次被修改的版本号
+	families         map[uint32]*ColumnFamily  //所有的列族，默认列族使用index作为索引
+	defaultFamily    *ColumnFamily             //默认列族
+	watchers         *watchers                 //数据变更的订阅者
+	mergeHorizon     uint32                    //最近一次merge没有参与的最小文件id，之前的变更已经无法读取
+	mergeInfo        *mergeInfo                //最近一次merge的信息，为空表示没有merge过
+	autoMergeStop    chan struct{}             //通知后台自动merge退出
+	autoMergeDone    chan struct{}             //后台自动merge已经退出
+	autoMergeErr     error                     //最近一次自动merge的错误，成功之后清空
+	readCache        *readCache                //value的读缓存，为空表示不缓存
 }
 
 // Stat存储索引统计信息
 type Stat struct {
-	KeyNum          uint  //key的总数量
-	DataFileNum     uint  //磁盘上面数据文件数量
-	ReclaimableSize int64 //可以进行Merge回收的数据量，字节为单位
-	DiskSize        int64 //数据目录所占磁盘空间大小
+	KeyNum          uint       //key的总数量
+	DataFileNum     uint       //磁盘上面数据文件数量
+	ReclaimableSize int64      //可以进行Merge回收的数据量，字节为单位
+	DiskSize        int64      //数据目录所占磁盘空间大小
+	FileStats       []FileStat //每个数据文件的统计信息
+	//打开之后写入的记录不压缩的大小和实际大小的比值，没有写入时为1
+	CompressionRatio float64
+	BlobFileStats    []FileStat //每个blob文件的统计信息
+	CacheHits        uint64     //读缓存命中的次数
+	CacheMisses      uint64     //读缓存未命中的次数
+	AutoMergeError   error      //最近一次自动merge失败的原因，成功之后为空
 }
 
 // Open 打开bitcask存储引擎实例
-func Open(options Options) (*DB, error) {
+func Open(options Options) (_ *DB, err error) {
 	//对用户传入的配置项进行校验
-	err := checkOptions(options)
+	err = checkOptions(options)
 	if err != nil {
 		return nil, err
 	}
+	//配置了密钥时加密写入文件的记录
+	var cipher *data.Cipher
+	if len(options.EncryptionKey) > 0 || len(options.PreviousEncryptionKeys) > 0 {
+		if cipher, err = data.NewCipher(options.EncryptionKey, options.PreviousEncryptionKeys); err != nil {
+			return nil, err
+		}
+	}
 	var isInitial bool
 	//判断数据目录是否存在，如果不存在，则创建这个目录
 	if _, err := os.Stat(options.DirPath); os.IsNotExist(err) {
@@ -72,6 +113,12 @@ func Open(options Options) (*DB, error) {
 	if !hold {
 		return nil, ErrDatabaseIsUsing
 	}
+	//打开失败时释放目录锁，修复数据之后可以重新打开
+	defer func() {
+		if err != nil {
+			_ = fileLock.Unlock()
+		}
+	}()
 	entries, err := os.ReadDir(options.DirPath)
 	if err != nil {
 		return nil, err
@@ -81,12 +128,26 @@ func Open(options Options) (*DB, error) {
 	}
 	//初始化DB实例结构体
 	db := &DB{
-		options:    options,
-		mu:         new(sync.RWMutex),
-		olderFiles: make(map[uint32]*data.DataFile),
-		index:      index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrites),
-		isInitial:  isInitial,
-		fileLock:   fileLock,
+		options:       options,
+		mu:            new(sync.RWMutex),
+		olderFiles:    make(map[uint32]*data.DataFile),
+		index:         index.NewIndexer(options.IndexType, options.DirPath, options.SyncWrites, options.BloomFilterFalsePositiveRate),
+		isInitial:     isInitial,
+		fileLock:      fileLock,
+		watchers:      newWatchers(),
+		fileStats:     make(map[uint32]*fileStat),
+		cipher:        cipher,
+		blobFiles:     make(map[uint32]*data.DataFile),
+		blobStats:     make(map[uint32]*fileStat),
+		readCache:     newReadCache(options.ReadCacheSize),
+		fileRefs:      make(map[*data.DataFile]int),
+		obsoleteFiles: make(map[*data.DataFile]bool),
+		activeTxns:    make(map[uint64]int),
+		keyVersions:   make(map[string]uint64),
+	}
+	//加载列族信息
+	if err := db.loadColumnFamilies(); err != nil {
+		return nil, err
 	}
 	//加载merge数据目录
 	if err := db.loadMergeFiles(); err != nil {
@@ -96,6 +157,15 @@ func Open(options Options) (*DB, error) {
 	if err := db.loadDataFiles(); err != nil {
 		return nil, err
 	}
+	if err := db.loadBlobFiles(); err != nil {
+		return nil, err
+	}
+	if err := db.loadMergeHorizon(); err != nil {
+		return nil, err
+	}
+	if err := db.loadChangesHorizon(); err != nil {
+		return nil, err
+	}
 	//B+树索引不需要从数据文件中加载索引
 	if options.IndexType != BPlusTree {
 		//从Hint索引文件中加载索引
@@ -120,7 +190,15 @@ func Open(options Options) (*DB, error) {
 		if err := db.loadSeqNo(); err != nil {
 			return nil, err
 		}
+		if err := db.recoverActiveFile(); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.loadBlobStats(); err != nil {
+		return nil, err
 	}
+	//开启后台自动merge
+	db.startAutoMerge()
 	return db, nil
 }
 
@@ -131,26 +209,26 @@ func (db *DB) Close() error {
 			panic(fmt.Sprintf("failed to unlock the directory,%v", err))
 		}
 	}()
+	//停止后台自动merge，正在进行的merge完成之后才会返回
+	db.stopAutoMerge()
+	//关闭所有的订阅
+	db.watchers.closeAll()
 	if db.activeFile == nil {
 		return nil
 	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
 	//保存当前事务序列号
-	seqNoFile, err := data.OpenSeqNoFile(db.options.DirPath)
-	if err != nil {
+	if err := db.writeSeqNoFile(db.options.DirPath); err != nil {
 		return err
 	}
-	record := &data.LogRecord{
-		Key:   []byte(seqNoKey),
-		Value: []byte(strconv.FormatUint(db.seqNo, 10)),
-	}
-	encRecord, _ := data.EncodeLogRecord(record)
-	if err := seqNoFile.Write(encRecord); err != nil {
-		return err
-	}
-	if err := seqNoFile.Sync(); err != nil {
-		return err
+	//保存B+树索引的布隆过滤器，下次打开时不需要重建
+	for _, cf := range db.families {
+		if bpt, ok := cf.index.(*index.BPlusTree); ok {
+			if err := bpt.SaveBloomFilter(); err != nil {
+				return err
+			}
+		}
 	}
 	//关闭当前活跃文件
 	if err := db.activeFile.Close(); err != nil {
@@ -162,6 +240,19 @@ func (db *DB) Close() error {
 			return err
 		}
 	}
+	//关闭blob文件
+	for _, file := range db.blobFiles {
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	//关闭merge之后还没有释放的数据文件
+	for file := range db.obsoleteFiles {
+		if err := file.Close(); err != nil {
+			return err
+		}
+		delete(db.obsoleteFiles, file)
+	}
 	return nil
 }
 
@@ -172,6 +263,11 @@ func (db *DB) Sync() error {
 	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if db.activeBlobFile != nil {
+		if err := db.activeBlobFile.Sync(); err != nil {
+			return err
+		}
+	}
 	return db.activeFile.Sync()
 }
 
@@ -187,105 +283,230 @@ func (db *DB) Stat() *Stat {
 	if err != nil {
 		panic(fmt.Sprintf("failed to get dir size:%v", err))
 	}
+	var keyNum uint
+	for _, cf := range db.families {
+		keyNum += uint(cf.index.Size())
+	}
+	var compressionRatio float64 = 1
+	if db.writeDiskSize > 0 {
+		compressionRatio = float64(db.writeSize) / float64(db.writeDiskSize)
+	}
+	cacheHits, cacheMisses := db.readCache.stats()
 	return &Stat{
-		KeyNum:          uint(db.index.Size()),
-		DataFileNum:     dataFiles,
-		ReclaimableSize: db.reclaimSize,
-		DiskSize:        dirSize, //todo
+		KeyNum:           keyNum,
+		DataFileNum:      dataFiles,
+		ReclaimableSize:  db.reclaimSize,
+		DiskSize:         dirSize, //todo
+		FileStats:        db.getFileStats(),
+		CompressionRatio: compressionRatio,
+		BlobFileStats:    db.getBlobFileStats(),
+		CacheHits:        cacheHits,
+		CacheMisses:      cacheMisses,
+		AutoMergeError:   db.autoMergeErr,
 	}
 
 }
 
-// 备份数据库，将数据文件拷贝到新的目录中
+// 备份数据库，将数据文件拷贝到新的目录中，并写入备份清单
 func (db *DB) BackUp(dir string) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
-	return utils.CopyDir(db.options.DirPath, dir, []string{fileLockName})
+	_, err := db.backUp(dir, "")
+	return err
 }
 
 // Put 写入key/value数据，key不能为空
 func (db *DB) Put(key []byte, value []byte) error {
+	return db.put(db.defaultFamily, key, value, 0)
+}
+
+// PutWithTTL 写入key/value数据，数据在ttl时间之后过期，ttl必须大于0
+func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return db.put(db.defaultFamily, key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// 写入key/value数据到指定的列族，expire为过期时间，为0表示永不过期
+func (db *DB) put(cf *ColumnFamily, key []byte, value []byte, expire int64) error {
 	//判断是key是否有效
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
 	//构造LogRecord
 	logRecord := &data.LogRecord{
-		Key:   logRecordKeyWithSeq(key, nonTransactionSeqNo),
-		Value: value,
-		Type:  data.LogRecordNormal,
+		Key:      logRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Value:    value,
+		Type:     data.LogRecordNormal,
+		Expire:   expire,
+		FamilyId: cf.id,
 	}
+	//写入数据文件和更新内存索引需要在同一把锁内完成，保证事务冲突检测看到的索引和数据文件一致
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	//追加写入到活跃数据文件当中
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
 		return err
 	}
 	//更新内存索引
-	if oldPos := db.index.Put(key, pos); oldPos != nil {
-		db.reclaimSize += int64(oldPos.Size)
+	db.markLive(pos)
+	if oldPos := cf.index.Put(key, pos); oldPos != nil {
+		db.markStale(oldPos)
 	}
+	db.notifyWrite(cf.id, &WatchEvent{Type: WatchPut, Key: key, Value: value})
 	return nil
 }
 
 // Delete 根据key删除对应的数据
 func (db *DB) Delete(key []byte) error {
+	return db.delete(db.defaultFamily, key)
+}
+
+// 根据key删除指定列族中对应的数据
+func (db *DB) delete(cf *ColumnFamily, key []byte) error {
 	//判断key的有效性
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	//先检查key是否存在，如果不存在的话直接返回
-	if pos := db.index.Get(key); pos != nil {
+	if pos := cf.index.Get(key); pos == nil {
 		return nil
 	}
 	//构造LogRecord，标识其是被删除的
 	logRecord := &data.LogRecord{
-		Key:  logRecordKeyWithSeq(key, nonTransactionSeqNo),
-		Type: data.LogRecordDeleted,
+		Key:      logRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Type:     data.LogRecordDeleted,
+		FamilyId: cf.id,
 	}
 	//写入到数据文件当中
-	pos, err := db.appendLogRecordWithLock(logRecord)
+	pos, err := db.appendLogRecord(logRecord)
 	if err != nil {
-		return nil
+		return err
 	}
-	db.reclaimSize += int64(pos.Size)
+	db.markGarbage(pos)
 	//从内存索引中将对应的key删除
-	oldPos, ok := db.index.Delete(key)
+	oldPos, ok := cf.index.Delete(key)
 	if !ok {
 		return ErrIndexUpdateFailed
 	}
 	if oldPos != nil {
-		db.reclaimSize += int64(oldPos.Size)
+		db.markStale(oldPos)
 	}
+	db.notifyWrite(cf.id, &WatchEvent{Type: WatchDelete, Key: key})
 	return nil
 }
 
-// Get 根据key读取数据
-func (db *DB) Get(key []byte) ([]byte, error) {
+// DeleteRange 删除[start,end)范围内的所有数据，end为空表示删除start之后的所有数据
+// 只会写入一条范围删除的记录
+func (db *DB) DeleteRange(start []byte, end []byte) error {
+	return db.deleteRange(db.defaultFamily, start, end)
+}
+
+// DeletePrefix 删除所有以prefix为前缀的数据
+func (db *DB) DeletePrefix(prefix []byte) error {
+	return db.deleteRange(db.defaultFamily, prefix, prefixEnd(prefix))
+}
+
+// 删除指定列族中[start,end)范围内的所有数据
+func (db *DB) deleteRange(cf *ColumnFamily, start []byte, end []byte) error {
+	if len(end) > 0 && bytes.Compare(start, end) >= 0 {
+		return ErrInvalidKeyRange
+	}
+	//构造LogRecord，标识其是被范围删除的
+	logRecord := &data.LogRecord{
+		Key:      logRecordKeyWithSeq(start, nonTransactionSeqNo),
+		Value:    end,
+		Type:     data.LogRecordRangeDeleted,
+		FamilyId: cf.id,
+	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	//写入到数据文件当中
+	pos, err := db.appendLogRecord(logRecord)
+	if err != nil {
+		return err
+	}
+	db.markGarbage(pos)
+	//从内存索引中将范围内的key删除
+	version := db.nextWriteVersion()
+	for _, key := range db.deleteIndexRange(cf.index, start, end) {
+		db.recordKeyWrite(cf.id, key)
+	}
+	db.watchers.notify(cf.id, &WatchEvent{Type: WatchDeleteRange, Key: start, Value: end, SeqNo: version})
+	return nil
+}
+
+// 返回大于所有以prefix为前缀的key的最小key，为空表示不存在
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// Get 根据key读取数据
+func (db *DB) Get(key []byte) ([]byte, error) {
+	return db.get(db.defaultFamily, key)
+}
+
+// 根据key读取指定列族中的数据，读取期间只持有读锁，不同的key可以并发读取
+func (db *DB) get(cf *ColumnFamily, key []byte) ([]byte, error) {
 	//判断key的有效性
 	if len(key) == 0 {
 		return nil, ErrKeyIsEmpty
 	}
+	db.mu.RLock()
 	//从内存数据结构中取出key对应的索引信息
-	logRecordPos := db.index.Get(key)
+	logRecordPos := cf.index.Get(key)
 	//如果key不在内存索引中，说明key不存在
 	if logRecordPos == nil {
+		db.mu.RUnlock()
+		return nil, ErrKeyNotFound
+	}
+	if logRecordPos.IsExpired(time.Now().UnixNano()) {
+		db.mu.RUnlock()
+		db.removeExpired(cf, key, logRecordPos)
 		return nil, ErrKeyNotFound
 	}
+	defer db.mu.RUnlock()
 	//从数据文件中获取value
 	return db.getValueByPosition(logRecordPos)
 }
 
-// ListKeys获取数据库中所有的key
+// 已经过期的key从内存索引中删除，空间可以被merge回收
+// 释放读锁之后key可能已经被重新写入，只删除仍然指向pos的key
+func (db *DB) removeExpired(cf *ColumnFamily, key []byte, pos *data.LogRecordPos) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	current := cf.index.Get(key)
+	if current == nil || current.Fid != pos.Fid || current.Offset != pos.Offset {
+		return
+	}
+	if _, ok := cf.index.Delete(key); ok {
+		db.markStale(current)
+	}
+}
+
+// ListKeys获取数据库中所有的key，不包含已经过期的key
 func (db *DB) ListKeys() [][]byte {
 	iterator := db.index.Iterator(false)
 	defer iterator.Close()
-	keys := make([][]byte, db.index.Size())
-	var idx int
+	keys := make([][]byte, 0, db.index.Size())
+	now := time.Now().UnixNano()
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		keys[idx] = iterator.Key()
-		idx++
+		if iterator.Value().IsExpired(now) {
+			continue
+		}
+		keys = append(keys, iterator.Key())
 	}
 	return keys
 }
@@ -296,7 +517,11 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 	defer db.mu.RUnlock()
 	iterator := db.index.Iterator(false)
 	defer iterator.Close()
+	now := time.Now().UnixNano()
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if iterator.Value().IsExpired(now) {
+			continue
+		}
 		value, err := db.getValueByPosition(iterator.Value())
 		if err != nil {
 			return err
@@ -310,33 +535,74 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 
 // 根据索引信息获取对应的value
 func (db *DB) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error) {
-	//根据文件id找到对应的数据文件
-	var dataFile *data.DataFile
-	if db.activeFile.FileId == logRecordPos.Fid {
-		dataFile = db.activeFile
-	} else {
-		dataFile = db.olderFiles[logRecordPos.Fid]
-	}
-	//数据文件为空
-	if dataFile == nil {
-		return nil, ErrDataFileNotFound
-	}
-	//根据偏移读取对应的数据
-	logRecord, _, err := dataFile.ReadLogRecord(logRecordPos.Offset)
+	return db.readCachedValue(db.getDataFile, db.getBlobFile, logRecordPos)
+}
+
+// 根据索引信息从给定的文件中获取value，优先从读缓存中获取
+func (db *DB) readCachedValue(getDataFile func(fid uint32) *data.DataFile, getBlobFile func(fid uint32) *data.DataFile,
+	logRecordPos *data.LogRecordPos) ([]byte, error) {
+	if value, ok := db.readCache.get(logRecordPos.Fid, logRecordPos.Offset); ok {
+		return value, nil
+	}
+	value, err := db.readValue(getDataFile, getBlobFile, logRecordPos)
 	if err != nil {
 		return nil, err
 	}
-	if logRecord.Type == data.LogRecordDeleted {
-		return nil, ErrKeyNotFound
+	db.readCache.put(logRecordPos.Fid, logRecordPos.Offset, value)
+	return value, nil
+}
+
+// 根据文件id找到对应的数据文件
+func (db *DB) getDataFile(fid uint32) *data.DataFile {
+	if db.activeFile != nil && db.activeFile.FileId == fid {
+		return db.activeFile
 	}
-	return logRecord.Value, nil
+	return db.olderFiles[fid]
 }
 
-// 追加写数据到活跃文件中
-func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
+// 引用当前所有的数据文件，被引用期间merge替换掉的数据文件不会被关闭
+// 在访问此方法前必须得有互斥锁
+func (db *DB) pinDataFiles() map[uint32]*data.DataFile {
+	files := make(map[uint32]*data.DataFile, len(db.olderFiles)+1)
+	for fid, dataFile := range db.olderFiles {
+		files[fid] = dataFile
+	}
+	if db.activeFile != nil {
+		files[db.activeFile.FileId] = db.activeFile
+	}
+	for _, dataFile := range files {
+		db.fileRefs[dataFile]++
+	}
+	return files
+}
+
+// 释放对数据文件和blob文件的引用，已经被替换的文件没有引用之后关闭
+func (db *DB) unpinFiles(fileSets ...map[uint32]*data.DataFile) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	return db.appendLogRecord(logRecord)
+	for _, files := range fileSets {
+		for _, file := range files {
+			db.fileRefs[file]--
+			if db.fileRefs[file] > 0 {
+				continue
+			}
+			delete(db.fileRefs, file)
+			if db.obsoleteFiles[file] {
+				delete(db.obsoleteFiles, file)
+				_ = file.Close()
+			}
+		}
+	}
+}
+
+// 关闭不再使用的文件，还有引用时延迟到引用释放之后关闭
+// 在访问此方法前必须得有互斥锁
+func (db *DB) closeObsoleteFile(file *data.DataFile) error {
+	if db.fileRefs[file] > 0 {
+		db.obsoleteFiles[file] = true
+		return nil
+	}
+	return file.Close()
 }
 
 // 追加写数据到活跃文件中
@@ -348,18 +614,22 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 			return nil, err
 		}
 	}
-	//写入数据编码
+	//较大的value存储到blob文件中，记录中只保存blob记录的位置
+	if db.isBlobRecord(logRecord) {
+		blobRecord, err := db.appendBlobRecord(logRecord)
+		if err != nil {
+			return nil, err
+		}
+		logRecord = blobRecord
+	}
+	//根据用户配置决定是否压缩value，读取的记录重新写入时同样按照当前配置处理
+	logRecord.Compressed = db.options.Compression && len(logRecord.Value) >= db.options.CompressionMinSize
+	//写入数据编码，加密之后的记录会增加认证标签的长度
 	encRecord, size := data.EncodeLogRecord(logRecord)
+	size += db.cipher.Overhead()
 	//如果写入的数据已经到达了活跃文件的阈值，则关闭活跃文件，并打开新的文件
 	if db.activeFile.WriteOff+size > db.options.DataFileSize {
-		//先持久化数据文件，保证已有的数据持久到磁盘中
-		if err := db.activeFile.Sync(); err != nil {
-			return nil, err
-		}
-		//将当前活跃文件转化为旧的活跃文件
-		db.olderFiles[db.activeFile.FileId] = db.activeFile
-		//打开新的数据文件
-		if err := db.setActiveDataFile(); err != nil {
+		if err := db.rotateActiveFile(); err != nil {
 			return nil, err
 		}
 	}
@@ -368,6 +638,8 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 		return nil, err
 	}
 	db.bytesWrite += uint(size)
+	db.writeSize += data.EncodedLogRecordSize(logRecord)
+	db.writeDiskSize += size
 	//根据用户配置决定是否持久化
 	var needSync = db.options.SyncWrites
 	if !needSync && db.options.BytesPerSync > 0 && db.bytesWrite >= db.options.BytesPerSync {
@@ -389,10 +661,29 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 		}
 	}
 
-	pos := &data.LogRecordPos{Fid: db.activeFile.FileId, Offset: writeOff, Size: uint32(size)}
+	pos := &data.LogRecordPos{Fid: db.activeFile.FileId, Offset: writeOff, Size: uint32(size), Expire: logRecord.Expire}
+	if logRecord.Blob {
+		pos.Blob = data.DecodeLogRecordPos(logRecord.Value)
+	}
+	db.appendActiveHint(logRecord, pos)
 	return pos, nil
 }
 
+// 持久化当前活跃文件并转换为旧的数据文件，然后打开新的活跃文件
+// 在访问此方法前必须得有互斥锁
+func (db *DB) rotateActiveFile() error {
+	//先持久化数据文件，保证已有的数据持久到磁盘中
+	if err := db.activeFile.Sync(); err != nil {
+		return err
+	}
+	//hint文件只用于加快启动，写入失败时启动会读取整个数据文件
+	_ = db.writeDataHintFile()
+	//将当前活跃文件转化为旧的活跃文件
+	db.olderFiles[db.activeFile.FileId] = db.activeFile
+	//打开新的数据文件
+	return db.setActiveDataFile()
+}
+
 // 设置当前活跃文件
 // 在访问此方法前必须得有互斥锁
 func (db *DB) setActiveDataFile() error {
@@ -400,11 +691,19 @@ func (db *DB) setActiveDataFile() error {
 	if db.activeFile != nil {
 		initialFileid = db.activeFile.FileId + 1
 	}
+	//merge之后的数据文件id可能比活跃文件大，新的活跃文件使用最大的文件id
+	for fid := range db.olderFiles {
+		if fid >= initialFileid {
+			initialFileid = fid + 1
+		}
+	}
 	dataFile, err := data.OpenDataFile(db.options.DirPath, initialFileid, fio.StandardFIO)
 	if err != nil {
 		return err
 	}
+	dataFile.Cipher = db.cipher
 	db.activeFile = dataFile
+	db.activeHints, db.activeHintsValid = db.activeHints[:0], true
 	return nil
 }
 
@@ -441,6 +740,7 @@ func (db *DB) loadDataFiles() error {
 		if err != nil {
 			return err
 		}
+		dataFile.Cipher = db.cipher
 		if i == len(fileIds)-1 { //最后一个，id最大的，说明是当前活跃文件
 			db.activeFile = dataFile
 		} else { //说明是旧的数据文件
@@ -457,96 +757,207 @@ func (db *DB) loadIndexFromDataFiles() error {
 	if len(db.fileIds) == 0 {
 		return nil
 	}
-	//查看是否发生过merge
-	hasMerge, nonMergeFileId := false, uint32(0)
-	mergeFinFileName := filepath.Join(db.options.DirPath, data.MergeFinishedFileName)
-	if _, err := os.Stat(mergeFinFileName); err == nil {
-		fid, err := db.getNoMergeFileId(db.options.DirPath)
+	now := time.Now().UnixNano()
+	updateIndex := func(familyId uint32, key []byte, value []byte, typ data.LogRecordType, pos *data.LogRecordPos) error {
+		familyIndex, err := db.getFamilyIndex(familyId)
 		if err != nil {
 			return err
 		}
-		hasMerge = true
-		nonMergeFileId = fid
-	}
-
-	updateIndex := func(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
 		var oldPos *data.LogRecordPos
-		if typ == data.LogRecordDeleted {
-			oldPos, _ = db.index.Delete(key)
-			db.reclaimSize += int64(oldPos.Size)
+		//范围删除的记录需要删除范围内所有的key
+		if typ == data.LogRecordRangeDeleted {
+			db.markGarbage(pos)
+			db.deleteIndexRange(familyIndex, key, value)
+			return nil
+		}
+		//合并操作数的记录会引用之前的记录，之前的记录不是无效数据
+		if typ == data.LogRecordMergeOperand {
+			if oldPos := familyIndex.Get(key); oldPos != nil {
+				pos.Size += oldPos.Size
+				pos.Prev = oldPos
+				db.markReferenced(oldPos)
+			}
+			familyIndex.Put(key, pos)
+			db.markLive(pos)
+			return nil
+		}
+		//删除的数据和已经过期的数据都需要从索引中删除，对应的记录本身也是无效的
+		if typ == data.LogRecordDeleted || pos.IsExpired(now) {
+			oldPos, _ = familyIndex.Delete(key)
+			db.markGarbage(pos)
 		} else {
-			oldPos = db.index.Put(key, pos)
+			oldPos = familyIndex.Put(key, pos)
+			db.markLive(pos)
 		}
 		if oldPos != nil {
-			db.reclaimSize += int64(oldPos.Size)
+			db.markStale(oldPos)
 		}
+		return nil
 	}
 	//暂存事务
 	transactionRecords := make(map[uint64][]*data.TransactionRecord)
 	var currentSeqNo = nonTransactionSeqNo
-	//遍历所有的文件id，处理文件中的记录
-	for i, fid := range db.fileIds {
+	applyRecord := func(logRecord *data.LogRecord, logRecordPos *data.LogRecordPos) error {
+		//解析key拿到实物序列号
+		realKey, seqNo := parseLogRecordKey(logRecord.Key)
+
+		if seqNo == nonTransactionSeqNo {
+			//非实务操作，直接更新内存索引
+			if err := updateIndex(logRecord.FamilyId, realKey, logRecord.Value, logRecord.Type, logRecordPos); err != nil {
+				return err
+			}
+		} else {
+			//事务完成，对应的seq no的数据可以更新到内存索引中
+			if logRecord.Type == data.LogRecordTxnFinished {
+				for _, txnRecord := range transactionRecords[seqNo] {
+					record := txnRecord.Record
+					if err := updateIndex(record.FamilyId, record.Key, record.Value, record.Type, txnRecord.Pos); err != nil {
+						return err
+					}
+				}
+				delete(transactionRecords, seqNo)
+				db.markGarbage(logRecordPos)
+			} else {
+				logRecord.Key = realKey
+				transactionRecords[seqNo] = append(transactionRecords[seqNo], &data.TransactionRecord{
+					Record: logRecord,
+					Pos:    logRecordPos,
+				})
+			}
+		}
+		//更新事务序列号
+		if seqNo > currentSeqNo {
+			currentSeqNo = seqNo
+		}
+		return nil
+	}
+	//找出需要加载的数据文件
+	var dataFiles []*data.DataFile
+	for _, fid := range db.fileIds {
 		var fileId = uint32(fid)
-		//如果比最近未参与merge的文件id要小，则说明已经从Hint文件中加载索引了
-		if hasMerge && fileId < nonMergeFileId {
+		//被merge的文件已经删除了，merge生成的文件已经从Hint文件中加载索引了
+		if info := db.mergeInfo; info != nil && (fileId < info.nonMergeFileId || info.isMergeFile(fileId)) {
 			continue
 		}
-		var dataFile *data.DataFile
 		if fileId == db.activeFile.FileId {
-			dataFile = db.activeFile
+			dataFiles = append(dataFiles, db.activeFile)
 		} else {
-			dataFile = db.olderFiles[fileId]
+			dataFiles = append(dataFiles, db.olderFiles[fileId])
 		}
-		var offset int64 = 0
-		for {
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
+	}
+	//并行解码数据文件，按照文件id的顺序依次更新索引
+	done := make(chan struct{})
+	defer close(done)
+	results := db.decodeDataFiles(dataFiles, done)
+	for i, dataFile := range dataFiles {
+		decoded := <-results[i]
+		isActiveFile := dataFile == db.activeFile
+		//丢弃损坏的记录以及之后的数据，之前的记录仍然有效
+		if decoded.err != nil {
+			if err := db.truncateDataFile(dataFile, isActiveFile, decoded.size, decoded.err); err != nil {
 				return err
 			}
-			//构建内存索引并保存
-			logRecordPos := &data.LogRecordPos{Fid: fileId, Offset: offset, Size: uint32(size)}
-
-			//解析key拿到实物序列号
-			realKey, seqNo := parseLogRecordKey(logRecord.Key)
-
-			if seqNo == nonTransactionSeqNo {
-				//非实务操作，直接更新内存索引
-				updateIndex(realKey, logRecord.Type, logRecordPos)
-			} else {
-				//事务完成，对应的seq no的数据可以更新到内存索引中
-				if logRecord.Type == data.LogRecordTxnFinished {
-					for _, txnRecord := range transactionRecords[seqNo] {
-						updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
-					}
-					delete(transactionRecords, seqNo)
-				} else {
-					logRecord.Key = realKey
-					transactionRecords[seqNo] = append(transactionRecords[seqNo], &data.TransactionRecord{
-						Record: logRecord,
-						Pos:    logRecordPos,
-					})
-				}
+		}
+		if isActiveFile {
+			db.activeHints, db.activeHintsValid = nil, true
+		}
+		for j, logRecord := range decoded.logRecords {
+			//活跃文件中的记录需要在写满之后写入hint文件
+			if isActiveFile {
+				db.appendActiveHint(logRecord, decoded.positions[j])
 			}
-			//更新事务序列号
-			if seqNo > currentSeqNo {
-				currentSeqNo = seqNo
+			if err := applyRecord(logRecord, decoded.positions[j]); err != nil {
+				return err
 			}
-			//递增offset，下一次从新的位置开始读
-			offset += size
 		}
 		//如果是当前活跃文件，更新这个文件的WriteOff
-		if i == len(db.fileIds)-1 {
-			db.activeFile.WriteOff = offset
+		if isActiveFile {
+			db.activeFile.WriteOff = decoded.size
 		}
-
 	}
 	//更新事务序列号
 	db.seqNo = currentSeqNo
 	return nil
 }
+
+// 解码之后的数据文件
+type decodedDataFile struct {
+	logRecords []*data.LogRecord
+	positions  []*data.LogRecordPos
+	size       int64 //读取到的数据文件大小，出错时为出错记录的位置
+	err        error
+}
+
+// 并行解码数据文件，返回每个数据文件对应的结果
+// 已经解码但是还没有取出的结果和正在解码的文件总数不超过并行的数量，done关闭之后不再解码剩余的文件
+func (db *DB) decodeDataFiles(dataFiles []*data.DataFile, done <-chan struct{}) []chan *decodedDataFile {
+	parallelism := db.options.IndexLoadParallelism
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+	results := make([]chan *decodedDataFile, len(dataFiles))
+	for i := range results {
+		results[i] = make(chan *decodedDataFile)
+	}
+	activeFile := db.activeFile
+	go func() {
+		sem := make(chan struct{}, parallelism)
+		for i, dataFile := range dataFiles {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(result chan *decodedDataFile, dataFile *data.DataFile, isActiveFile bool) {
+				decoded := db.decodeDataFile(dataFile, isActiveFile)
+				//结果被取出之后才可以解码下一个文件，避免占用过多的内存
+				select {
+				case result <- decoded:
+				case <-done:
+				}
+				<-sem
+			}(results[i], dataFile, dataFile == activeFile)
+		}
+	}()
+	return results
+}
+
+// 解码数据文件中的所有记录，旧的数据文件优先从hint文件中读取，不需要读取value
+// 除了范围删除的结束key之外不保留value，加载索引时不需要
+func (db *DB) decodeDataFile(dataFile *data.DataFile, isActiveFile bool) *decodedDataFile {
+	if !isActiveFile {
+		if logRecords, positions, ok := db.readDataHintFile(dataFile); ok {
+			return &decodedDataFile{logRecords: logRecords, positions: positions}
+		}
+	}
+	decoded := &decodedDataFile{}
+	var offset int64 = 0
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			decoded.size, decoded.err = offset, err
+			return decoded
+		}
+		//构建内存索引并保存
+		logRecordPos := &data.LogRecordPos{Fid: dataFile.FileId, Offset: offset, Size: uint32(size), Expire: logRecord.Expire}
+		if logRecord.Blob {
+			logRecordPos.Blob = data.DecodeLogRecordPos(logRecord.Value)
+		}
+		if logRecord.Type != data.LogRecordRangeDeleted {
+			logRecord.Value = nil
+		}
+		decoded.logRecords = append(decoded.logRecords, logRecord)
+		decoded.positions = append(decoded.positions, logRecordPos)
+		//递增offset，下一次从新的位置开始读
+		offset += size
+	}
+	decoded.size = offset
+	return decoded
+}
+
 func checkOptions(options Options) error {
 	if options.DirPath == "" {
 		return errors.New("database dir path is empty")
@@ -557,6 +968,26 @@ func checkOptions(options Options) error {
 	if options.DataFileMergeRatio < 0 || options.DataFileMergeRatio > 1 {
 		return errors.New("invalid merge ration,must between 0 and 1")
 	}
+	if options.BlobValueThreshold > 0 && options.BlobFileSize <= 0 {
+		return errors.New("blob file size must be greater than 0")
+	}
+	if options.BloomFilterFalsePositiveRate < 0 || options.BloomFilterFalsePositiveRate >= 1 {
+		return errors.New("invalid bloom filter false positive rate,must between 0 and 1")
+	}
+	//B+树索引文件中的key和位置信息没有加密
+	if options.IndexType == BPlusTree && (len(options.EncryptionKey) > 0 || len(options.PreviousEncryptionKeys) > 0) {
+		return errors.New("the b+ tree index is stored in plaintext,can not be used with encryption")
+	}
+	if options.ReadCacheSize < 0 {
+		return errors.New("read cache size must be greater than or equal to 0")
+	}
+	if options.CompressionMinSize < 0 {
+		return errors.New("compression min size must be greater than or equal to 0")
+	}
+	if options.AutoMergeWindowStart < 0 || options.AutoMergeWindowStart >= 24*time.Hour ||
+		options.AutoMergeWindowEnd < 0 || options.AutoMergeWindowEnd >= 24*time.Hour {
+		return errors.New("invalid auto merge window,must between 0 and 24 hours")
+	}
 	return nil
 }
 func (db *DB) loadSeqNo() error {
@@ -568,7 +999,14 @@ func (db *DB) loadSeqNo() error {
 	if err != nil {
 		return err
 	}
+	seqNoFile.Cipher = db.cipher
+	defer func() {
+		_ = seqNoFile.Close()
+	}()
 	record, _, err := seqNoFile.ReadLogRecord(0)
+	if err != nil {
+		return err
+	}
 	seqNo, err := strconv.ParseUint(string(record.Value), 10, 64)
 	if err != nil {
 		return err
@@ -578,6 +1016,86 @@ func (db *DB) loadSeqNo() error {
 	return nil
 }
 
+// 将当前事务序列号写入dirPath中，替换之前保存的序列号文件
+// 在访问此方法前必须得有互斥锁
+func (db *DB) writeSeqNoFile(dirPath string) error {
+	//序列号只读取文件中的第一条记录，使用当前的密钥重新写入
+	if err := os.Remove(filepath.Join(dirPath, data.SeqNoFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	seqNoFile, err := data.OpenSeqNoFile(dirPath)
+	if err != nil {
+		return err
+	}
+	seqNoFile.Cipher = db.cipher
+	defer func() {
+		_ = seqNoFile.Close()
+	}()
+	record := &data.LogRecord{
+		Key:   []byte(seqNoKey),
+		Value: []byte(strconv.FormatUint(db.seqNo, 10)),
+	}
+	encRecord, _ := data.EncodeLogRecord(record)
+	if err := seqNoFile.Write(encRecord); err != nil {
+		return err
+	}
+	return seqNoFile.Sync()
+}
+
+// 读取追加写入的元数据文件中最大的值，文件不存在时返回0
+func (db *DB) loadMaxFileValue(fileName string, openFile func(dirPath string) (*data.DataFile, error)) (uint32, error) {
+	if _, err := os.Stat(filepath.Join(db.options.DirPath, fileName)); os.IsNotExist(err) {
+		return 0, nil
+	}
+	file, err := openFile(db.options.DirPath)
+	if err != nil {
+		return 0, err
+	}
+	file.Cipher = db.cipher
+	defer func() {
+		_ = file.Close()
+	}()
+	var maxValue uint32
+	var offset int64 = 0
+	for {
+		record, size, err := file.ReadLogRecord(offset)
+		if err != nil {
+			//写入过程中崩溃的记录直接忽略
+			if err == io.EOF || err == io.ErrUnexpectedEOF || err == data.ErrInvalidCRC {
+				return maxValue, nil
+			}
+			return 0, err
+		}
+		value, err := strconv.ParseUint(string(record.Value), 10, 32)
+		if err != nil {
+			return 0, ErrDataDirectoryCorrupted
+		}
+		maxValue = max(maxValue, uint32(value))
+		offset += size
+	}
+}
+
+// 将值追加写入到元数据文件的末尾并持久化
+func (db *DB) appendFileValue(openFile func(dirPath string) (*data.DataFile, error), key string, value uint32) error {
+	file, err := openFile(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	file.Cipher = db.cipher
+	defer func() {
+		_ = file.Close()
+	}()
+	record := &data.LogRecord{
+		Key:   []byte(key),
+		Value: []byte(strconv.FormatUint(uint64(value), 10)),
+	}
+	encRecord, _ := data.EncodeLogRecord(record)
+	if err := file.Write(encRecord); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
 // 将数据文件的IO类型设置为标准文件IO
 func (db *DB) resetIoType() error {
 	if db.activeFile == nil {
@@ -1,9 +1,12 @@
 package bitcask_go
 
 import (
+	"bitcask-go/data"
 	"bitcask-go/utils"
 	"bytes"
+	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -200,3 +203,259 @@ func TestDB_BackUp(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, db2)
 }
+
+func TestDB_PutWithTTL(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-ttl")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.PutWithTTL(utils.GetTestKey(1), utils.RandomValue(10), 0)
+	assert.Equal(t, ErrInvalidTTL, err)
+	err = db.PutWithTTL(utils.GetTestKey(1), utils.RandomValue(10), time.Millisecond*100)
+	assert.Nil(t, err)
+	err = db.PutWithTTL(utils.GetTestKey(2), utils.RandomValue(10), time.Hour)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(3), utils.RandomValue(10))
+	assert.Nil(t, err)
+
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+	assert.Equal(t, 3, len(db.ListKeys()))
+
+	//过期之后读取不到
+	time.Sleep(time.Millisecond * 150)
+	assert.Equal(t, 2, len(db.ListKeys()))
+	iter := db.NewIterator(DefalutIteratorOptinos)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.NotEqual(t, utils.GetTestKey(1), iter.Key())
+	}
+	iter.Close()
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	//重启之后过期的数据依然无效
+	err = db.PutWithTTL(utils.GetTestKey(4), utils.RandomValue(10), time.Millisecond*100)
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * 150)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(db2.ListKeys()))
+	_, err = db2.Get(utils.GetTestKey(4))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db2.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	//merge会丢弃过期的数据，hint文件中也不会再加载
+	err = db2.PutWithTTL(utils.GetTestKey(5), utils.RandomValue(10), time.Millisecond*100)
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * 150)
+	err = db2.Merge()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(2), db2.Stat().KeyNum)
+	err = db2.Close()
+	assert.Nil(t, err)
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	defer db3.Close()
+	assert.Equal(t, uint(2), db3.Stat().KeyNum)
+}
+
+func TestDB_Delete(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-delete")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Delete(nil)
+	assert.Equal(t, ErrKeyIsEmpty, err)
+	err = db.Put(utils.GetTestKey(1), utils.GetTestKey(1))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(2), utils.GetTestKey(2))
+	assert.Nil(t, err)
+
+	//删除存在的key
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	//删除不存在的key不会写入记录
+	writeOff := db.activeFile.WriteOff
+	err = db.Delete(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, writeOff, db.activeFile.WriteOff)
+
+	//重启之后删除仍然有效
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db2.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(2), val)
+
+	//写入失败时返回错误，索引保持不变
+	err = db2.Close()
+	assert.Nil(t, err)
+	err = db2.Delete(utils.GetTestKey(2))
+	assert.NotNil(t, err)
+	assert.NotNil(t, db2.index.Get(utils.GetTestKey(2)))
+}
+
+func TestDB_DeleteRange(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-delete-range")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put([]byte(fmt.Sprintf("tenant-a-%03d", i)), utils.RandomValue(64))
+		assert.Nil(t, err)
+		err = db.Put([]byte(fmt.Sprintf("tenant-b-%03d", i)), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	err = db.DeleteRange([]byte("tenant-b"), []byte("tenant-a"))
+	assert.Equal(t, ErrInvalidKeyRange, err)
+
+	err = db.DeletePrefix([]byte("tenant-a"))
+	assert.Nil(t, err)
+	err = db.DeleteRange([]byte("tenant-b-050"), []byte("tenant-b-060"))
+	assert.Nil(t, err)
+	assert.Equal(t, 90, len(db.ListKeys()))
+	_, err = db.Get([]byte("tenant-a-001"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get([]byte("tenant-b-055"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	//范围删除之后重新写入的数据不受影响
+	err = db.Put([]byte("tenant-a-001"), []byte("value"))
+	assert.Nil(t, err)
+
+	//重启之后重放范围删除的记录
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 91, len(db2.ListKeys()))
+	val, err := db2.Get([]byte("tenant-a-001"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+
+	//merge之后被覆盖的数据被清理，从hint文件中加载的索引仍然正确
+	err = db2.Merge()
+	assert.Nil(t, err)
+	err = db2.Close()
+	assert.Nil(t, err)
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 91, len(db3.ListKeys()))
+	_, err = db3.Get([]byte("tenant-b-055"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = db3.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_IndexLoadParallelism(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-index-load")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i%500), utils.RandomValue(64)))
+	}
+	//跨越多个数据文件的事务
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, wb.Commit())
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	stat := db.Stat()
+	assert.Greater(t, stat.DataFileNum, uint(4))
+	err = db.Close()
+	assert.Nil(t, err)
+	//一部分数据文件没有hint文件，需要读取整个数据文件
+	for fid := uint32(0); fid < uint32(stat.DataFileNum); fid += 2 {
+		_ = os.Remove(data.GetDataHintFileName(dir, fid))
+	}
+
+	for _, parallelism := range []int{1, 3, 16} {
+		opts.IndexLoadParallelism = parallelism
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, 900, len(db.ListKeys()))
+		for i := 100; i < 1000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, utils.GetTestKey(i), val)
+		}
+		assert.Equal(t, stat.FileStats, db.Stat().FileStats)
+		assert.Nil(t, db.Close())
+	}
+}
+
+func TestDB_BloomFilter(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bloom")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.IndexType = BPlusTree
+	opts.BloomFilterFalsePositiveRate = 0.01
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 2000; i += 2 {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	_, err = db.Get(utils.GetTestKey(2000))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	//merge之后重建过滤器
+	assert.Nil(t, db.Merge())
+	for i := 0; i < 2000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		if i%2 == 0 {
+			assert.Equal(t, ErrKeyNotFound, err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+	assert.Nil(t, db.Close())
+	_, err = os.Stat(filepath.Join(dir, "bptree-index.bloom"))
+	assert.Nil(t, err)
+
+	opts.BloomFilterFalsePositiveRate = 1
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
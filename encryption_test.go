@@ -0,0 +1,138 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Encryption(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.EncryptionKey = bytes.Repeat([]byte("k"), 32)
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	cf, err := db.CreateColumnFamily("users")
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("customer-pii")))
+	}
+	assert.Nil(t, cf.Put([]byte("user"), []byte("customer-pii")))
+	assert.Nil(t, db.Close())
+
+	//数据文件和hint文件中没有明文
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		if entry.Name() == fileLockName {
+			continue
+		}
+		buf, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(buf, []byte("customer-pii")), entry.Name())
+		assert.False(t, bytes.Contains(buf, []byte("users")), entry.Name())
+	}
+
+	//密钥不正确时无法打开
+	wrongOpts := opts
+	wrongOpts.EncryptionKey = bytes.Repeat([]byte("w"), 32)
+	_, err = Open(wrongOpts)
+	assert.Equal(t, data.ErrWrongEncryptionKey, err)
+	wrongOpts.EncryptionKey = nil
+	_, err = Open(wrongOpts)
+	assert.Equal(t, data.ErrWrongEncryptionKey, err)
+
+	//更换密钥，merge之后使用新的密钥重新加密
+	newKey := bytes.Repeat([]byte("n"), 16)
+	rotateOpts := opts
+	rotateOpts.EncryptionKey = newKey
+	rotateOpts.PreviousEncryptionKeys = [][]byte{opts.EncryptionKey}
+	db, err = Open(rotateOpts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(1000), []byte("customer-pii")))
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	newOpts := opts
+	newOpts.EncryptionKey = newKey
+	db, err = Open(newOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1001, len(db.ListKeys()))
+	value, err := db.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("customer-pii"), value)
+	cf, err = db.ColumnFamily("users")
+	assert.Nil(t, err)
+	value, err = cf.Get([]byte("user"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("customer-pii"), value)
+	assert.Nil(t, db.Close())
+
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrWrongEncryptionKey, err)
+}
+
+func TestDB_Encryption_Blob(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption-blob")
+	opts.DirPath = dir
+	opts.DataFileMergeRatio = 0
+	opts.BlobValueThreshold = 100
+	opts.EncryptionKey = bytes.Repeat([]byte("k"), 32)
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	value := bytes.Repeat([]byte("customer-pii"), 100)
+	streamValue := bytes.Repeat([]byte("customer-pii"), 10000)
+	assert.Nil(t, db.Put(utils.GetTestKey(1), value))
+	assert.Nil(t, db.PutStream(utils.GetTestKey(2), bytes.NewReader(streamValue), int64(len(streamValue))))
+	assert.Nil(t, db.Close())
+
+	//更换密钥，merge之后blob文件中的value也使用新的密钥重新加密
+	newKey := bytes.Repeat([]byte("n"), 16)
+	rotateOpts := opts
+	rotateOpts.EncryptionKey = newKey
+	rotateOpts.PreviousEncryptionKeys = [][]byte{opts.EncryptionKey}
+	db, err = Open(rotateOpts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	newOpts := opts
+	newOpts.EncryptionKey = newKey
+	db, err = Open(newOpts)
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+	val, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, streamValue, val)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_Encryption_BPlusTree(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption-bptree")
+	defer os.RemoveAll(dir)
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	opts.EncryptionKey = bytes.Repeat([]byte("k"), 32)
+	//B+树索引文件是明文存储的，不能和加密一起使用
+	db, err := Open(opts)
+	assert.NotNil(t, err)
+	assert.Nil(t, db)
+}
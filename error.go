@@ -13,4 +13,21 @@ var (
 	ErrDatabaseIsUsing        = errors.New("the database directory is used by another process")
 	ErrMergeRationUnreached   = errors.New("the merge ration do not reach the option")
 	ErrNoEnoughSpaceForMerge  = errors.New("no enough disk space for merge")
+	ErrTxnConflict            = errors.New("transaction conflict,the key has been modified by another transaction")
+	ErrTxnFinished            = errors.New("the transaction has been committed or rolled back")
+	ErrSnapshotReleased       = errors.New("the snapshot has been released")
+	ErrInvalidTTL             = errors.New("the ttl must be greater than 0")
+	ErrColumnFamilyNameEmpty  = errors.New("the column family name is empty")
+	ErrColumnFamilyExists     = errors.New("the column family already exists")
+	ErrColumnFamilyNotFound   = errors.New("column family not found")
+	ErrInvalidKeyRange        = errors.New("the end key must be greater than the start key")
+	ErrMergeOperatorNotSet    = errors.New("the merge operator is not set in options")
+	ErrChangesUnavailable     = errors.New("the change position is no longer available,the data files have been merged")
+	ErrInvalidChangePosition  = errors.New("the change position is beyond the end of the data files")
+	ErrRepairDirNotEmpty      = errors.New("the repair directory is not empty")
+	ErrRestoreDirNotEmpty     = errors.New("the restore directory is not empty")
+	ErrBackupChecksumMismatch = errors.New("the backup file size or checksum mismatch")
+	ErrCheckpointDirNotEmpty  = errors.New("the checkpoint directory is not empty")
+	ErrInvalidValueSize       = errors.New("the value size is negative or too large")
+	ErrBlobRecordMismatch     = errors.New("the blob record does not belong to the key")
 )
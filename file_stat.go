@@ -0,0 +1,158 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/index"
+	"bytes"
+	"sort"
+)
+
+// FileStat 单个数据文件的统计信息
+// B+树索引不会在启动时重放数据文件，重启之前的数据不会计入统计
+type FileStat struct {
+	Fid             uint32 //数据文件id
+	Size            int64  //数据文件大小
+	ReclaimableSize int64  //文件中可以回收的数据量，字节为单位
+	LiveKeys        int    //索引中指向这个文件的key数量
+}
+
+// 数据文件的统计信息
+type fileStat struct {
+	reclaimableSize int64
+	liveKeys        int
+}
+
+// 获取数据文件的统计信息，不存在则新建
+// 在访问此方法前必须得有互斥锁
+func (db *DB) fileStat(fid uint32) *fileStat {
+	stat := db.fileStats[fid]
+	if stat == nil {
+		stat = &fileStat{}
+		db.fileStats[fid] = stat
+	}
+	return stat
+}
+
+// 索引中新增了指向pos的key
+// 在访问此方法前必须得有互斥锁
+func (db *DB) markLive(pos *data.LogRecordPos) {
+	db.fileStat(pos.Fid).liveKeys++
+}
+
+// 索引中指向pos的key失效了，对应的记录可以被回收
+// pos是合并操作数的链表时沿着Prev把每条记录的大小记到各自的文件中
+// B+树索引中的位置不保存Prev，只能读取链表
+// 在访问此方法前必须得有互斥锁
+func (db *DB) markStale(pos *data.LogRecordPos) {
+	if pos.Prev != nil {
+		chain := []*data.LogRecordPos{pos}
+		for prev := pos.Prev; prev != nil; prev = prev.Prev {
+			chain = append(chain, prev)
+		}
+		db.markChainStale(chain)
+		return
+	}
+	if db.options.MergeOperator != nil && db.options.IndexType == BPlusTree {
+		if chain, err := db.mergeOperandChain(pos); err == nil && len(chain) > 1 {
+			db.markChainStale(chain)
+			return
+		}
+	}
+	stat := db.fileStat(pos.Fid)
+	stat.liveKeys--
+	stat.reclaimableSize += int64(pos.Size)
+	db.reclaimSize += int64(pos.Size)
+	db.markBlobStale(pos)
+}
+
+// 写入的记录本身就是无效的，例如删除的标记
+// 在访问此方法前必须得有互斥锁
+func (db *DB) markGarbage(pos *data.LogRecordPos) {
+	db.fileStat(pos.Fid).reclaimableSize += int64(pos.Size)
+	db.reclaimSize += int64(pos.Size)
+}
+
+// 索引中指向pos的key被替换，但是对应的记录仍然被引用，例如合并操作数的链表
+// 在访问此方法前必须得有互斥锁
+func (db *DB) markReferenced(pos *data.LogRecordPos) {
+	db.fileStat(pos.Fid).liveKeys--
+}
+
+// 从索引中删除[start,end)范围内的所有key，返回被删除的key
+// 在访问此方法前必须得有互斥锁
+func (db *DB) deleteIndexRange(indexer index.Indexer, start []byte, end []byte) [][]byte {
+	//先找出所有需要删除的key，遍历结束之后再删除
+	var keys [][]byte
+	iterator := indexer.Iterator(false)
+	for iterator.Seek(start); iterator.Valid(); iterator.Next() {
+		if len(end) > 0 && bytes.Compare(iterator.Key(), end) >= 0 {
+			break
+		}
+		keys = append(keys, iterator.Key())
+	}
+	iterator.Close()
+	for _, key := range keys {
+		if oldPos, _ := indexer.Delete(key); oldPos != nil {
+			db.markStale(oldPos)
+		}
+	}
+	return keys
+}
+
+// 删除数据文件的统计信息，并重新计算总的可回收数据量
+// 在访问此方法前必须得有互斥锁
+func (db *DB) removeFileStats(fids []uint32) {
+	for _, fid := range fids {
+		delete(db.fileStats, fid)
+	}
+	db.reclaimSize = 0
+	for _, stat := range db.fileStats {
+		db.reclaimSize += stat.reclaimableSize
+	}
+}
+
+// 所有数据文件的统计信息，按照文件id排序
+// 在访问此方法前必须得有互斥锁
+func (db *DB) getFileStats() []FileStat {
+	var stats []FileStat
+	addStat := func(dataFile *data.DataFile) {
+		fileStat := FileStat{Fid: dataFile.FileId}
+		if size, err := dataFile.IoManager.Size(); err == nil {
+			fileStat.Size = size
+		}
+		if stat := db.fileStats[dataFile.FileId]; stat != nil {
+			fileStat.ReclaimableSize = stat.reclaimableSize
+			fileStat.LiveKeys = stat.liveKeys
+		}
+		stats = append(stats, fileStat)
+	}
+	for _, dataFile := range db.olderFiles {
+		addStat(dataFile)
+	}
+	if db.activeFile != nil {
+		addStat(db.activeFile)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Fid < stats[j].Fid
+	})
+	return stats
+}
+
+// 合并操作数的链表不再被引用，链表中的每条记录都可以被回收
+// 链表中记录的Size是到链表末尾的累计大小，每条记录自身的大小为和下一条记录的差值
+// 在访问此方法前必须得有互斥锁
+func (db *DB) markChainStale(chain []*data.LogRecordPos) {
+	for i, pos := range chain {
+		size := int64(pos.Size)
+		if i+1 < len(chain) {
+			size -= int64(chain[i+1].Size)
+		}
+		stat := db.fileStat(pos.Fid)
+		if i == 0 {
+			stat.liveKeys--
+		}
+		stat.reclaimableSize += size
+		db.reclaimSize += size
+		db.markBlobStale(pos)
+	}
+}
@@ -0,0 +1,117 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_FileStats(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-file-stats")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 200; i < 300; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, wb.Commit())
+
+	stat := db.Stat()
+	assert.Equal(t, int(stat.DataFileNum), len(stat.FileStats))
+	var liveKeys int
+	var reclaimableSize int64
+	for _, fileStat := range stat.FileStats {
+		assert.LessOrEqual(t, fileStat.ReclaimableSize, fileStat.Size)
+		liveKeys += fileStat.LiveKeys
+		reclaimableSize += fileStat.ReclaimableSize
+	}
+	assert.Equal(t, int(stat.KeyNum), liveKeys)
+	assert.Equal(t, stat.ReclaimableSize, reclaimableSize)
+	//第一个文件中的数据大部分都被删除或者覆盖了
+	assert.Equal(t, 0, stat.FileStats[0].LiveKeys)
+
+	//重启之后重新统计的结果一致
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer db2.Close()
+	assert.Equal(t, stat.FileStats, db2.Stat().FileStats)
+	assert.Equal(t, stat.ReclaimableSize, db2.Stat().ReclaimableSize)
+}
+
+func TestDB_FileStats_MergeOperandChain(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-file-stats-chain")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.MergeOperator = counterMergeOperator{}
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	//链表的第一条记录在第一个文件中，之后的操作数在其他文件中
+	assert.Nil(t, db.Put([]byte("counter"), []byte("1")))
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.MergeValue([]byte("counter"), []byte("1")))
+	}
+	before := db.Stat().FileStats
+	assert.Greater(t, len(before), 1)
+	//链表保存在内存索引中，标记失效时不需要读取数据文件
+	chain, err := db.mergeOperandChain(db.defaultFamily.index.Get([]byte("counter")))
+	assert.Nil(t, err)
+	assert.Equal(t, 11, operandChainLen(db.defaultFamily.index.Get([]byte("counter"))))
+	assert.Equal(t, len(chain), operandChainLen(db.defaultFamily.index.Get([]byte("counter"))))
+	assert.Nil(t, db.Put([]byte("counter"), []byte("0")))
+
+	//链表中每条记录的大小记到各自所在的文件中
+	after := db.Stat().FileStats
+	firstRecordSize := after[0].ReclaimableSize - before[0].ReclaimableSize
+	assert.Greater(t, firstRecordSize, int64(0))
+	assert.Less(t, firstRecordSize, int64(64))
+	var reclaimableSize int64
+	for i := 1; i < len(before); i++ {
+		reclaimableSize += after[i].ReclaimableSize - before[i].ReclaimableSize
+	}
+	assert.Greater(t, reclaimableSize, int64(0))
+	for _, fileStat := range after {
+		assert.LessOrEqual(t, fileStat.ReclaimableSize, fileStat.Size)
+	}
+
+	//重启之后重新统计的结果一致
+	stat := db.Stat()
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer db2.Close()
+	assert.Equal(t, stat.FileStats, db2.Stat().FileStats)
+}
+
+// 沿着Prev计算合并操作数的链表长度
+func operandChainLen(pos *data.LogRecordPos) int {
+	var n int
+	for ; pos != nil; pos = pos.Prev {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,537 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FsckProblemType 检查数据目录时发现的问题类型
+type FsckProblemType = string
+
+const (
+	// FsckCorruptedRecord 记录的校验值不正确
+	FsckCorruptedRecord FsckProblemType = "corrupted-record"
+	// FsckIncompleteRecord 文件末尾的记录不完整
+	FsckIncompleteRecord FsckProblemType = "incomplete-record"
+	// FsckInvalidHint hint文件中的位置没有指向有效的记录
+	FsckInvalidHint FsckProblemType = "invalid-hint"
+	// FsckInvalidFile seq-no、merge-finished等文件的内容无效
+	FsckInvalidFile FsckProblemType = "invalid-file"
+	// FsckOrphanMergeDir 残留的merge目录，下次打开时会被应用或者删除
+	FsckOrphanMergeDir FsckProblemType = "orphan-merge-dir"
+	// FsckIncompleteTxn 没有事务完成标记的事务，打开时会被丢弃
+	FsckIncompleteTxn FsckProblemType = "incomplete-transaction"
+	// FsckUnverifiableRecord 加密的记录没有配置密钥或者密钥不正确，只校验了crc
+	FsckUnverifiableRecord FsckProblemType = "unverifiable-record"
+)
+
+// FsckFile 检查过的文件
+type FsckFile struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	Records int    `json:"records"` //文件中有效的记录数量
+	//无法解密的记录数量，这些记录也计入Records
+	Unverifiable int `json:"unverifiable,omitempty"`
+}
+
+// FsckProblem 检查数据目录时发现的问题
+type FsckProblem struct {
+	Type    FsckProblemType `json:"type"`
+	File    string          `json:"file"`
+	Offset  int64           `json:"offset"`
+	Message string          `json:"message"`
+}
+
+// FsckReport 数据目录的检查结果
+type FsckReport struct {
+	DirPath  string        `json:"dir_path"`
+	Healthy  bool          `json:"healthy"`
+	Files    []FsckFile    `json:"files"`
+	Problems []FsckProblem `json:"problems"`
+	Repaired string        `json:"repaired,omitempty"` //修复之后的数据目录
+}
+
+// 检查数据目录使用的上下文
+type fsck struct {
+	dirPath  string
+	cipher   *data.Cipher
+	report   *FsckReport
+	dataFids []uint32
+	//数据文件中有效记录的位置和大小
+	records map[uint32]map[int64]int64
+	//检查hint时打开的数据文件
+	files map[uint32]*data.DataFile
+}
+
+// Fsck 离线检查数据目录，校验所有的数据文件、hint文件、merge-finished和seq-no文件
+// 检查期间数据目录不能被打开，加密的数据目录需要在opts中配置密钥
+func Fsck(dirPath string, opts FsckOptions) (*FsckReport, error) {
+	f, err := runFsck(dirPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	return f.report, nil
+}
+
+// FsckRepair 检查数据目录，并将数据文件中有效的记录复制到新的数据目录destPath中，重新生成hint文件
+// 原来的数据目录不会被修改，destPath必须不存在或者为空
+// B+树索引不会从数据文件中重建，修复之后只能使用内存索引打开
+// 加密的数据目录必须配置密钥，修复之后的记录使用opts中的EncryptionKey加密
+func FsckRepair(dirPath string, destPath string, opts FsckOptions) (*FsckReport, error) {
+	if entries, err := os.ReadDir(destPath); err == nil && len(entries) > 0 {
+		return nil, ErrRepairDirNotEmpty
+	}
+	f, err := runFsck(dirPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	//无法解密的记录不能复制，否则修复之后会丢失这些数据
+	for _, problem := range f.report.Problems {
+		if problem.Type == FsckUnverifiableRecord {
+			return nil, data.ErrWrongEncryptionKey
+		}
+	}
+	if err := os.MkdirAll(destPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := f.salvage(destPath); err != nil {
+		return nil, err
+	}
+	f.report.Repaired = destPath
+	return f.report, nil
+}
+
+func runFsck(dirPath string, opts FsckOptions) (*fsck, error) {
+	if _, err := os.Stat(dirPath); err != nil {
+		return nil, err
+	}
+	var cipher *data.Cipher
+	if len(opts.EncryptionKey) > 0 || len(opts.PreviousEncryptionKeys) > 0 {
+		var err error
+		if cipher, err = data.NewCipher(opts.EncryptionKey, opts.PreviousEncryptionKeys); err != nil {
+			return nil, err
+		}
+	}
+	f := &fsck{
+		dirPath: dirPath,
+		cipher:  cipher,
+		report:  &FsckReport{DirPath: dirPath, Files: []FsckFile{}, Problems: []FsckProblem{}},
+		records: make(map[uint32]map[int64]int64),
+		files:   make(map[uint32]*data.DataFile),
+	}
+	defer func() {
+		for _, dataFile := range f.files {
+			_ = dataFile.Close()
+		}
+	}()
+	if err := f.run(); err != nil {
+		return nil, err
+	}
+	f.report.Healthy = len(f.report.Problems) == 0
+	return f, nil
+}
+
+func (f *fsck) run() error {
+	if err := f.checkDataFiles(); err != nil {
+		return err
+	}
+	if err := f.checkDataHintFiles(); err != nil {
+		return err
+	}
+	if err := f.checkMergeFiles(); err != nil {
+		return err
+	}
+	if err := f.checkSeqNoFile(); err != nil {
+		return err
+	}
+	return f.checkColumnFamilyFile()
+}
+
+func (f *fsck) addProblem(typ FsckProblemType, file string, offset int64, message string) {
+	f.report.Problems = append(f.report.Problems, FsckProblem{Type: typ, File: file, Offset: offset, Message: message})
+}
+
+// 依次读取文件中的记录，遇到无效的记录时停止，返回有效的记录数量
+// 无法解密的记录跳过，不调用fn
+func (f *fsck) walkFile(fileName string, fn func(logRecord *data.LogRecord, offset int64, size int64) error) (int, error) {
+	fileInfo, err := os.Stat(filepath.Join(f.dirPath, fileName))
+	if err != nil {
+		return 0, err
+	}
+	dataFile, err := openFsckFile(f.dirPath, fileName, f.cipher)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = dataFile.Close()
+	}()
+	var count, unverifiable int
+	var offset, unverifiableOffset int64 = 0, 0
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err == data.ErrWrongEncryptionKey {
+			if unverifiable == 0 {
+				unverifiableOffset = offset
+			}
+			unverifiable++
+			count++
+			offset += size
+			continue
+		}
+		if err != nil {
+			switch err {
+			case io.EOF:
+			case io.ErrUnexpectedEOF:
+				f.addProblem(FsckIncompleteRecord, fileName, offset, "incomplete record at the end of the file")
+			case data.ErrInvalidCRC, data.ErrInvalidCompressedValue:
+				f.addProblem(FsckCorruptedRecord, fileName, offset, err.Error())
+			default:
+				return count, err
+			}
+			break
+		}
+		if err := fn(logRecord, offset, size); err != nil {
+			return count, err
+		}
+		count++
+		offset += size
+	}
+	if unverifiable > 0 {
+		f.addProblem(FsckUnverifiableRecord, fileName, unverifiableOffset,
+			strconv.Itoa(unverifiable)+" encrypted records can not be decrypted, the encryption key is wrong or not set")
+	}
+	f.report.Files = append(f.report.Files, FsckFile{Name: fileName, Size: fileInfo.Size(), Records: count, Unverifiable: unverifiable})
+	return count, nil
+}
+
+// 检查所有的数据文件，以及没有完成的事务
+func (f *fsck) checkDataFiles() error {
+	entries, err := os.ReadDir(f.dirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			continue
+		}
+		fid, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), data.DataFileNameSuffix))
+		if err != nil {
+			return ErrDataDirectoryCorrupted
+		}
+		f.dataFids = append(f.dataFids, uint32(fid))
+	}
+	sort.Slice(f.dataFids, func(i, j int) bool {
+		return f.dataFids[i] < f.dataFids[j]
+	})
+	//事务的记录可能跨越多个数据文件
+	txnStart := make(map[uint64]string)
+	txnOffset := make(map[uint64]int64)
+	for _, fid := range f.dataFids {
+		fileName := filepath.Base(data.GetDataFileName(f.dirPath, fid))
+		records := make(map[int64]int64)
+		f.records[fid] = records
+		_, err := f.walkFile(fileName, func(logRecord *data.LogRecord, offset int64, size int64) error {
+			records[offset] = size
+			_, seqNo := parseLogRecordKey(logRecord.Key)
+			if seqNo == nonTransactionSeqNo {
+				return nil
+			}
+			if logRecord.Type == data.LogRecordTxnFinished {
+				delete(txnStart, seqNo)
+				delete(txnOffset, seqNo)
+			} else if _, ok := txnStart[seqNo]; !ok {
+				txnStart[seqNo], txnOffset[seqNo] = fileName, offset
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	seqNos := make([]uint64, 0, len(txnStart))
+	for seqNo := range txnStart {
+		seqNos = append(seqNos, seqNo)
+	}
+	sort.Slice(seqNos, func(i, j int) bool {
+		return seqNos[i] < seqNos[j]
+	})
+	for _, seqNo := range seqNos {
+		f.addProblem(FsckIncompleteTxn, txnStart[seqNo], txnOffset[seqNo],
+			"transaction "+strconv.FormatUint(seqNo, 10)+" has no finished record")
+	}
+	return nil
+}
+
+// 检查数据文件对应的hint文件中的位置是否指向有效的记录
+func (f *fsck) checkDataHintFiles() error {
+	entries, err := os.ReadDir(f.dirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fileName := entry.Name()
+		if !strings.HasSuffix(fileName, data.DataHintFileSuffix) {
+			continue
+		}
+		fid, err := strconv.Atoi(strings.TrimSuffix(fileName, data.DataHintFileSuffix))
+		if err != nil {
+			f.addProblem(FsckInvalidFile, fileName, 0, "invalid hint file name")
+			continue
+		}
+		_, err = f.walkFile(fileName, func(hintRecord *data.LogRecord, offset int64, size int64) error {
+			logRecord, pos := data.DecodeDataHintRecord(hintRecord)
+			if pos.Fid != uint32(fid) {
+				f.addProblem(FsckInvalidHint, fileName, offset, "hint entry points at another data file")
+				return nil
+			}
+			return f.checkHintPos(fileName, offset, logRecord.Key, pos)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 检查hint中的位置是否指向数据文件中key相同的有效记录
+func (f *fsck) checkHintPos(fileName string, offset int64, key []byte, pos *data.LogRecordPos) error {
+	message := "hint entry does not point at a valid record"
+	recordSize, ok := f.records[pos.Fid][pos.Offset]
+	if !ok {
+		f.addProblem(FsckInvalidHint, fileName, offset, message)
+		return nil
+	}
+	logRecord, err := f.readRecord(pos)
+	if err != nil {
+		return err
+	}
+	//数据文件的hint记录中的key包含事务序列号，merge生成的Hint文件中不包含
+	recordKey := logRecord.Key
+	if fileName == data.HintFileName {
+		recordKey, _ = parseLogRecordKey(recordKey)
+	} else if recordSize != int64(pos.Size) {
+		f.addProblem(FsckInvalidHint, fileName, offset, message)
+		return nil
+	}
+	if !bytes.Equal(recordKey, key) {
+		f.addProblem(FsckInvalidHint, fileName, offset, message)
+	}
+	return nil
+}
+
+func (f *fsck) readRecord(pos *data.LogRecordPos) (*data.LogRecord, error) {
+	dataFile := f.files[pos.Fid]
+	if dataFile == nil {
+		var err error
+		if dataFile, err = data.OpenDataFile(f.dirPath, pos.Fid, fio.StandardFIO); err != nil {
+			return nil, err
+		}
+		dataFile.Cipher = f.cipher
+		f.files[pos.Fid] = dataFile
+	}
+	logRecord, _, err := dataFile.ReadLogRecord(pos.Offset)
+	return logRecord, err
+}
+
+// 检查merge生成的Hint文件、merge-finished文件以及残留的merge目录
+func (f *fsck) checkMergeFiles() error {
+	dir := path.Dir(path.Clean(f.dirPath))
+	mergePath := filepath.Join(dir, path.Base(f.dirPath)+mergeDirName)
+	if _, err := os.Stat(mergePath); err == nil {
+		message := "merge directory was not applied and will be removed on open"
+		if _, err := os.Stat(filepath.Join(mergePath, data.MergeFinishedFileName)); err == nil {
+			message = "finished merge directory will be applied on open"
+		}
+		f.addProblem(FsckOrphanMergeDir, mergePath, 0, message)
+	}
+
+	var info *mergeInfo
+	if _, err := os.Stat(filepath.Join(f.dirPath, data.MergeFinishedFileName)); err == nil {
+		count, err := f.walkFile(data.MergeFinishedFileName, func(logRecord *data.LogRecord, offset int64, size int64) error {
+			mergeInfo, err := decodeMergeInfo(logRecord.Value)
+			if err != nil || string(logRecord.Key) != mergeFinishedKey {
+				f.addProblem(FsckInvalidFile, data.MergeFinishedFileName, offset, "invalid merge finished record")
+				return nil
+			}
+			info = mergeInfo
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		//有记录时已经报告了无效或者无法解密的记录
+		if info == nil && count == 0 {
+			f.addProblem(FsckInvalidFile, data.MergeFinishedFileName, 0, "merge finished record not found")
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(f.dirPath, data.HintFileName)); err != nil {
+		return nil
+	}
+	_, err := f.walkFile(data.HintFileName, func(logRecord *data.LogRecord, offset int64, size int64) error {
+		if logRecord.Type != data.LogRecordNormal {
+			return nil
+		}
+		pos := info.hintPos(data.DecodeLogRecordPos(logRecord.Value))
+		return f.checkHintPos(data.HintFileName, offset, logRecord.Key, pos)
+	})
+	return err
+}
+
+// 检查保存事务序列号的文件
+func (f *fsck) checkSeqNoFile() error {
+	if _, err := os.Stat(filepath.Join(f.dirPath, data.SeqNoFileName)); err != nil {
+		return nil
+	}
+	_, err := f.walkFile(data.SeqNoFileName, func(logRecord *data.LogRecord, offset int64, size int64) error {
+		if _, err := strconv.ParseUint(string(logRecord.Value), 10, 64); err != nil || string(logRecord.Key) != seqNoKey {
+			f.addProblem(FsckInvalidFile, data.SeqNoFileName, offset, "invalid seq no record")
+		}
+		return nil
+	})
+	return err
+}
+
+// 检查保存列族信息的文件
+func (f *fsck) checkColumnFamilyFile() error {
+	if _, err := os.Stat(filepath.Join(f.dirPath, data.ColumnFamilyFileName)); err != nil {
+		return nil
+	}
+	_, err := f.walkFile(data.ColumnFamilyFileName, func(logRecord *data.LogRecord, offset int64, size int64) error {
+		return nil
+	})
+	return err
+}
+
+// 将数据文件中有效的记录复制到新的数据目录中，并重新生成数据文件的hint文件
+// 新的数据目录不使用merge生成的Hint文件，打开时重新读取所有的数据文件
+func (f *fsck) salvage(destPath string) error {
+	for i, fid := range f.dataFids {
+		srcFile, err := data.OpenDataFile(f.dirPath, fid, fio.StandardFIO)
+		if err != nil {
+			return err
+		}
+		destFile, err := data.OpenDataFile(destPath, fid, fio.StandardFIO)
+		if err != nil {
+			_ = srcFile.Close()
+			return err
+		}
+		srcFile.Cipher, destFile.Cipher = f.cipher, f.cipher
+		var hintFile *data.DataFile
+		if i < len(f.dataFids)-1 {
+			if hintFile, err = data.OpenDataHintFile(destPath, fid); err != nil {
+				_ = srcFile.Close()
+				_ = destFile.Close()
+				return err
+			}
+			hintFile.Cipher = f.cipher
+		}
+		err = copyValidRecords(srcFile, destFile, hintFile)
+		_ = srcFile.Close()
+		if closeErr := destFile.Close(); err == nil {
+			err = closeErr
+		}
+		if hintFile != nil {
+			if closeErr := hintFile.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	//数据文件中的记录引用的blob文件直接复制
+	entries, err := os.ReadDir(f.dirPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), data.BlobFileSuffix) {
+			continue
+		}
+		if _, _, err := utils.CopyFile(filepath.Join(f.dirPath, entry.Name()), filepath.Join(destPath, entry.Name())); err != nil {
+			return err
+		}
+	}
+	//列族信息、事务序列号、merge的信息、变更起点和blob文件id中有效的记录也需要保留
+	//merge生成的数据文件id比之后写入的数据文件大，需要从Hint文件中加载索引
+	for _, fileName := range []string{data.ColumnFamilyFileName, data.SeqNoFileName, data.MergeFinishedFileName, data.ChangesHorizonFileName, data.BlobFileIdFileName, data.HintFileName} {
+		if _, err := os.Stat(filepath.Join(f.dirPath, fileName)); err != nil {
+			continue
+		}
+		srcFile, err := openFsckFile(f.dirPath, fileName, f.cipher)
+		if err != nil {
+			return err
+		}
+		destFile, err := openFsckFile(destPath, fileName, f.cipher)
+		if err != nil {
+			_ = srcFile.Close()
+			return err
+		}
+		err = copyValidRecords(srcFile, destFile, nil)
+		_ = srcFile.Close()
+		if closeErr := destFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 复制文件中第一条无效记录之前的所有记录，hintFile不为空时同时写入对应的hint记录
+func copyValidRecords(srcFile *data.DataFile, destFile *data.DataFile, hintFile *data.DataFile) error {
+	var offset int64 = 0
+	for {
+		logRecord, size, err := srcFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF ||
+				err == data.ErrInvalidCRC || err == data.ErrInvalidCompressedValue {
+				break
+			}
+			return err
+		}
+		//重新编码之后的压缩数据长度可能变化，加密也会增加记录的长度，hint记录使用写入之后的位置和大小
+		destOffset := destFile.WriteOff
+		encRecord, _ := data.EncodeLogRecord(logRecord)
+		if err := destFile.Write(encRecord); err != nil {
+			return err
+		}
+		if hintFile != nil {
+			pos := &data.LogRecordPos{Fid: srcFile.FileId, Offset: destOffset, Size: uint32(destFile.WriteOff - destOffset), Expire: logRecord.Expire}
+			if logRecord.Blob {
+				pos.Blob = data.DecodeLogRecordPos(logRecord.Value)
+			}
+			encHint, _ := data.EncodeLogRecord(data.EncodeDataHintRecord(logRecord, pos))
+			if err := hintFile.Write(encHint); err != nil {
+				return err
+			}
+		}
+		offset += size
+	}
+	if hintFile != nil {
+		if err := hintFile.Sync(); err != nil {
+			return err
+		}
+	}
+	return destFile.Sync()
+}
+
+// 按照数据文件的格式打开目录中的文件
+func openFsckFile(dirPath string, fileName string, cipher *data.Cipher) (*data.DataFile, error) {
+	ioManager, err := fio.NewIOManager(filepath.Join(dirPath, fileName), fio.StandardFIO)
+	if err != nil {
+		return nil, err
+	}
+	return &data.DataFile{IoManager: ioManager, Cipher: cipher}, nil
+}
@@ -0,0 +1,165 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFsck(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-fsck")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.Merge())
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 1000; i < 2000; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, wb.Commit())
+	err = db.Close()
+	assert.Nil(t, err)
+
+	report, err := Fsck(dir, DefaultFsckOptions)
+	assert.Nil(t, err)
+	assert.True(t, report.Healthy)
+	assert.Empty(t, report.Problems)
+	assert.NotEmpty(t, report.Files)
+
+	//损坏旧的数据文件，写入没有完成的事务，并残留merge目录
+	var activeFid uint32
+	for _, file := range report.Files {
+		var fid uint32
+		if n, _ := fmt.Sscanf(file.Name, "%09d.data", &fid); n == 1 && fid > activeFid {
+			activeFid = fid
+		}
+	}
+	corruptedFile := data.GetDataFileName(dir, activeFid-1)
+	buf, err := os.ReadFile(corruptedFile)
+	assert.Nil(t, err)
+	buf[len(buf)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(corruptedFile, buf, 0644))
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeq(utils.GetTestKey(1), 100),
+		Value: utils.RandomValue(64),
+	})
+	appendFile(t, data.GetDataFileName(dir, activeFid), encRecord)
+	mergePath := dir + mergeDirName
+	assert.Nil(t, os.MkdirAll(mergePath, os.ModePerm))
+	defer os.RemoveAll(mergePath)
+
+	report, err = Fsck(dir, DefaultFsckOptions)
+	assert.Nil(t, err)
+	assert.False(t, report.Healthy)
+	types := make(map[FsckProblemType]int)
+	for _, problem := range report.Problems {
+		types[problem.Type]++
+	}
+	assert.Equal(t, 1, types[FsckCorruptedRecord])
+	assert.Equal(t, 1, types[FsckIncompleteTxn])
+	assert.Equal(t, 1, types[FsckOrphanMergeDir])
+	//损坏位置之后的记录不再有效，hint中指向它们的位置也无效
+	assert.Greater(t, types[FsckInvalidHint], 0)
+
+	//修复到新的目录，损坏位置之前的数据仍然可以读取
+	repairPath, _ := os.MkdirTemp("", "bitcask-go-fsck-repair")
+	defer os.RemoveAll(repairPath)
+	report, err = FsckRepair(dir, repairPath, DefaultFsckOptions)
+	assert.Nil(t, err)
+	assert.Equal(t, repairPath, report.Repaired)
+	_, err = FsckRepair(dir, repairPath, DefaultFsckOptions)
+	assert.Equal(t, ErrRepairDirNotEmpty, err)
+
+	repaired, err := Fsck(repairPath, DefaultFsckOptions)
+	assert.Nil(t, err)
+	for _, problem := range repaired.Problems {
+		assert.Equal(t, FsckIncompleteTxn, problem.Type)
+	}
+	opts.DirPath = repairPath
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	keys := len(db2.ListKeys())
+	assert.Greater(t, keys, 1000)
+	assert.Less(t, keys, 2000)
+	for i := 0; i < 1000; i++ {
+		_, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db2.Close())
+}
+
+func TestFsck_Encryption(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-fsck-encryption")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.EncryptionKey = bytes.Repeat([]byte("k"), 32)
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.Merge())
+	for i := 1000; i < 2000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, db.Close())
+
+	//没有配置密钥时加密的记录无法校验，仍然输出检查结果
+	report, err := Fsck(dir, DefaultFsckOptions)
+	assert.Nil(t, err)
+	assert.False(t, report.Healthy)
+	assert.NotEmpty(t, report.Problems)
+	for _, problem := range report.Problems {
+		assert.Equal(t, FsckUnverifiableRecord, problem.Type)
+	}
+	repairPath, _ := os.MkdirTemp("", "bitcask-go-fsck-encryption-repair")
+	defer os.RemoveAll(repairPath)
+	_, err = FsckRepair(dir, repairPath, DefaultFsckOptions)
+	assert.Equal(t, data.ErrWrongEncryptionKey, err)
+
+	fsckOpts := FsckOptions{EncryptionKey: opts.EncryptionKey}
+	report, err = Fsck(dir, fsckOpts)
+	assert.Nil(t, err)
+	assert.True(t, report.Healthy)
+	assert.Empty(t, report.Problems)
+
+	//修复之后的数据文件仍然是加密的
+	report, err = FsckRepair(dir, repairPath, fsckOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, repairPath, report.Repaired)
+	repaired, err := Fsck(repairPath, fsckOpts)
+	assert.Nil(t, err)
+	assert.True(t, repaired.Healthy)
+	repaired, err = Fsck(repairPath, DefaultFsckOptions)
+	assert.Nil(t, err)
+	assert.False(t, repaired.Healthy)
+
+	opts.DirPath = repairPath
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 2000, len(db2.ListKeys()))
+	for i := 0; i < 2000; i++ {
+		_, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db2.Close())
+}
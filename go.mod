@@ -2,19 +2,20 @@ module bitcask-go
 
 go 1.23.0
 
-require github.com/google/btree v1.1.3
+require (
+	github.com/gofrs/flock v0.12.1
+	github.com/google/btree v1.1.3
+	github.com/stretchr/testify v1.9.0
+	github.com/tidwall/redcon v1.6.2
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/exp v0.0.0-20240909161429-701f63a606c0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/gofrs/flock v0.12.1 // indirect
-	github.com/plar/go-adaptive-radix-tree v1.0.5 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.9.0 // indirect
 	github.com/tidwall/btree v1.1.0 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
-	github.com/tidwall/redcon v1.6.2 // indirect
-	go.etcd.io/bbolt v1.3.11 // indirect
-	golang.org/x/exp v0.0.0-20240909161429-701f63a606c0 // indirect
 	golang.org/x/sys v0.22.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
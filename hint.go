@@ -0,0 +1,93 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"io"
+	"os"
+)
+
+// 记录活跃文件中新写入的记录，活跃文件写满之后写入对应的hint文件
+// 在访问此方法前必须得有互斥锁
+func (db *DB) appendActiveHint(logRecord *data.LogRecord, pos *data.LogRecordPos) {
+	if !db.activeHintsValid {
+		return
+	}
+	encRecord, _ := data.EncodeLogRecord(data.EncodeDataHintRecord(logRecord, pos))
+	db.activeHints = append(db.activeHints, encRecord...)
+}
+
+// 将活跃文件的hint写入对应的hint文件，启动时不需要再读取整个数据文件
+// 在访问此方法前必须得有互斥锁
+func (db *DB) writeDataHintFile() error {
+	if !db.activeHintsValid || len(db.activeHints) == 0 {
+		return nil
+	}
+	fileName := data.GetDataHintFileName(db.options.DirPath, db.activeFile.FileId)
+	//删除之前残留的同名文件
+	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	hintFile, err := data.OpenDataHintFile(db.options.DirPath, db.activeFile.FileId)
+	if err != nil {
+		return err
+	}
+	hintFile.Cipher = db.cipher
+	err = hintFile.Write(db.activeHints)
+	if err == nil {
+		err = hintFile.Sync()
+	}
+	if closeErr := hintFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(fileName)
+	}
+	return err
+}
+
+// 读取数据文件对应的hint文件，返回文件中所有记录的key和位置信息
+// hint文件不存在、已经损坏或者和数据文件不一致时返回false，需要读取整个数据文件
+func (db *DB) readDataHintFile(dataFile *data.DataFile) ([]*data.LogRecord, []*data.LogRecordPos, bool) {
+	fileName := data.GetDataHintFileName(db.options.DirPath, dataFile.FileId)
+	if _, err := os.Stat(fileName); err != nil {
+		return nil, nil, false
+	}
+	dataFileSize, err := dataFile.IoManager.Size()
+	if err != nil {
+		return nil, nil, false
+	}
+	hintFile, err := data.OpenDataHintFile(db.options.DirPath, dataFile.FileId)
+	if err != nil {
+		return nil, nil, false
+	}
+	hintFile.Cipher = db.cipher
+	defer func() {
+		_ = hintFile.Close()
+	}()
+	var logRecords []*data.LogRecord
+	var positions []*data.LogRecordPos
+	var offset, dataOffset int64
+	for {
+		hintRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, false
+		}
+		logRecord, pos := data.DecodeDataHintRecord(hintRecord)
+		//位置信息需要和数据文件中的记录依次对应
+		if pos.Fid != dataFile.FileId || pos.Offset != dataOffset {
+			return nil, nil, false
+		}
+		logRecords = append(logRecords, logRecord)
+		positions = append(positions, pos)
+		dataOffset += int64(pos.Size)
+		offset += size
+	}
+	//hint文件需要覆盖整个数据文件
+	if dataOffset != dataFileSize {
+		return nil, nil, false
+	}
+	return logRecords, positions, true
+}
@@ -0,0 +1,90 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_DataHintFile(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-data-hint")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.MergeOperator = counterMergeOperator{}
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	counter := []byte("counter")
+	assert.Nil(t, db.MergeValue(counter, []byte("1")))
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.DeleteRange(utils.GetTestKey(900), utils.GetTestKey(1000)))
+	assert.Nil(t, db.MergeValue(counter, []byte("2")))
+	for i := 1000; i < 1500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+
+	//旧的数据文件都有对应的hint文件，活跃文件没有
+	for fid := range db.olderFiles {
+		_, err := os.Stat(data.GetDataHintFileName(dir, fid))
+		assert.Nil(t, err)
+	}
+	_, err = os.Stat(data.GetDataHintFileName(dir, db.activeFile.FileId))
+	assert.True(t, os.IsNotExist(err))
+	stat := db.Stat()
+	err = db.Close()
+	assert.Nil(t, err)
+
+	check := func(db *DB) {
+		assert.Equal(t, 1401, len(db.ListKeys()))
+		val, err := db.Get(counter)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("3"), val)
+		for i := 0; i < 100; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, utils.GetTestKey(i), val)
+		}
+		for i := 900; i < 1000; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+		assert.Equal(t, stat.FileStats, db.Stat().FileStats)
+	}
+
+	//损坏第一个数据文件中的value，从hint文件加载索引时不会读取value
+	dataFileName := data.GetDataFileName(dir, 0)
+	buf, err := os.ReadFile(dataFileName)
+	assert.Nil(t, err)
+	buf[len(buf)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(dataFileName, buf, 0644))
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	check(db2)
+	assert.Nil(t, db2.Close())
+	buf[len(buf)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(dataFileName, buf, 0644))
+
+	//hint文件损坏或者不存在时读取整个数据文件
+	hintFileName := data.GetDataHintFileName(dir, 1)
+	hintBuf, err := os.ReadFile(hintFileName)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(hintFileName, hintBuf[:len(hintBuf)/2], 0644))
+	assert.Nil(t, os.Remove(data.GetDataHintFileName(dir, 2)))
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	check(db3)
+	assert.Nil(t, db3.Close())
+}
@@ -5,21 +5,40 @@ import (
 	"bytes"
 	"sort"
 	"sync"
-
-	goart "github.com/plar/go-adaptive-radix-tree"
 )
 
-// AdaptiveRadixTree自适应搜索树索引
-// 主要封装了https://github.com/plar/go-adaptive-radix-tree的代码
+// 子节点数量不超过这个值时按顺序保存在数组中，超过之后按照字节直接索引
+const artSparseMaxChildren = 48
+
+// AdaptiveRadixTree自适应基数树索引
+// 节点使用写时复制，Clone的开销为O(1)，之后的修改只会复制从根节点到被修改节点的路径
 type AdaptiveRadixTree struct {
-	tree goart.Tree
+	root *artNode
+	size int
+	cow  *artCowContext
 	lock *sync.RWMutex
 }
 
+// 写时复制的上下文，节点只能被创建它的上下文原地修改，其他的树修改之前需要先复制节点
+type artCowContext struct {
+	_ byte //保证每个上下文的地址都不相同
+}
+
+// 基数树节点，key的公共前缀压缩保存在prefix中
+type artNode struct {
+	cow      *artCowContext
+	prefix   []byte         //压缩的公共前缀，不会被原地修改
+	leaf     *Item          //在当前节点结束的key
+	keys     []byte         //子节点较少时按照顺序保存子节点对应的字节
+	children []*artNode     //子节点较少时和keys一一对应
+	full     *[256]*artNode //子节点较多时按照字节直接索引
+	count    int            //使用full时子节点的数量
+}
+
 // NewART初始化自适应基数树索引
 func NewART() *AdaptiveRadixTree {
 	return &AdaptiveRadixTree{
-		tree: goart.New(),
+		cow:  new(artCowContext),
 		lock: new(sync.RWMutex),
 	}
 }
@@ -27,126 +46,499 @@ func NewART() *AdaptiveRadixTree {
 // Put 向对象中存储key对应的数据位置信息
 func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 	art.lock.Lock()
-	oldValue, _ := art.tree.Insert(key, pos)
-	art.lock.Unlock()
-	if oldValue == nil {
+	defer art.lock.Unlock()
+	root, oldItem := art.insert(art.root, key, &Item{key: key, pos: pos})
+	art.root = root
+	if oldItem == nil {
+		art.size++
 		return nil
 	}
-	return oldValue.(*data.LogRecordPos)
+	return oldItem.pos
 }
 
 // Get 根据key获取对应的索引信息
 func (art *AdaptiveRadixTree) Get(key []byte) *data.LogRecordPos {
 	art.lock.RLock()
 	defer art.lock.RUnlock()
-	value, found := art.tree.Search(key)
-	if !found {
-		return nil
+	n := art.root
+	for n != nil {
+		if !bytes.HasPrefix(key, n.prefix) {
+			return nil
+		}
+		key = key[len(n.prefix):]
+		if len(key) == 0 {
+			if n.leaf == nil {
+				return nil
+			}
+			return n.leaf.pos
+		}
+		n, key = n.child(key[0]), key[1:]
 	}
-	return value.(*data.LogRecordPos)
+	return nil
 }
 
 // Delete根据key删除对应的索引信息
 func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	art.lock.Lock()
-	oldValue, deleted := art.tree.Delete(key)
-	art.lock.Unlock()
-	if oldValue == nil {
+	defer art.lock.Unlock()
+	root, oldItem := art.delete(art.root, key)
+	if oldItem == nil {
 		return nil, false
 	}
-	return oldValue.(*data.LogRecordPos), deleted
+	art.root = root
+	art.size--
+	return oldItem.pos, true
 }
 
 // Size索引中的数据量
 func (art *AdaptiveRadixTree) Size() int {
 	art.lock.RLock()
-	size := art.tree.Size()
-	art.lock.RUnlock()
-	return size
+	defer art.lock.RUnlock()
+	return art.size
 }
 
-// Iterator索引迭代器
+// Iterator索引迭代器，遍历的是创建时刻的索引
 func (art *AdaptiveRadixTree) Iterator(reverse bool) Iterator {
-	art.lock.RLock()
-	defer art.lock.RUnlock()
-	return newARTIterator(art.tree, reverse)
+	art.lock.Lock()
+	defer art.lock.Unlock()
+	return newARTIterator(art.freeze(), reverse)
 }
 
-// Art索引迭代器
-type artIterator struct {
-	currIndex int     //当前遍历的下标位置
-	reverse   bool    //是否是反向遍历
-	values    []*Item //key+位置索引信息
+// Clone复制一份索引快照，使用写时复制，不会拷贝数据
+func (art *AdaptiveRadixTree) Clone() Indexer {
+	art.lock.Lock()
+	defer art.lock.Unlock()
+	return &AdaptiveRadixTree{
+		root: art.freeze(),
+		size: art.size,
+		cow:  new(artCowContext),
+		lock: new(sync.RWMutex),
+	}
+}
+
+// 返回当前的根节点，之后的修改都需要先复制节点，不会影响返回的树
+// 在访问此方法前必须得有索引的写锁
+func (art *AdaptiveRadixTree) freeze() *artNode {
+	art.cow = new(artCowContext)
+	return art.root
 }
 
-func newARTIterator(tree goart.Tree, reverse bool) *artIterator {
-	var idx int
-	if reverse {
-		idx = tree.Size() - 1
+// 返回可以原地修改的节点，节点不属于当前的树时复制一份
+func (art *AdaptiveRadixTree) mutable(n *artNode) *artNode {
+	if n.cow == art.cow {
+		return n
 	}
-	values := make([]*Item, tree.Size())
-	saveValues := func(node goart.Node) bool {
-		item := &Item{
-			key: node.Key(),
-			pos: node.Value().(*data.LogRecordPos),
-		}
-		values[idx] = item
-		if reverse {
-			idx--
+	c := &artNode{cow: art.cow, prefix: n.prefix, leaf: n.leaf, count: n.count}
+	if n.full != nil {
+		full := *n.full
+		c.full = &full
+	} else {
+		c.keys = append([]byte(nil), n.keys...)
+		c.children = append([]*artNode(nil), n.children...)
+	}
+	return c
+}
+
+// 在以n为根的子树中插入key，返回新的子树根节点和被替换掉的数据
+func (art *AdaptiveRadixTree) insert(n *artNode, key []byte, item *Item) (*artNode, *Item) {
+	if n == nil {
+		return &artNode{cow: art.cow, prefix: key, leaf: item}, nil
+	}
+	p := commonPrefixLen(n.prefix, key)
+	if p < len(n.prefix) {
+		//前缀不一致，拆分出一个新的父节点
+		parent := &artNode{cow: art.cow, prefix: n.prefix[:p]}
+		b, rest := n.prefix[p], n.prefix[p+1:]
+		child := art.mutable(n)
+		child.prefix = rest
+		parent.setChild(b, child)
+		if p == len(key) {
+			parent.leaf = item
 		} else {
-			idx++
+			parent.setChild(key[p], &artNode{cow: art.cow, prefix: key[p+1:], leaf: item})
+		}
+		return parent, nil
+	}
+	n = art.mutable(n)
+	key = key[p:]
+	if len(key) == 0 {
+		oldItem := n.leaf
+		n.leaf = item
+		return n, oldItem
+	}
+	child, oldItem := art.insert(n.child(key[0]), key[1:], item)
+	n.setChild(key[0], child)
+	return n, oldItem
+}
+
+// 在以n为根的子树中删除key，返回新的子树根节点和被删除的数据，key不存在时子树不变
+func (art *AdaptiveRadixTree) delete(n *artNode, key []byte) (*artNode, *Item) {
+	if n == nil || !bytes.HasPrefix(key, n.prefix) {
+		return n, nil
+	}
+	key = key[len(n.prefix):]
+	if len(key) == 0 {
+		if n.leaf == nil {
+			return n, nil
+		}
+		oldItem := n.leaf
+		n = art.mutable(n)
+		n.leaf = nil
+		return art.compact(n), oldItem
+	}
+	child, oldItem := art.delete(n.child(key[0]), key[1:])
+	if oldItem == nil {
+		return n, nil
+	}
+	n = art.mutable(n)
+	n.setChild(key[0], child)
+	return art.compact(n), oldItem
+}
+
+// 删除之后收缩节点，没有数据的节点被删除，只有一个子节点时和子节点合并
+func (art *AdaptiveRadixTree) compact(n *artNode) *artNode {
+	if n.leaf != nil {
+		return n
+	}
+	switch n.numChildren() {
+	case 0:
+		return nil
+	case 1:
+		b, child := n.firstChild()
+		prefix := make([]byte, 0, len(n.prefix)+1+len(child.prefix))
+		prefix = append(prefix, n.prefix...)
+		prefix = append(prefix, b)
+		prefix = append(prefix, child.prefix...)
+		child = art.mutable(child)
+		child.prefix = prefix
+		return child
+	}
+	return n
+}
+
+// 根据字节找到对应的子节点
+func (n *artNode) child(b byte) *artNode {
+	if n.full != nil {
+		return n.full[b]
+	}
+	if i := bytes.IndexByte(n.keys, b); i >= 0 {
+		return n.children[i]
+	}
+	return nil
+}
+
+// 设置字节对应的子节点，child为空表示删除子节点，只能修改可以原地修改的节点
+func (n *artNode) setChild(b byte, child *artNode) {
+	if n.full != nil {
+		if n.full[b] == nil && child != nil {
+			n.count++
+		} else if n.full[b] != nil && child == nil {
+			n.count--
+		}
+		n.full[b] = child
+		if n.count <= artSparseMaxChildren/2 {
+			n.shrink()
+		}
+		return
+	}
+	i := sort.Search(len(n.keys), func(i int) bool {
+		return n.keys[i] >= b
+	})
+	if i < len(n.keys) && n.keys[i] == b {
+		if child != nil {
+			n.children[i] = child
+			return
 		}
-		return true
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		n.children = append(n.children[:i], n.children[i+1:]...)
+		return
+	}
+	if child == nil {
+		return
 	}
+	if len(n.keys) == artSparseMaxChildren {
+		n.grow()
+		n.setChild(b, child)
+		return
+	}
+	n.keys = append(n.keys, 0)
+	copy(n.keys[i+1:], n.keys[i:])
+	n.keys[i] = b
+	n.children = append(n.children, nil)
+	copy(n.children[i+1:], n.children[i:])
+	n.children[i] = child
+}
 
-	tree.ForEach(saveValues)
+// 子节点的数量
+func (n *artNode) numChildren() int {
+	if n.full != nil {
+		return n.count
+	}
+	return len(n.keys)
+}
 
+// 字节最小的子节点
+func (n *artNode) firstChild() (byte, *artNode) {
+	if n.full == nil {
+		return n.keys[0], n.children[0]
+	}
+	for i, child := range n.full {
+		if child != nil {
+			return byte(i), child
+		}
+	}
+	return 0, nil
+}
+
+// 子节点变多之后改为按照字节直接索引
+func (n *artNode) grow() {
+	n.full = new([256]*artNode)
+	for i, b := range n.keys {
+		n.full[b] = n.children[i]
+	}
+	n.count = len(n.keys)
+	n.keys, n.children = nil, nil
+}
+
+// 子节点变少之后改为按顺序保存在数组中
+func (n *artNode) shrink() {
+	n.keys = make([]byte, 0, n.count)
+	n.children = make([]*artNode, 0, n.count)
+	for i, child := range n.full {
+		if child != nil {
+			n.keys = append(n.keys, byte(i))
+			n.children = append(n.children, child)
+		}
+	}
+	n.full, n.count = nil, 0
+}
+
+// 从slot开始正向查找第一个子节点，子节点较少时slot为数组下标，较多时为字节
+func (n *artNode) nextChild(slot int) (int, *artNode) {
+	if n.full == nil {
+		if slot < len(n.children) {
+			return slot, n.children[slot]
+		}
+		return -1, nil
+	}
+	for ; slot < len(n.full); slot++ {
+		if n.full[slot] != nil {
+			return slot, n.full[slot]
+		}
+	}
+	return -1, nil
+}
+
+// 从slot开始反向查找第一个子节点
+func (n *artNode) prevChild(slot int) (int, *artNode) {
+	if n.full == nil {
+		if slot >= 0 {
+			return slot, n.children[slot]
+		}
+		return -1, nil
+	}
+	for ; slot >= 0; slot-- {
+		if n.full[slot] != nil {
+			return slot, n.full[slot]
+		}
+	}
+	return -1, nil
+}
+
+// 字节大于等于b的第一个子节点的slot
+func (n *artNode) slotOf(b byte) int {
+	if n.full != nil {
+		return int(b)
+	}
+	return sort.Search(len(n.keys), func(i int) bool {
+		return n.keys[i] >= b
+	})
+}
+
+// 最后一个子节点的slot
+func (n *artNode) lastSlot() int {
+	if n.full != nil {
+		return len(n.full) - 1
+	}
+	return len(n.keys) - 1
+}
+
+// 两个key的公共前缀长度
+func commonPrefixLen(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// Art索引迭代器
+// 遍历的是创建时刻的索引，使用栈记录从根节点到当前位置的路径，不会拷贝数据
+// 打开迭代器的开销为O(1)，Seek的开销和key的长度成正比
+type artIterator struct {
+	root       *artNode   //创建迭代器时的根节点
+	reverse    bool       //是否是反向遍历
+	stack      []artFrame //从根节点到当前位置的路径
+	curr       *Item      //当前位置的数据
+	positioned bool       //是否已经定位到了遍历的起点
+}
+
+// 遍历路径上的节点
+type artFrame struct {
+	node     *artNode
+	slot     int  //下一个需要访问的子节点的slot，反向遍历时为-1表示子节点已经访问完
+	leafDone bool //节点自身的数据是否已经访问过
+}
+
+func newARTIterator(root *artNode, reverse bool) *artIterator {
 	return &artIterator{
-		currIndex: 0,
-		reverse:   reverse,
-		values:    values,
+		root:    root,
+		reverse: reverse,
 	}
 }
 
 // Rewind重新回到迭代器的起点，即第一个数据
 func (ai *artIterator) Rewind() {
-	ai.currIndex = 0
+	if !ai.reverse {
+		ai.Seek(nil)
+		return
+	}
+	ai.positioned = true
+	ai.stack = ai.stack[:0]
+	if ai.root != nil {
+		ai.stack = append(ai.stack, artFrame{node: ai.root, slot: ai.root.lastSlot()})
+	}
+	ai.advance()
 }
 
 // Seek根据传入的key查询到第一个大于（或小于）等于的目标key，根据从这个key开始遍历
 func (ai *artIterator) Seek(key []byte) {
-	if ai.reverse {
-		ai.currIndex = sort.Search(len(ai.values), func(i int) bool {
-			return bytes.Compare(ai.values[i].key, key) <= 0
-		})
-	} else {
-		ai.currIndex = sort.Search(len(ai.values), func(i int) bool {
-			return bytes.Compare(ai.values[i].key, key) >= 0
-		})
+	ai.positioned = true
+	ai.stack = ai.stack[:0]
+	for n := ai.root; n != nil; {
+		p := commonPrefixLen(n.prefix, key)
+		if p < len(n.prefix) {
+			//子树中所有的key都大于目标key
+			if p == len(key) || n.prefix[p] > key[p] {
+				if !ai.reverse {
+					ai.stack = append(ai.stack, artFrame{node: n, leafDone: true})
+					if n.leaf != nil {
+						ai.curr = n.leaf
+						return
+					}
+				}
+				break
+			}
+			//子树中所有的key都小于目标key
+			if ai.reverse {
+				ai.stack = append(ai.stack, artFrame{node: n, slot: n.lastSlot()})
+			}
+			break
+		}
+		key = key[p:]
+		if len(key) == 0 {
+			//节点自身的数据等于目标key，子节点都大于目标key
+			if ai.reverse {
+				ai.stack = append(ai.stack, artFrame{node: n, slot: -1})
+				break
+			}
+			ai.stack = append(ai.stack, artFrame{node: n, leafDone: true})
+			if n.leaf != nil {
+				ai.curr = n.leaf
+				return
+			}
+			break
+		}
+		//节点自身的数据小于目标key，字节较小的子节点小于目标key，字节较大的子节点大于目标key
+		child, slot := n.child(key[0]), n.slotOf(key[0])
+		if ai.reverse {
+			ai.stack = append(ai.stack, artFrame{node: n, slot: slot - 1})
+		} else if child != nil {
+			ai.stack = append(ai.stack, artFrame{node: n, slot: slot + 1, leafDone: true})
+		} else {
+			ai.stack = append(ai.stack, artFrame{node: n, slot: slot, leafDone: true})
+		}
+		n, key = child, key[1:]
 	}
+	ai.advance()
 }
 
 // Next跳转到下一个key
 func (ai *artIterator) Next() {
-	ai.currIndex += 1
+	ai.ensurePositioned()
+	ai.advance()
 }
 
 // Valid是否有效，即是否已经遍历了所有的key，用于退出遍历
 func (ai *artIterator) Valid() bool {
-	return ai.currIndex < len(ai.values)
+	ai.ensurePositioned()
+	return ai.curr != nil
 }
 
 // Key当前遍历位置的key数据
 func (ai *artIterator) Key() []byte {
-	return ai.values[ai.currIndex].key
+	ai.ensurePositioned()
+	return ai.curr.key
 }
 
 // Value当前遍历位置的Value数据
 func (ai *artIterator) Value() *data.LogRecordPos {
-	return ai.values[ai.currIndex].pos
+	ai.ensurePositioned()
+	return ai.curr.pos
 }
 
 // Close关闭迭代器，释放相关资源
 func (ai *artIterator) Close() {
-	ai.values = nil
+	ai.root = nil
+	ai.stack = nil
+	ai.curr = nil
+	ai.positioned = true
+}
+
+// 没有调用过Rewind或Seek时从头开始遍历
+func (ai *artIterator) ensurePositioned() {
+	if !ai.positioned {
+		ai.Rewind()
+	}
+}
+
+// 沿着栈中记录的路径移动到下一个数据
+// 正向遍历时先访问节点自身的数据，再按照字节从小到大访问子节点；反向遍历的顺序相反
+func (ai *artIterator) advance() {
+	ai.curr = nil
+	for len(ai.stack) > 0 {
+		top := &ai.stack[len(ai.stack)-1]
+		if !ai.reverse {
+			slot, child := top.node.nextChild(top.slot)
+			if child == nil {
+				ai.stack = ai.stack[:len(ai.stack)-1]
+				continue
+			}
+			top.slot = slot + 1
+			ai.stack = append(ai.stack, artFrame{node: child, leafDone: true})
+			if child.leaf != nil {
+				ai.curr = child.leaf
+				return
+			}
+			continue
+		}
+		if top.slot >= 0 {
+			if slot, child := top.node.prevChild(top.slot); child != nil {
+				top.slot = slot - 1
+				ai.stack = append(ai.stack, artFrame{node: child, slot: child.lastSlot()})
+				continue
+			}
+			top.slot = -1
+		}
+		if !top.leafDone {
+			top.leafDone = true
+			if top.node.leaf != nil {
+				ai.curr = top.node.leaf
+				return
+			}
+		}
+		ai.stack = ai.stack[:len(ai.stack)-1]
+	}
 }
@@ -2,6 +2,9 @@ package index
 
 import (
 	"bitcask-go/data"
+	"fmt"
+	"math/rand"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -61,3 +64,164 @@ func TestAdaptiveRadixTree_Iterator(t *testing.T) {
 		t.Log(string(iter.Key()))
 	}
 }
+
+func TestAdaptiveRadixTree_Iterator_Modify(t *testing.T) {
+	art := NewART()
+	for i := 0; i < 100; i++ {
+		art.Put([]byte(fmt.Sprintf("key-%03d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	iter := art.Iterator(false)
+	iter.Seek([]byte("key-050"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("key-050"), iter.Key())
+
+	//迭代器打开之后的修改不可见
+	art.Delete([]byte("key-051"))
+	art.Put([]byte("key-099a"), &data.LogRecordPos{Fid: 1, Offset: 100})
+	var keys []string
+	for iter.Next(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	assert.Equal(t, 49, len(keys))
+	assert.Equal(t, "key-051", keys[0])
+	assert.Equal(t, "key-099", keys[len(keys)-1])
+	iter.Close()
+
+	reverseIter := art.Iterator(true)
+	reverseIter.Seek([]byte("key-010"))
+	assert.True(t, reverseIter.Valid())
+	assert.Equal(t, []byte("key-010"), reverseIter.Key())
+	reverseIter.Close()
+}
+
+func TestAdaptiveRadixTree_Clone(t *testing.T) {
+	art := NewART()
+	art.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	art.Put([]byte("ab"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	art.Put([]byte("b"), &data.LogRecordPos{Fid: 1, Offset: 3})
+
+	snap := art.Clone()
+	art.Put([]byte("a"), &data.LogRecordPos{Fid: 2, Offset: 1})
+	art.Delete([]byte("ab"))
+	art.Put([]byte("abc"), &data.LogRecordPos{Fid: 2, Offset: 2})
+
+	//快照不受原索引修改的影响
+	assert.Equal(t, 3, snap.Size())
+	assert.Equal(t, uint32(1), snap.Get([]byte("a")).Fid)
+	assert.NotNil(t, snap.Get([]byte("ab")))
+	assert.Nil(t, snap.Get([]byte("abc")))
+	assert.Equal(t, uint32(2), art.Get([]byte("a")).Fid)
+	assert.Nil(t, art.Get([]byte("ab")))
+	assert.Equal(t, 3, art.Size())
+
+	//快照的修改也不会影响原索引
+	snap.Delete([]byte("b"))
+	assert.NotNil(t, art.Get([]byte("b")))
+}
+
+func TestAdaptiveRadixTree_Random(t *testing.T) {
+	art := NewART()
+	expected := make(map[string]int64)
+	rnd := rand.New(rand.NewSource(1))
+	var snap Indexer
+	var snapExpected map[string]int64
+	for i := 0; i < 20000; i++ {
+		//较短的key会产生大量的公共前缀和大小不同的节点
+		key := make([]byte, rnd.Intn(4))
+		for j := range key {
+			key[j] = byte(rnd.Intn(64))
+		}
+		if rnd.Intn(3) == 0 {
+			_, ok := art.Delete(key)
+			_, exists := expected[string(key)]
+			assert.Equal(t, exists, ok)
+			delete(expected, string(key))
+		} else {
+			art.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+			expected[string(key)] = int64(i)
+		}
+		if i == 10000 {
+			snap = art.Clone()
+			snapExpected = make(map[string]int64, len(expected))
+			for k, v := range expected {
+				snapExpected[k] = v
+			}
+		}
+	}
+	checkART := func(indexer Indexer, expected map[string]int64) {
+		assert.Equal(t, len(expected), indexer.Size())
+		var keys []string
+		for k, v := range expected {
+			assert.Equal(t, v, indexer.Get([]byte(k)).Offset)
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		iter := indexer.Iterator(false)
+		var i int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			assert.Equal(t, keys[i], string(iter.Key()))
+			i++
+		}
+		assert.Equal(t, len(keys), i)
+		iter.Close()
+	}
+	checkART(art, expected)
+	checkART(snap, snapExpected)
+}
+
+func TestAdaptiveRadixTree_Iterator_Seek(t *testing.T) {
+	art := NewART()
+	rnd := rand.New(rand.NewSource(1))
+	var keys []string
+	for i := 0; i < 5000; i++ {
+		key := make([]byte, rnd.Intn(5))
+		for j := range key {
+			key[j] = byte(rnd.Intn(80))
+		}
+		if art.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)}) == nil {
+			keys = append(keys, string(key))
+		}
+	}
+	sort.Strings(keys)
+	iter := art.Iterator(false)
+	reverseIter := art.Iterator(true)
+	//迭代器打开之后的修改不可见
+	art.Put([]byte{0}, &data.LogRecordPos{Fid: 2})
+	for i := 0; i < 1000; i++ {
+		target := make([]byte, rnd.Intn(5))
+		for j := range target {
+			target[j] = byte(rnd.Intn(80))
+		}
+		idx := sort.SearchStrings(keys, string(target))
+		iter.Seek(target)
+		for j := idx; j < len(keys) && j < idx+3; j++ {
+			assert.True(t, iter.Valid())
+			assert.Equal(t, keys[j], string(iter.Key()))
+			iter.Next()
+		}
+		if idx >= len(keys) {
+			assert.False(t, iter.Valid())
+		}
+
+		//反向遍历从最后一个小于等于目标的key开始
+		idx = sort.Search(len(keys), func(j int) bool { return keys[j] > string(target) }) - 1
+		reverseIter.Seek(target)
+		for j := idx; j >= 0 && j > idx-3; j-- {
+			assert.True(t, reverseIter.Valid())
+			assert.Equal(t, keys[j], string(reverseIter.Key()))
+			reverseIter.Next()
+		}
+		if idx < 0 {
+			assert.False(t, reverseIter.Valid())
+		}
+	}
+
+	var count int
+	for reverseIter.Rewind(); reverseIter.Valid(); reverseIter.Next() {
+		assert.Equal(t, keys[len(keys)-1-count], string(reverseIter.Key()))
+		count++
+	}
+	assert.Equal(t, len(keys), count)
+	iter.Close()
+	reverseIter.Close()
+}
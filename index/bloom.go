@@ -0,0 +1,116 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"hash/fnv"
+	"math"
+)
+
+// 布隆过滤器的最小容量，key的数量较少时避免频繁扩容
+const minBloomFilterCapacity = 1024
+
+// crc 4字节 误判率 8字节 哈希函数数量 4字节 容量 8字节 已添加数量 8字节 索引中key的数量 8字节
+const bloomFilterHeaderSize = 40
+
+var errInvalidBloomFilter = errors.New("invalid bloom filter file")
+
+// 布隆过滤器，判断为不存在的key一定不存在
+// key被删除之后无法从过滤器中移除，只能通过重建清除
+type bloomFilter struct {
+	bits     []uint64
+	fpRate   float64 //期望的误判率
+	k        uint32  //哈希函数的数量
+	capacity uint64  //容量，添加的key超过容量之后误判率会升高
+	count    uint64  //已经添加的key数量
+}
+
+// 根据容量和误判率计算需要的位数和哈希函数数量
+func newBloomFilter(capacity uint64, fpRate float64) *bloomFilter {
+	if capacity < minBloomFilterCapacity {
+		capacity = minBloomFilterCapacity
+	}
+	m := math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := uint32(math.Round(m / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits:     make([]uint64, (uint64(m)+63)/64),
+		fpRate:   fpRate,
+		k:        k,
+		capacity: capacity,
+	}
+}
+
+// 使用两个哈希值组合出k个哈希函数
+func bloomFilterHash(key []byte) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	h1 := h.Sum64()
+	//对fnv的结果再做一次混合，让高位和低位分布更均匀
+	h2 := h1 ^ h1>>33
+	h2 *= 0xff51afd7ed558ccd
+	h2 ^= h2 >> 33
+	return h1, h2 | 1
+}
+
+func (bf *bloomFilter) add(key []byte) {
+	h1, h2 := bloomFilterHash(key)
+	m := uint64(len(bf.bits)) * 64
+	for i := uint64(0); i < uint64(bf.k); i++ {
+		bit := (h1 + i*h2) % m
+		bf.bits[bit/64] |= 1 << (bit % 64)
+	}
+	bf.count++
+}
+
+func (bf *bloomFilter) mayContain(key []byte) bool {
+	h1, h2 := bloomFilterHash(key)
+	m := uint64(len(bf.bits)) * 64
+	for i := uint64(0); i < uint64(bf.k); i++ {
+		bit := (h1 + i*h2) % m
+		if bf.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// 编码布隆过滤器，keyNum为保存时索引中key的数量，加载时用于校验过滤器和索引是否一致
+func (bf *bloomFilter) encode(keyNum uint64) []byte {
+	buf := make([]byte, bloomFilterHeaderSize+len(bf.bits)*8)
+	binary.LittleEndian.PutUint64(buf[4:], math.Float64bits(bf.fpRate))
+	binary.LittleEndian.PutUint32(buf[12:], bf.k)
+	binary.LittleEndian.PutUint64(buf[16:], bf.capacity)
+	binary.LittleEndian.PutUint64(buf[24:], bf.count)
+	binary.LittleEndian.PutUint64(buf[32:], keyNum)
+	for i, word := range bf.bits {
+		binary.LittleEndian.PutUint64(buf[bloomFilterHeaderSize+i*8:], word)
+	}
+	binary.LittleEndian.PutUint32(buf[:crc32.Size], crc32.ChecksumIEEE(buf[crc32.Size:]))
+	return buf
+}
+
+// 解码布隆过滤器，返回过滤器和保存时索引中key的数量
+func decodeBloomFilter(buf []byte) (*bloomFilter, uint64, error) {
+	if len(buf) < bloomFilterHeaderSize || (len(buf)-bloomFilterHeaderSize)%8 != 0 ||
+		crc32.ChecksumIEEE(buf[crc32.Size:]) != binary.LittleEndian.Uint32(buf[:crc32.Size]) {
+		return nil, 0, errInvalidBloomFilter
+	}
+	bf := &bloomFilter{
+		bits:     make([]uint64, (len(buf)-bloomFilterHeaderSize)/8),
+		fpRate:   math.Float64frombits(binary.LittleEndian.Uint64(buf[4:])),
+		k:        binary.LittleEndian.Uint32(buf[12:]),
+		capacity: binary.LittleEndian.Uint64(buf[16:]),
+		count:    binary.LittleEndian.Uint64(buf[24:]),
+	}
+	if len(bf.bits) == 0 || bf.k == 0 {
+		return nil, 0, errInvalidBloomFilter
+	}
+	for i := range bf.bits {
+		bf.bits[i] = binary.LittleEndian.Uint64(buf[bloomFilterHeaderSize+i*8:])
+	}
+	return bf, binary.LittleEndian.Uint64(buf[32:]), nil
+}
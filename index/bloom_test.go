@@ -0,0 +1,38 @@
+package index
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBloomFilter(t *testing.T) {
+	bf := newBloomFilter(10000, 0.01)
+	for i := 0; i < 10000; i++ {
+		bf.add([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	for i := 0; i < 10000; i++ {
+		assert.True(t, bf.mayContain([]byte(fmt.Sprintf("key-%d", i))))
+	}
+	//误判率接近配置的值
+	var falsePositives int
+	for i := 0; i < 10000; i++ {
+		if bf.mayContain([]byte(fmt.Sprintf("missing-%d", i))) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 200)
+
+	buf := bf.encode(100)
+	decoded, keyNum, err := decodeBloomFilter(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), keyNum)
+	assert.Equal(t, bf, decoded)
+
+	buf[len(buf)-1] ^= 0xff
+	_, _, err = decodeBloomFilter(buf)
+	assert.Equal(t, errInvalidBloomFilter, err)
+	_, _, err = decodeBloomFilter(buf[:10])
+	assert.Equal(t, errInvalidBloomFilter, err)
+}
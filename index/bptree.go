@@ -2,26 +2,40 @@ package index
 
 import (
 	"bitcask-go/data"
+	"os"
 	"path/filepath"
+	"sync"
 
 	"go.etcd.io/bbolt"
 )
 
 const bptreeIndexFileName = "bptree-index"
 
+// 布隆过滤器文件的后缀，和索引文件放在一起
+const bloomFilterFileSuffix = ".bloom"
+
 var indexBucketName = []byte("bitcask-index")
 
 // B+树索引
 // 主要封装了go.etcd.io/bbolt库
 type BPlusTree struct {
 	tree *bbolt.DB
+	//布隆过滤器，为空表示不使用，判断key不存在时不需要打开bbolt的读事务
+	filter     *bloomFilter
+	filterMu   *sync.RWMutex
+	filterPath string
 }
 
 // 初始化B+树索引
 func NewBPlusTree(dirPath string, syncWrites bool) *BPlusTree {
+	return NewBPlusTreeWithFileName(dirPath, bptreeIndexFileName, syncWrites, 0)
+}
+
+// 使用指定的索引文件名初始化B+树索引，bloomFalsePositiveRate大于0时使用布隆过滤器
+func NewBPlusTreeWithFileName(dirPath string, fileName string, syncWrites bool, bloomFalsePositiveRate float64) *BPlusTree {
 	opts := bbolt.DefaultOptions
 	opts.NoSync = !syncWrites
-	bptree, err := bbolt.Open(filepath.Join(dirPath, bptreeIndexFileName), 0644, opts)
+	bptree, err := bbolt.Open(filepath.Join(dirPath, fileName), 0644, opts)
 	if err != nil {
 		panic("failed to open bptree")
 	}
@@ -32,9 +46,91 @@ func NewBPlusTree(dirPath string, syncWrites bool) *BPlusTree {
 	}); err != nil {
 		panic("failed to crate bucket in bptree")
 	}
-	return &BPlusTree{
-		tree: bptree,
+	bpt := &BPlusTree{
+		tree:       bptree,
+		filterMu:   new(sync.RWMutex),
+		filterPath: filepath.Join(dirPath, fileName+bloomFilterFileSuffix),
+	}
+	if err := bpt.loadBloomFilter(bloomFalsePositiveRate); err != nil {
+		panic("failed to load bloom filter")
+	}
+	return bpt
+}
+
+// 加载之前保存的布隆过滤器，加载之后删除文件，异常退出之后重新打开时从索引中重建
+// 保存时索引中key的数量或者误判率不一致时同样重建
+func (bpt *BPlusTree) loadBloomFilter(fpRate float64) error {
+	buf, err := os.ReadFile(bpt.filterPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(bpt.filterPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	//不使用布隆过滤器时之后的写入不会更新过滤器，已有的文件不再有效
+	if fpRate <= 0 {
+		return nil
+	}
+	if filter, keyNum, err := decodeBloomFilter(buf); err == nil &&
+		filter.fpRate == fpRate && keyNum == uint64(bpt.Size()) {
+		bpt.filter = filter
+		return nil
+	}
+	bpt.filter = newBloomFilter(0, fpRate)
+	bpt.RebuildBloomFilter()
+	return nil
+}
+
+// RebuildBloomFilter 使用索引中所有的key重建布隆过滤器，清除已经删除的key
+func (bpt *BPlusTree) RebuildBloomFilter() {
+	bpt.filterMu.Lock()
+	defer bpt.filterMu.Unlock()
+	if bpt.filter != nil {
+		bpt.rebuildBloomFilter(uint64(bpt.Size()) * 2)
+	}
+}
+
+// 在访问此方法前必须得有布隆过滤器的互斥锁
+func (bpt *BPlusTree) rebuildBloomFilter(capacity uint64) {
+	filter := newBloomFilter(capacity, bpt.filter.fpRate)
+	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(indexBucketName).ForEach(func(k, v []byte) error {
+			filter.add(k)
+			return nil
+		})
+	}); err != nil {
+		panic("failed to rebuild bloom filter")
+	}
+	bpt.filter = filter
+}
+
+// 将新写入的key添加到布隆过滤器中
+func (bpt *BPlusTree) addToBloomFilter(key []byte) {
+	bpt.filterMu.Lock()
+	defer bpt.filterMu.Unlock()
+	if bpt.filter == nil {
+		return
+	}
+	bpt.filter.add(key)
+	//超过容量之后误判率会升高，扩大容量重建
+	if bpt.filter.count > bpt.filter.capacity {
+		bpt.rebuildBloomFilter(bpt.filter.capacity * 2)
+	}
+}
+
+// SaveBloomFilter 将布隆过滤器保存到索引文件旁边，下次打开时不需要重建
+// 保存之后不能再修改索引
+func (bpt *BPlusTree) SaveBloomFilter() error {
+	bpt.filterMu.RLock()
+	defer bpt.filterMu.RUnlock()
+	if bpt.filter == nil {
+		return nil
+	}
+	tmpPath := bpt.filterPath + ".tmp"
+	if err := os.WriteFile(tmpPath, bpt.filter.encode(uint64(bpt.Size())), 0644); err != nil {
+		return err
 	}
+	return os.Rename(tmpPath, bpt.filterPath)
 }
 
 // Put 向对象中存储key对应的数据位置信息
@@ -48,6 +144,7 @@ func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos
 		panic("failed to put value in bptree")
 	}
 	if oldValue == nil {
+		bpt.addToBloomFilter(key)
 		return nil
 	}
 	return data.DecodeLogRecordPos(oldValue)
@@ -55,6 +152,12 @@ func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos
 
 // Get 根据key获取对应的索引信息
 func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
+	bpt.filterMu.RLock()
+	mayContain := bpt.filter == nil || bpt.filter.mayContain(key)
+	bpt.filterMu.RUnlock()
+	if !mayContain {
+		return nil
+	}
 	var pos *data.LogRecordPos
 	if err := bpt.tree.View(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
@@ -105,6 +208,12 @@ func (bpt *BPlusTree) Iterator(reverse bool) Iterator {
 	return newBptreeIterator(bpt.tree, reverse)
 }
 
+// Clone B+树索引不支持快照
+// 长时间持有bbolt的读事务会阻塞写事务重新映射文件，拷贝所有的数据开销又太大
+func (bpt *BPlusTree) Clone() Indexer {
+	panic("bptree index does not support clone")
+}
+
 // b+树迭代器
 type bptreeIterator struct {
 	tx        *bbolt.Tx
@@ -2,6 +2,7 @@ package index
 
 import (
 	"bitcask-go/data"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
@@ -101,3 +102,58 @@ func TestBptree_Iterator(t *testing.T) {
 		t.Log(string(iter.Key()))
 	}
 }
+
+func TestBPlusTree_BloomFilter(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "bptree-bloom")
+	_ = os.MkdirAll(path, os.ModePerm)
+	defer func() {
+		_ = os.RemoveAll(path)
+	}()
+	tree := NewBPlusTreeWithFileName(path, bptreeIndexFileName, false, 0.01)
+	//超过初始容量之后扩容
+	for i := 0; i < 3000; i++ {
+		tree.Put([]byte(fmt.Sprintf("key-%d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	assert.Greater(t, tree.filter.capacity, uint64(3000))
+	for i := 0; i < 3000; i++ {
+		assert.NotNil(t, tree.Get([]byte(fmt.Sprintf("key-%d", i))))
+	}
+	assert.Nil(t, tree.Get([]byte("not exist")))
+
+	//删除的key在重建之后从过滤器中移除
+	for i := 0; i < 3000; i++ {
+		tree.Delete([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	assert.True(t, tree.filter.mayContain([]byte("key-1")))
+	tree.RebuildBloomFilter()
+	assert.Equal(t, uint64(0), tree.filter.count)
+	tree.Put([]byte("key-1"), &data.LogRecordPos{Fid: 1, Offset: 1})
+
+	//重新打开时加载保存的过滤器，加载之后删除文件
+	assert.Nil(t, tree.SaveBloomFilter())
+	filter := tree.filter
+	assert.Nil(t, tree.tree.Close())
+	tree = NewBPlusTreeWithFileName(path, bptreeIndexFileName, false, 0.01)
+	assert.Equal(t, filter, tree.filter)
+	_, err := os.Stat(filepath.Join(path, bptreeIndexFileName+bloomFilterFileSuffix))
+	assert.True(t, os.IsNotExist(err))
+	assert.NotNil(t, tree.Get([]byte("key-1")))
+
+	//没有保存过滤器时从索引中重建
+	tree.Put([]byte("key-2"), &data.LogRecordPos{Fid: 1, Offset: 2})
+	assert.Nil(t, tree.tree.Close())
+	tree = NewBPlusTreeWithFileName(path, bptreeIndexFileName, false, 0.01)
+	assert.NotNil(t, tree.Get([]byte("key-2")))
+	assert.Equal(t, uint64(2), tree.filter.count)
+
+	//不使用过滤器时写入的key在之后使用过滤器时仍然可以读取
+	assert.Nil(t, tree.SaveBloomFilter())
+	assert.Nil(t, tree.tree.Close())
+	tree = NewBPlusTree(path, false)
+	assert.Nil(t, tree.filter)
+	tree.Put([]byte("key-3"), &data.LogRecordPos{Fid: 1, Offset: 3})
+	assert.Nil(t, tree.tree.Close())
+	tree = NewBPlusTreeWithFileName(path, bptreeIndexFileName, false, 0.01)
+	assert.NotNil(t, tree.Get([]byte("key-3")))
+	assert.Nil(t, tree.tree.Close())
+}
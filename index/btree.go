@@ -3,7 +3,6 @@ package index
 import (
 	"bitcask-go/data"
 	"bytes"
-	"sort"
 	"sync"
 
 	"github.com/google/btree"
@@ -32,7 +31,9 @@ func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 }
 func (bt *BTree) Get(key []byte) *data.LogRecordPos {
 	it := &Item{key: key}
+	bt.lock.RLock()
 	btreeItem := bt.tree.Get(it)
+	bt.lock.RUnlock()
 	if btreeItem == nil {
 		return nil
 	}
@@ -52,84 +53,130 @@ func (bt *BTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 func (bt *BTree) Size() int {
 	return bt.tree.Len()
 }
+
+// Iterator索引迭代器，遍历的是创建时刻索引的写时复制副本
 func (bt *BTree) Iterator(reverse bool) Iterator {
 	if bt.tree == nil {
 		return nil
 	}
-	bt.lock.RLock()
-	defer bt.lock.RUnlock()
-	return newBTreeIterator(bt.tree, reverse)
+	//Clone会修改原索引的写时复制状态，需要加写锁
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	return newBTreeIterator(bt.tree.Clone(), reverse)
+}
 
+// Clone复制一份索引快照，使用写时复制，不会拷贝数据
+func (bt *BTree) Clone() Indexer {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	return &BTree{
+		tree: bt.tree.Clone(),
+		lock: new(sync.RWMutex),
+	}
 }
 
+// 迭代器每次从btree中读取的数据量
+const btreeIteratorBatchSize = 64
+
 // BTree索引迭代器
+// 遍历的是索引的写时复制副本，打开迭代器的开销为O(1)，Seek的开销为O(log n)
+// 数据按批次从副本中读取，不会一次性拷贝所有的数据
 type btreeIterator struct {
-	currIndex int     //当前遍历的下标位置
-	reverse   bool    //是否是反向遍历
-	values    []*Item //key+位置索引信息
+	tree       *btree.BTree //索引的写时复制副本
+	reverse    bool         //是否是反向遍历
+	values     []*Item      //当前批次的key+位置索引信息
+	currIndex  int          //当前遍历的下标位置
+	exhausted  bool         //当前批次之后是否已经没有数据了
+	positioned bool         //是否已经定位到了遍历的起点
 }
 
 func newBTreeIterator(tree *btree.BTree, reverse bool) *btreeIterator {
-	var idx int
-	values := make([]*Item, tree.Len())
-
-	//将所有的数据存放到数组中
-	saveValues := func(it btree.Item) bool {
-		values[idx] = it.(*Item)
-		idx++
-		return true
-	}
-	if reverse {
-		tree.Descend(saveValues)
-	} else {
-		tree.Ascend(saveValues)
-	}
 	return &btreeIterator{
-		currIndex: 0,
-		reverse:   reverse,
-		values:    values,
+		tree:    tree,
+		reverse: reverse,
+		values:  make([]*Item, 0, btreeIteratorBatchSize),
 	}
 }
 
 // Rewind重新回到迭代器的起点，即第一个数据
 func (bti *btreeIterator) Rewind() {
-	bti.currIndex = 0
+	bti.fetch(nil, false)
 }
 
 // Seek根据传入的key查询到第一个大于（或小于）等于的目标key，根据从这个key开始遍历
 func (bti *btreeIterator) Seek(key []byte) {
-	if bti.reverse {
-		bti.currIndex = sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(bti.values[i].key, key) <= 0
-		})
-	} else {
-		bti.currIndex = sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(bti.values[i].key, key) >= 0
-		})
-	}
+	bti.fetch(key, false)
 }
 
 // Next跳转到下一个key
 func (bti *btreeIterator) Next() {
+	bti.ensurePositioned()
 	bti.currIndex += 1
+	//当前批次遍历完之后，从最后一个key之后继续读取下一批
+	if bti.currIndex >= len(bti.values) && !bti.exhausted && len(bti.values) > 0 {
+		bti.fetch(bti.values[len(bti.values)-1].key, true)
+	}
 }
 
 // Valid是否有效，即是否已经遍历了所有的key，用于退出遍历
 func (bti *btreeIterator) Valid() bool {
+	bti.ensurePositioned()
 	return bti.currIndex < len(bti.values)
 }
 
 // Key当前遍历位置的key数据
 func (bti *btreeIterator) Key() []byte {
+	bti.ensurePositioned()
 	return bti.values[bti.currIndex].key
 }
 
 // Value当前遍历位置的Value数据
 func (bti *btreeIterator) Value() *data.LogRecordPos {
+	bti.ensurePositioned()
 	return bti.values[bti.currIndex].pos
 }
 
 // Close关闭迭代器，释放相关资源
 func (bti *btreeIterator) Close() {
+	bti.tree = nil
 	bti.values = nil
+	bti.exhausted = true
+	bti.positioned = true
+}
+
+// 没有调用过Rewind或Seek时从头开始遍历
+func (bti *btreeIterator) ensurePositioned() {
+	if !bti.positioned {
+		bti.Rewind()
+	}
+}
+
+// 从指定的key开始读取一批数据，from为空表示从头读取，skipFrom表示跳过和from相等的key
+func (bti *btreeIterator) fetch(from []byte, skipFrom bool) {
+	bti.values = bti.values[:0]
+	bti.currIndex = 0
+	bti.positioned = true
+	if bti.tree == nil {
+		bti.exhausted = true
+		return
+	}
+	saveValues := func(it btree.Item) bool {
+		item := it.(*Item)
+		if skipFrom && bytes.Equal(item.key, from) {
+			return true
+		}
+		bti.values = append(bti.values, item)
+		return len(bti.values) < btreeIteratorBatchSize
+	}
+	switch {
+	case from == nil && bti.reverse:
+		bti.tree.Descend(saveValues)
+	case from == nil:
+		bti.tree.Ascend(saveValues)
+	case bti.reverse:
+		bti.tree.DescendLessOrEqual(&Item{key: from}, saveValues)
+	default:
+		bti.tree.AscendGreaterOrEqual(&Item{key: from}, saveValues)
+	}
+	bti.exhausted = len(bti.values) < btreeIteratorBatchSize
 }
@@ -2,6 +2,7 @@ package index
 
 import (
 	"bitcask-go/data"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -102,3 +103,54 @@ func TestBTree_Iterator(t *testing.T) {
 		assert.NotNil(t, iter6.Key())
 	}
 }
+
+func TestBTree_Clone(t *testing.T) {
+	bt := NewBTree()
+	bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	bt.Put([]byte("b"), &data.LogRecordPos{Fid: 1, Offset: 2})
+
+	snap := bt.Clone()
+	bt.Put([]byte("a"), &data.LogRecordPos{Fid: 2, Offset: 1})
+	bt.Delete([]byte("b"))
+	bt.Put([]byte("c"), &data.LogRecordPos{Fid: 2, Offset: 2})
+
+	//快照不受原索引修改的影响
+	assert.Equal(t, 2, snap.Size())
+	assert.Equal(t, uint32(1), snap.Get([]byte("a")).Fid)
+	assert.NotNil(t, snap.Get([]byte("b")))
+	assert.Nil(t, snap.Get([]byte("c")))
+	assert.Equal(t, uint32(2), bt.Get([]byte("a")).Fid)
+}
+
+func TestBTree_Iterator_Batch(t *testing.T) {
+	bt := NewBTree()
+	for i := 0; i < 1000; i++ {
+		bt.Put([]byte(fmt.Sprintf("key-%04d", i)), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+	iter := bt.Iterator(false)
+	//迭代器打开之后的修改不可见
+	bt.Delete([]byte("key-0500"))
+	var count int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.Equal(t, []byte(fmt.Sprintf("key-%04d", count)), iter.Key())
+		count++
+	}
+	assert.Equal(t, 1000, count)
+
+	iter.Seek([]byte("key-0990"))
+	count = 0
+	for ; iter.Valid(); iter.Next() {
+		count++
+	}
+	assert.Equal(t, 10, count)
+	iter.Close()
+
+	reverseIter := bt.Iterator(true)
+	count = 0
+	for reverseIter.Seek([]byte("key-0100")); reverseIter.Valid(); reverseIter.Next() {
+		assert.Equal(t, []byte(fmt.Sprintf("key-%04d", 100-count)), reverseIter.Key())
+		count++
+	}
+	assert.Equal(t, 101, count)
+	reverseIter.Close()
+}
@@ -3,6 +3,7 @@ package index
 import (
 	"bitcask-go/data"
 	"bytes"
+	"fmt"
 
 	"github.com/google/btree"
 )
@@ -20,6 +21,8 @@ type Indexer interface {
 	Size() int
 	//Iterator索引迭代器
 	Iterator(reverse bool) Iterator
+	//Clone复制一份索引快照，之后对原索引的修改不会影响快照
+	Clone() Indexer
 }
 type IndexType = int8
 
@@ -32,19 +35,28 @@ const (
 	BPTree
 )
 
-func NewIndexer(typ IndexType, dirPath string, sync bool) Indexer {
+// NewIndexer 初始化索引，bloomFalsePositiveRate为B+树索引使用的布隆过滤器的误判率，为0表示不使用
+func NewIndexer(typ IndexType, dirPath string, sync bool, bloomFalsePositiveRate float64) Indexer {
 	switch typ {
 	case Btree:
 		return NewBTree()
 	case ART:
 		return NewART()
 	case BPTree:
-		return NewBPlusTree(dirPath, sync)
+		return NewBPlusTreeWithFileName(dirPath, bptreeIndexFileName, sync, bloomFalsePositiveRate)
 	default:
 		panic("unsupported index type")
 	}
 }
 
+// NewFamilyIndexer 初始化列族的索引，B+树索引为每个列族使用单独的索引文件
+func NewFamilyIndexer(typ IndexType, dirPath string, familyId uint32, sync bool, bloomFalsePositiveRate float64) Indexer {
+	if typ == BPTree {
+		return NewBPlusTreeWithFileName(dirPath, fmt.Sprintf("%s-%d", bptreeIndexFileName, familyId), sync, bloomFalsePositiveRate)
+	}
+	return NewIndexer(typ, dirPath, sync, bloomFalsePositiveRate)
+}
+
 type Item struct {
 	key []byte
 	pos *data.LogRecordPos
@@ -1,41 +1,85 @@
 package bitcask_go
 
 import (
+	"bitcask-go/data"
 	"bitcask-go/index"
 	"bytes"
+	"time"
 )
 
 // Iterator迭代器
+// 迭代器会引用数据文件，使用完毕之后需要调用Close释放
 type Iterator struct {
 	indexIter index.Iterator //索引迭代器
 	db        *DB
+	snapshot  *Snapshot                 //不为空时从快照中读取数据
+	files     map[uint32]*data.DataFile //创建迭代器时的数据文件，遍历期间merge替换掉的文件不会被关闭
+	blobs     map[uint32]*data.DataFile //创建迭代器时的blob文件
 	options   IteratorOptions
+	count     int  //已经遍历的key数量
+	done      bool //是否已经超出了遍历的范围
+	closed    bool //是否已经关闭
 }
 
 // NewIterator 初始化迭代器
 func (db *DB) NewIterator(opts IteratorOptions) *Iterator {
-	indexIter := db.index.Iterator(opts.Reverse)
+	return db.newIterator(db.defaultFamily, opts)
+}
+
+// 初始化指定列族的迭代器
+func (db *DB) newIterator(cf *ColumnFamily, opts IteratorOptions) *Iterator {
+	//先引用数据文件，索引中的位置只会指向引用的文件或者之后生成的文件
+	db.mu.Lock()
+	files, blobs := db.pinDataFiles(), db.pinBlobFiles()
+	db.mu.Unlock()
+	indexIter := cf.index.Iterator(opts.Reverse)
 	return &Iterator{
 		db:        db,
 		indexIter: indexIter,
+		files:     files,
+		blobs:     blobs,
 		options:   opts,
 	}
 }
 
+// Scan根据配置项遍历数据，并执行用户指定的操作，函数返回false时停止遍历
+// KeysOnly为true时value为nil
+func (db *DB) Scan(opts IteratorOptions, fn func(key []byte, value []byte) bool) error {
+	iterator := db.NewIterator(opts)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		value, err := iterator.Value()
+		if err != nil {
+			return err
+		}
+		if !fn(iterator.Key(), value) {
+			break
+		}
+	}
+	return nil
+}
+
 // Rewind重新回到迭代器的起点，即第一个数据
 func (it *Iterator) Rewind() {
-	it.indexIter.Rewind()
+	it.count, it.done = 0, false
+	if start := it.options.startKey(); start != nil {
+		it.indexIter.Seek(start)
+	} else {
+		it.indexIter.Rewind()
+	}
 	it.skipToNext()
 }
 
 // Seek根据传入的key查询到第一个大于（或小于）等于的目标key，根据从这个key开始遍历
 func (it *Iterator) Seek(key []byte) {
-	it.indexIter.Seek(key)
+	it.count, it.done = 0, false
+	it.indexIter.Seek(it.options.clampSeekKey(key))
 	it.skipToNext()
 }
 
 // Next跳转到下一个key
 func (it *Iterator) Next() {
+	it.count++
 	it.indexIter.Next()
 	it.skipToNext()
 
@@ -43,6 +87,9 @@ func (it *Iterator) Next() {
 
 // Valid是否有效，即是否已经遍历了所有的key，用于退出遍历
 func (it *Iterator) Valid() bool {
+	if it.done || (it.options.Limit > 0 && it.count >= it.options.Limit) {
+		return false
+	}
 	return it.indexIter.Valid()
 }
 
@@ -51,28 +98,126 @@ func (it *Iterator) Key() []byte {
 	return it.indexIter.Key()
 }
 
-// Value当前遍历位置的Value数据
+// Value当前遍历位置的Value数据，KeysOnly为true时返回nil
 func (it *Iterator) Value() ([]byte, error) {
+	if it.options.KeysOnly {
+		return nil, nil
+	}
 	logRecordPos := it.indexIter.Value()
+	if it.snapshot != nil {
+		return it.snapshot.getValueByPosition(logRecordPos)
+	}
 	it.db.mu.RLock()
 	defer it.db.mu.RUnlock()
-	return it.db.getValueByPosition(logRecordPos)
+	return it.db.readCachedValue(it.getDataFile, it.getBlobFile, logRecordPos)
 }
 
 // Close关闭迭代器，释放相关资源
 func (it *Iterator) Close() {
 	it.indexIter.Close()
+	if it.closed {
+		return
+	}
+	it.closed = true
+	if it.snapshot == nil {
+		it.db.unpinFiles(it.files, it.blobs)
+		it.files, it.blobs = nil, nil
+	}
 }
 
-func (it *Iterator) skipToNext() {
-	prefixLen := len(it.options.Prefix)
-	if prefixLen == 0 {
-		return
+// 获取迭代器引用的数据文件，迭代器创建之后新生成的数据文件从数据库中获取
+// 在访问此方法前必须得有数据库的读锁
+func (it *Iterator) getDataFile(fid uint32) *data.DataFile {
+	if dataFile := it.files[fid]; dataFile != nil {
+		return dataFile
 	}
+	return it.db.getDataFile(fid)
+}
+
+// 获取迭代器引用的blob文件，迭代器创建之后新生成的blob文件从数据库中获取
+// 在访问此方法前必须得有数据库的读锁
+func (it *Iterator) getBlobFile(fid uint32) *data.DataFile {
+	if blobFile := it.blobs[fid]; blobFile != nil {
+		return blobFile
+	}
+	return it.db.getBlobFile(fid)
+}
+
+func (it *Iterator) skipToNext() {
+	now := time.Now().UnixNano()
 	for ; it.indexIter.Valid(); it.indexIter.Next() {
-		key := it.indexIter.Key()
-		if prefixLen <= len(key) && bytes.Compare(it.options.Prefix, key[:prefixLen]) == 0 {
-			break
+		skip, stop := it.options.checkKey(it.indexIter.Key())
+		//已经超出遍历范围，后面的key都不需要再遍历
+		if stop {
+			it.done = true
+			return
+		}
+		if skip {
+			continue
 		}
+		//跳过已经过期的key
+		if it.indexIter.Value().IsExpired(now) {
+			continue
+		}
+		break
+	}
+}
+
+// 遍历开始的位置，为空表示从头开始遍历
+func (opts IteratorOptions) startKey() []byte {
+	var start []byte
+	if !opts.Reverse {
+		//正向遍历从前缀和下界中较大的一个开始
+		start = opts.Prefix
+		if opts.LowerBound != nil && bytes.Compare(opts.LowerBound, start) > 0 {
+			start = opts.LowerBound
+		}
+		return start
+	}
+	//反向遍历从前缀的上界和上界中较小的一个开始
+	if len(opts.Prefix) > 0 {
+		start = prefixEnd(opts.Prefix)
+	}
+	if opts.UpperBound != nil && (start == nil || bytes.Compare(opts.UpperBound, start) < 0) {
+		start = opts.UpperBound
+	}
+	return start
+}
+
+// 将Seek的位置限制在遍历的范围之内，避免从范围之外逐个跳过
+func (opts IteratorOptions) clampSeekKey(key []byte) []byte {
+	start := opts.startKey()
+	if start == nil {
+		return key
+	}
+	cmp := bytes.Compare(key, start)
+	if (!opts.Reverse && cmp < 0) || (opts.Reverse && cmp > 0) {
+		return start
+	}
+	return key
+}
+
+// 检查key是否在遍历的范围之内
+// skip表示key在遍历起点之前需要跳过，stop表示key已经超出了遍历的终点
+func (opts IteratorOptions) checkKey(key []byte) (skip bool, stop bool) {
+	belowLower, aboveUpper := false, false
+	if opts.LowerBound != nil {
+		cmp := bytes.Compare(key, opts.LowerBound)
+		belowLower = cmp < 0 || (cmp == 0 && opts.ExcludeLowerBound)
+	}
+	if opts.UpperBound != nil {
+		cmp := bytes.Compare(key, opts.UpperBound)
+		aboveUpper = cmp > 0 || (cmp == 0 && !opts.IncludeUpperBound)
+	}
+	if len(opts.Prefix) > 0 && !bytes.HasPrefix(key, opts.Prefix) {
+		if bytes.Compare(key, opts.Prefix) < 0 {
+			belowLower = true
+		} else {
+			aboveUpper = true
+		}
+	}
+	if opts.Reverse {
+		return aboveUpper, belowLower
 	}
+	return belowLower, aboveUpper
 }
@@ -93,3 +93,66 @@ func TestDB_Iterator_Multi_Value(t *testing.T) {
 		t.Log("key=", string(iter3.Key()))
 	}
 }
+
+func TestDB_Iterator_Bounds(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-iterator-bounds")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for _, key := range []string{"a1", "a2", "a3", "b1", "b2", "c1"} {
+		err := db.Put([]byte(key), []byte(key))
+		assert.Nil(t, err)
+	}
+	collect := func(opts IteratorOptions) []string {
+		var keys []string
+		err := db.Scan(opts, func(key []byte, value []byte) bool {
+			if opts.KeysOnly {
+				assert.Nil(t, value)
+			} else {
+				assert.Equal(t, key, value)
+			}
+			keys = append(keys, string(key))
+			return true
+		})
+		assert.Nil(t, err)
+		return keys
+	}
+
+	//默认包含下界，不包含上界
+	iterOpts := DefalutIteratorOptinos
+	iterOpts.LowerBound = []byte("a2")
+	iterOpts.UpperBound = []byte("b2")
+	assert.Equal(t, []string{"a2", "a3", "b1"}, collect(iterOpts))
+	iterOpts.ExcludeLowerBound = true
+	iterOpts.IncludeUpperBound = true
+	assert.Equal(t, []string{"a3", "b1", "b2"}, collect(iterOpts))
+	iterOpts.Reverse = true
+	assert.Equal(t, []string{"b2", "b1", "a3"}, collect(iterOpts))
+
+	//前缀和范围同时生效
+	iterOpts = DefalutIteratorOptinos
+	iterOpts.Prefix = []byte("b")
+	iterOpts.LowerBound = []byte("a")
+	assert.Equal(t, []string{"b1", "b2"}, collect(iterOpts))
+	iterOpts.Reverse = true
+	assert.Equal(t, []string{"b2", "b1"}, collect(iterOpts))
+
+	//限制数量并且只遍历key
+	iterOpts = DefalutIteratorOptinos
+	iterOpts.Limit = 2
+	iterOpts.KeysOnly = true
+	assert.Equal(t, []string{"a1", "a2"}, collect(iterOpts))
+
+	//Seek不会越过范围
+	iterOpts = DefalutIteratorOptinos
+	iterOpts.LowerBound = []byte("b")
+	iter := db.NewIterator(iterOpts)
+	iter.Seek([]byte("a"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("b1"), iter.Key())
+	iter.Close()
+}
@@ -2,13 +2,18 @@ package bitcask_go
 
 import (
 	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/index"
 	"bitcask-go/utils"
+	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -17,12 +22,14 @@ const (
 )
 
 // Merge清理无效数据，生成Hint文件
+// merge完成之后会在线替换旧的数据文件，不需要重启数据库
 func (db *DB) Merge() error {
+	db.mu.Lock()
 	//如果数据库为空，则直接返回
 	if db.activeFile == nil {
+		db.mu.Unlock()
 		return nil
 	}
-	db.mu.Lock()
 	//如果merge正在进行中，则直接返回
 	if db.isMergeing {
 		db.mu.Unlock()
@@ -34,6 +41,8 @@ func (db *DB) Merge() error {
 		db.mu.Unlock()
 		return err
 	}
+	//blob文件不参与merge
+	totalSize -= db.blobFilesSize()
 	if float32(db.reclaimSize)/float32(totalSize) < db.options.DataFileMergeRatio {
 		db.mu.Unlock()
 		return ErrMergeRationUnreached
@@ -50,20 +59,15 @@ func (db *DB) Merge() error {
 	}
 	db.isMergeing = true
 	defer func() {
+		db.mu.Lock()
 		db.isMergeing = false
+		db.mu.Unlock()
 	}()
-	//持久化当前活跃文件
-	if err := db.activeFile.Sync(); err != nil {
+	//持久化当前活跃文件，转换为旧的数据文件并打开新的活跃文件
+	if err := db.rotateActiveFile(); err != nil {
 		db.mu.Unlock()
 		return err
 	}
-	//将当前活跃文件转换为旧的活跃文件
-	db.olderFiles[db.activeFile.FileId] = db.activeFile
-	//打开新的活跃文件
-	if err := db.setActiveDataFile(); err != nil {
-		db.mu.Unlock()
-		return nil
-	}
 	//记录最近没有参与merge的文件id
 	nonMergeFileId := db.activeFile.FileId
 	//取出所有需要merge的文件
@@ -71,7 +75,15 @@ func (db *DB) Merge() error {
 	for _, file := range db.olderFiles {
 		mergeFiles = append(mergeFiles, file)
 	}
+	//merge期间新建的列族在待merge的文件中不会有数据
+	families := make(map[uint32]*ColumnFamily, len(db.families))
+	for familyId, cf := range db.families {
+		families[familyId] = cf
+	}
+	//merge期间blob文件不会被回收，之后新建的blob文件不会被待merge的文件引用
+	blobFiles := db.pinBlobFiles()
 	db.mu.Unlock()
+	defer db.unpinFiles(blobFiles)
 
 	//待merge的文件从小到大进行排序，依次merge
 	sort.Slice(mergeFiles, func(i, j int) bool {
@@ -88,18 +100,68 @@ func (db *DB) Merge() error {
 	if err := os.MkdirAll(mergePath, os.ModePerm); err != nil {
 		return err
 	}
+	fileNum, err := db.writeMergeFiles(mergeFiles, families, blobFiles, mergePath)
+	if err != nil {
+		return err
+	}
+
+	//将merge之后的文件替换到数据目录中，期间阻塞写入
+	db.mu.Lock()
+	if err := db.applyMergeFiles(mergePath, nonMergeFileId, fileNum); err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	//布隆过滤器无法删除key，merge之后重建
+	for _, cf := range db.families {
+		if bpt, ok := cf.index.(*index.BPlusTree); ok {
+			bpt.RebuildBloomFilter()
+		}
+	}
+	db.mergeHorizon = nonMergeFileId
+	db.mu.Unlock()
+	//merge只重写blob记录的位置，使用之前的密钥加密的blob文件需要单独重写
+	return db.reencryptBlobFiles()
+}
+
+// 将需要merge的文件中的有效数据重写到merge目录中，并生成Hint文件，返回merge之后的数据文件数量
+// merge目录中的数据文件id从0开始，替换到数据目录中时再分配新的文件id
+func (db *DB) writeMergeFiles(mergeFiles []*data.DataFile, families map[uint32]*ColumnFamily,
+	blobFiles map[uint32]*data.DataFile, mergePath string) (uint32, error) {
 	//打开一个新的临时bitcask实例
+	//临时实例只用于写数据文件，使用内存索引即可
 	mergeOptions := db.options
 	mergeOptions.DirPath = mergePath
 	mergeOptions.SyncWrites = false
+	mergeOptions.IndexType = BTree
+	mergeOptions.AutoMergeInterval = 0
+	//blob记录的位置直接重写，不会在merge目录中生成blob文件
+	mergeOptions.BlobValueThreshold = 0
 	mergeDB, err := Open(mergeOptions)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer func() {
+		_ = mergeDB.Close()
+	}()
 	//打开Hint文件存储索引
 	hintFile, err := data.OpenHintFile(mergePath)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	hintFile.Cipher = db.cipher
+	defer func() {
+		_ = hintFile.Close()
+	}()
+	now := time.Now().UnixNano()
+	fileMap := make(map[uint32]*data.DataFile, len(mergeFiles))
+	for _, dataFile := range mergeFiles {
+		fileMap[dataFile.FileId] = dataFile
+	}
+	getDataFile := func(fid uint32) *data.DataFile {
+		return fileMap[fid]
+	}
+	getBlobFile := func(fid uint32) *data.DataFile {
+		return blobFiles[fid]
 	}
 	//遍历处理每个数据文件
 	for _, dataFile := range mergeFiles {
@@ -110,24 +172,45 @@ func (db *DB) Merge() error {
 				if err == io.EOF {
 					break
 				}
-				return err
+				return 0, err
 			}
 			//解析拿到实际的key
 			realKey, _ := parseLogRecordKey(logRecord.Key)
-			logRecordPos := db.index.Get(realKey)
+			cf := families[logRecord.FamilyId]
+			if cf == nil {
+				return 0, ErrDataDirectoryCorrupted
+			}
+			logRecordPos := cf.index.Get(realKey)
 			//和内存中的索引位置进行比较，如果有效则重写
+			//范围删除的记录和被其覆盖的数据都不在索引中，会被直接丢弃
 			if logRecordPos != nil &&
 				logRecordPos.Fid == dataFile.FileId &&
 				logRecordPos.Offset == offset {
+				//已经过期的数据不再重写，在Hint文件中标记为删除，替换文件时从索引中删除
+				if logRecord.IsExpired(now) {
+					if err := hintFile.WriteHintDeletedRecord(realKey, logRecord.FamilyId); err != nil {
+						return 0, err
+					}
+					offset += size
+					continue
+				}
+				//合并操作数的链表合并为完整的值，之前的记录不再需要
+				if logRecord.Type == data.LogRecordMergeOperand {
+					value, err := db.readValue(getDataFile, getBlobFile, logRecordPos)
+					if err != nil {
+						return 0, err
+					}
+					logRecord.Value, logRecord.Type = value, data.LogRecordNormal
+				}
 				//清除事务标记
 				logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
 				pos, err := mergeDB.appendLogRecord(logRecord)
 				if err != nil {
-					return err
+					return 0, err
 				}
 				//将当前位置索引写到Hint文件当中
-				if err := hintFile.WriteHintRecord(realKey, pos); err != nil {
-					return err
+				if err := hintFile.WriteHintRecord(realKey, logRecord.FamilyId, pos); err != nil {
+					return 0, err
 				}
 			}
 			offset += size
@@ -135,28 +218,76 @@ func (db *DB) Merge() error {
 	}
 	//sync保证持久化
 	if err := hintFile.Sync(); err != nil {
-		return err
+		return 0, err
 	}
 	if err := mergeDB.Sync(); err != nil {
+		return 0, err
+	}
+	if mergeDB.activeFile == nil {
+		return 0, nil
+	}
+	return mergeDB.activeFile.FileId + 1, nil
+}
+
+// 在线替换merge完成的数据文件，关闭并删除被merge的旧数据文件，打开新的数据文件并更新内存索引
+// merge之后的数据文件使用比活跃文件更大的新文件id，不会和被merge的文件id重复
+// 在访问此方法前必须得有互斥锁
+func (db *DB) applyMergeFiles(mergePath string, nonMergeFileId uint32, fileNum uint32) error {
+	info := &mergeInfo{
+		nonMergeFileId: nonMergeFileId,
+		baseFileId:     db.activeFile.FileId + 1,
+		fileNum:        fileNum,
+	}
+	//列族文件只会追加写入，加密时和数据文件一起替换，之前的密钥不再需要
+	if db.cipher != nil {
+		if err := db.writeColumnFamilies(mergePath); err != nil {
+			return err
+		}
+	}
+	//写标识merge完成的文件，之后崩溃重启时会继续替换
+	if err := db.writeMergeInfo(mergePath, info); err != nil {
 		return err
 	}
-	//写标识merge完成的文件
-	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath)
-	if err != nil {
+	//关闭已经参与merge的旧数据文件，如果还有事务在引用则延迟关闭
+	for fid, dataFile := range db.olderFiles {
+		if fid >= nonMergeFileId {
+			continue
+		}
+		delete(db.olderFiles, fid)
+		if err := db.closeObsoleteFile(dataFile); err != nil {
+			return err
+		}
+	}
+	//旧数据文件的统计信息不再需要，merge之后的文件在更新索引时重新统计
+	var mergedFids []uint32
+	for fid := range db.fileStats {
+		if fid < nonMergeFileId {
+			mergedFids = append(mergedFids, fid)
+		}
+	}
+	db.removeFileStats(mergedFids)
+	if err := db.moveMergeFiles(mergePath, info); err != nil {
 		return err
 	}
-	mergeFinRecord := &data.LogRecord{
-		Key:   []byte(mergeFinishedKey),
-		Value: []byte(strconv.Itoa(int(nonMergeFileId))),
+	//打开merge之后的数据文件
+	for fid := info.baseFileId; fid < info.baseFileId+info.fileNum; fid++ {
+		dataFile, err := data.OpenDataFile(db.options.DirPath, fid, fio.StandardFIO)
+		if err != nil {
+			return err
+		}
+		dataFile.Cipher = db.cipher
+		db.olderFiles[fid] = dataFile
 	}
-	encRecord, _ := data.EncodeLogRecord(mergeFinRecord)
-	if err := mergeFinishedFile.Write(encRecord); err != nil {
+	//活跃文件的id需要大于merge之后的数据文件，之后写入的数据在重启时才会在merge的数据之后加载
+	if err := db.rotateActiveFile(); err != nil {
 		return err
 	}
-	if err := mergeFinishedFile.Sync(); err != nil {
+	db.mergeInfo = info
+	//更新内存索引中仍然指向旧数据文件的位置
+	if err := db.updateIndexFromHintFile(info); err != nil {
 		return err
 	}
-	return nil
+	return os.RemoveAll(mergePath)
 }
 
 func (db *DB) getMergePath() string {
@@ -175,68 +306,160 @@ func (db *DB) loadMergeFiles() error {
 	defer func() {
 		_ = os.RemoveAll(mergePath)
 	}()
-	dirEntries, err := os.ReadDir(mergePath)
-	if err != nil {
-		return err
-	}
-	//查看表示Merge完成的文件，判断merge是否完成了
-	var mergeFinished bool
-	var mergeFileName []string
-	for _, entry := range dirEntries {
-		if entry.Name() == data.MergeFinishedFileName {
-			mergeFinished = true
-		}
-		if entry.Name() == data.SeqNoFileName {
-			continue
-		}
-		if entry.Name() == fileLockName {
-			continue
-		}
-		mergeFileName = append(mergeFileName, entry.Name())
-	}
-	//没有merge完成直接返回
-	if !mergeFinished {
+	//查看表示Merge完成的文件，判断merge是否完成了，没有merge完成直接返回
+	if _, err := os.Stat(filepath.Join(mergePath, data.MergeFinishedFileName)); os.IsNotExist(err) {
 		return nil
 	}
-	nonMergeFileId, err := db.getNoMergeFileId(mergePath)
+	info, err := db.readMergeInfo(mergePath)
 	if err != nil {
 		return nil
 	}
+	if err := db.moveMergeFiles(mergePath, info); err != nil {
+		return err
+	}
+	//B+树索引是持久化的，需要更新其中指向旧数据文件的位置
+	return db.updateIndexFromHintFile(info)
+}
+
+// 删除已经参与merge的旧数据文件，并将merge目录中的文件移动到数据目录中
+// merge目录中的数据文件id加上baseFileId之后作为新的文件id，并创建id更大的空数据文件作为之后的活跃文件
+// 标识merge完成的文件最后移动，保证中途崩溃之后重启时可以重新执行
+func (db *DB) moveMergeFiles(mergePath string, info *mergeInfo) error {
+	dirEntries, err := os.ReadDir(mergePath)
+	if err != nil {
+		return err
+	}
 	//删除旧的数据文件
 	var fileId uint32 = 0
-	for ; fileId < nonMergeFileId; fileId++ {
+	for ; fileId < info.nonMergeFileId; fileId++ {
 		fileName := data.GetDataFileName(db.options.DirPath, fileId)
 		if _, err := os.Stat(fileName); err == nil {
 			if err := os.Remove(fileName); err != nil {
 				return err
 			}
 		}
+		hintFileName := data.GetDataHintFileName(db.options.DirPath, fileId)
+		if err := os.Remove(hintFileName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
 	//将新的数据文件移动到数据目录中
-	for _, fileName := range mergeFileName {
+	for _, entry := range dirEntries {
+		fileName := entry.Name()
+		if fileName == data.SeqNoFileName || fileName == fileLockName || fileName == data.MergeFinishedFileName {
+			continue
+		}
+		//merge之后的数据文件从Hint文件中加载索引，不需要数据文件的hint文件
+		if strings.HasSuffix(fileName, data.DataHintFileSuffix) {
+			continue
+		}
 		srcPath := filepath.Join(mergePath, fileName)
 		destPath := filepath.Join(db.options.DirPath, fileName)
+		if strings.HasSuffix(fileName, data.DataFileNameSuffix) {
+			fileId, err := strconv.Atoi(strings.Split(fileName, ".")[0])
+			if err != nil {
+				return ErrDataDirectoryCorrupted
+			}
+			destPath = data.GetDataFileName(db.options.DirPath, info.baseFileId+uint32(fileId))
+		}
 		if err := os.Rename(srcPath, destPath); err != nil {
 			return err
 		}
 	}
-	return nil
+	activeFile, err := data.OpenDataFile(db.options.DirPath, info.baseFileId+info.fileNum, fio.StandardFIO)
+	if err != nil {
+		return err
+	}
+	if err := activeFile.Close(); err != nil {
+		return err
+	}
+	srcPath := filepath.Join(mergePath, data.MergeFinishedFileName)
+	destPath := filepath.Join(db.options.DirPath, data.MergeFinishedFileName)
+	return os.Rename(srcPath, destPath)
+}
+
+// merge完成之后的信息，保存在标识merge完成的文件中
+type mergeInfo struct {
+	nonMergeFileId uint32 //没有参与merge的最小文件id，之前的数据文件都已经被merge
+	baseFileId     uint32 //merge之后的第一个数据文件id，Hint文件中的文件id需要加上此值
+	fileNum        uint32 //merge之后的数据文件数量
 }
 
-func (db *DB) getNoMergeFileId(dirPath string) (uint32, error) {
+// 判断数据文件是否是merge生成的，这些文件的索引从Hint文件中加载
+func (info *mergeInfo) isMergeFile(fid uint32) bool {
+	return info != nil && fid >= info.baseFileId && fid < info.baseFileId+info.fileNum
+}
+
+// 将Hint文件中的位置转换为数据目录中的位置
+func (info *mergeInfo) hintPos(pos *data.LogRecordPos) *data.LogRecordPos {
+	if info != nil {
+		pos.Fid += info.baseFileId
+	}
+	return pos
+}
+
+// 编码merge完成的信息，nonMergeFileId,baseFileId,fileNum
+func (info *mergeInfo) encode() []byte {
+	return []byte(fmt.Sprintf("%d,%d,%d", info.nonMergeFileId, info.baseFileId, info.fileNum))
+}
+
+// 解码merge完成的信息
+// 之前的版本只保存了nonMergeFileId，merge之后的数据文件使用被merge的文件id
+func decodeMergeInfo(value []byte) (*mergeInfo, error) {
+	parts := strings.Split(string(value), ",")
+	if len(parts) != 1 && len(parts) != 3 {
+		return nil, ErrDataDirectoryCorrupted
+	}
+	var fids []uint32
+	for _, part := range parts {
+		fid, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		fids = append(fids, uint32(fid))
+	}
+	if len(fids) == 1 {
+		return &mergeInfo{nonMergeFileId: fids[0], fileNum: fids[0]}, nil
+	}
+	return &mergeInfo{nonMergeFileId: fids[0], baseFileId: fids[1], fileNum: fids[2]}, nil
+}
+
+// 读取目录中标识merge完成的文件
+func (db *DB) readMergeInfo(dirPath string) (*mergeInfo, error) {
 	mergeFinishedFile, err := data.OpenMergeFinishedFile(dirPath)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	mergeFinishedFile.Cipher = db.cipher
+	defer func() {
+		_ = mergeFinishedFile.Close()
+	}()
 	record, _, err := mergeFinishedFile.ReadLogRecord(0)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	nonMergeFileId, err := strconv.Atoi(string(record.Value))
+	return decodeMergeInfo(record.Value)
+}
+
+// 在目录中写标识merge完成的文件
+func (db *DB) writeMergeInfo(dirPath string, info *mergeInfo) error {
+	mergeFinishedFile, err := data.OpenMergeFinishedFile(dirPath)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	mergeFinishedFile.Cipher = db.cipher
+	defer func() {
+		_ = mergeFinishedFile.Close()
+	}()
+	mergeFinRecord := &data.LogRecord{
+		Key:   []byte(mergeFinishedKey),
+		Value: info.encode(),
+	}
+	encRecord, _ := data.EncodeLogRecord(mergeFinRecord)
+	if err := mergeFinishedFile.Write(encRecord); err != nil {
+		return err
 	}
-	return uint32(nonMergeFileId), nil
+	return mergeFinishedFile.Sync()
 }
 
 // 从hint文件中加载索引
@@ -251,7 +474,9 @@ func (db *DB) loadIndexFromHintFile() error {
 	if err != nil {
 		return err
 	}
+	hintFile.Cipher = db.cipher
 	//读取文件中的索引
+	now := time.Now().UnixNano()
 	var offset int64 = 0
 	for {
 		logRecord, size, err := hintFile.ReadLogRecord(offset)
@@ -261,9 +486,78 @@ func (db *DB) loadIndexFromHintFile() error {
 			}
 			return err
 		}
+		//merge时已经过期的数据没有重写，不需要加载
+		if logRecord.Type == data.LogRecordDeleted {
+			offset += size
+			continue
+		}
+		familyIndex, err := db.getFamilyIndex(logRecord.FamilyId)
+		if err != nil {
+			return err
+		}
+		//范围删除需要删除之前加载的范围内的key
+		if logRecord.Type == data.LogRecordRangeDeleted {
+			db.deleteIndexRange(familyIndex, logRecord.Key, logRecord.Value)
+			offset += size
+			continue
+		}
 		//解码拿到实际的位置索引
-		pos := data.DecodeLogRecordPos(logRecord.Value)
-		db.index.Put(logRecord.Key, pos)
+		pos := db.mergeInfo.hintPos(data.DecodeLogRecordPos(logRecord.Value))
+		if pos.IsExpired(now) {
+			db.markGarbage(pos)
+		} else {
+			familyIndex.Put(logRecord.Key, pos)
+			db.markLive(pos)
+		}
+		offset += size
+	}
+	return nil
+}
+
+// 根据数据目录中的hint文件，将内存索引中仍然指向已merge文件的位置更新为merge之后的位置
+// 指向更新文件的key说明在merge期间被重新写入或删除了，不需要更新
+func (db *DB) updateIndexFromHintFile(info *mergeInfo) error {
+	hintFileName := filepath.Join(db.options.DirPath, data.HintFileName)
+	if _, err := os.Stat(hintFileName); os.IsNotExist(err) {
+		return nil
+	}
+	hintFile, err := data.OpenHintFile(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	hintFile.Cipher = db.cipher
+	defer func() {
+		_ = hintFile.Close()
+	}()
+	var offset int64 = 0
+	for {
+		logRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		familyIndex, err := db.getFamilyIndex(logRecord.FamilyId)
+		if err != nil {
+			return err
+		}
+		if logRecord.Type == data.LogRecordRangeDeleted {
+			offset += size
+			continue
+		}
+		oldPos := familyIndex.Get(logRecord.Key)
+		switch {
+		case oldPos != nil && oldPos.Fid < info.nonMergeFileId && logRecord.Type == data.LogRecordDeleted:
+			familyIndex.Delete(logRecord.Key)
+		case oldPos != nil && oldPos.Fid < info.nonMergeFileId:
+			pos := info.hintPos(data.DecodeLogRecordPos(logRecord.Value))
+			familyIndex.Put(logRecord.Key, pos)
+			db.markLive(pos)
+		case logRecord.Type != data.LogRecordDeleted:
+			//merge期间key被重新写入或删除了，重写的数据是无效的
+			db.markGarbage(info.hintPos(data.DecodeLogRecordPos(logRecord.Value)))
+		}
 		offset += size
 	}
 	return nil
@@ -0,0 +1,144 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"time"
+)
+
+// MergeOperator 合并操作，用于实现不需要先读取的读-改-写
+// MergeValue写入的操作数在读取时才会合并到已有的值上，merge时会被合并为完整的值
+type MergeOperator interface {
+	// Merge将操作数按照写入的顺序依次合并到已有的值上，existing为nil表示key不存在
+	Merge(key []byte, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// MergeValue 写入key的一个合并操作数，需要在Options中配置MergeOperator
+func (db *DB) MergeValue(key []byte, operand []byte) error {
+	return db.mergeValue(db.defaultFamily, key, operand)
+}
+
+// 写入指定列族中key的一个合并操作数
+func (db *DB) mergeValue(cf *ColumnFamily, key []byte, operand []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if db.options.MergeOperator == nil {
+		return ErrMergeOperatorNotSet
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	prevPos := cf.index.Get(key)
+	//已经过期的值不再参与合并，空间可以被merge回收
+	if prevPos != nil && prevPos.IsExpired(time.Now().UnixNano()) {
+		cf.index.Delete(key)
+		db.markStale(prevPos)
+		prevPos = nil
+	}
+	//merge期间写入的操作数指向的旧数据文件会被删除，直接合并为完整的值写入
+	if db.isMergeing {
+		var existing []byte
+		if prevPos != nil {
+			value, err := db.getValueByPosition(prevPos)
+			if err != nil && err != ErrKeyNotFound {
+				return err
+			}
+			existing = value
+		}
+		value, err := db.options.MergeOperator.Merge(key, existing, [][]byte{operand})
+		if err != nil {
+			return err
+		}
+		pos, err := db.appendLogRecord(&data.LogRecord{
+			Key:      logRecordKeyWithSeq(key, nonTransactionSeqNo),
+			Value:    value,
+			Type:     data.LogRecordNormal,
+			FamilyId: cf.id,
+		})
+		if err != nil {
+			return err
+		}
+		db.markLive(pos)
+		if oldPos := cf.index.Put(key, pos); oldPos != nil {
+			db.markStale(oldPos)
+		}
+		db.notifyWrite(cf.id, &WatchEvent{Type: WatchMerge, Key: key, Value: operand})
+		return nil
+	}
+	//操作数记录指向key之前的记录，读取时沿着链表依次合并
+	pos, err := db.appendLogRecord(&data.LogRecord{
+		Key:      logRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Value:    data.EncodeMergeOperand(prevPos, operand),
+		Type:     data.LogRecordMergeOperand,
+		FamilyId: cf.id,
+	})
+	if err != nil {
+		return err
+	}
+	//之前的记录仍然需要被读取，不是无效数据，记录到整个链表的大小中
+	if prevPos != nil {
+		pos.Size += prevPos.Size
+		pos.Prev = prevPos
+		db.markReferenced(prevPos)
+	}
+	cf.index.Put(key, pos)
+	db.markLive(pos)
+	db.notifyWrite(cf.id, &WatchEvent{Type: WatchMerge, Key: key, Value: operand})
+	return nil
+}
+
+// 从数据文件中读取索引信息对应的value，合并操作数的记录需要沿着链表读取之前的记录
+// value存储在blob文件中时从getBlobFile返回的blob文件中读取
+func (db *DB) readValue(getDataFile func(fid uint32) *data.DataFile, getBlobFile func(fid uint32) *data.DataFile,
+	logRecordPos *data.LogRecordPos) ([]byte, error) {
+	now := time.Now().UnixNano()
+	var operands [][]byte
+	var key []byte
+	for logRecordPos != nil {
+		dataFile := getDataFile(logRecordPos.Fid)
+		//数据文件为空
+		if dataFile == nil {
+			return nil, ErrDataFileNotFound
+		}
+		//根据偏移读取对应的数据
+		logRecord, _, err := dataFile.ReadLogRecord(logRecordPos.Offset)
+		if err != nil {
+			return nil, err
+		}
+		if logRecord.Type != data.LogRecordMergeOperand {
+			var existing []byte
+			if logRecord.Type == data.LogRecordNormal && !logRecord.IsExpired(now) {
+				existing = logRecord.Value
+				if logRecord.Blob {
+					if existing, err = readBlobValue(getBlobFile, logRecord); err != nil {
+						return nil, err
+					}
+				}
+			}
+			if len(operands) == 0 {
+				if existing == nil {
+					return nil, ErrKeyNotFound
+				}
+				return existing, nil
+			}
+			return db.fullMerge(key, existing, operands)
+		}
+		if key == nil {
+			key, _ = parseLogRecordKey(logRecord.Key)
+		}
+		var operand []byte
+		logRecordPos, operand = data.DecodeMergeOperand(logRecord.Value)
+		operands = append(operands, operand)
+	}
+	return db.fullMerge(key, nil, operands)
+}
+
+// 将倒序读取到的操作数按照写入的顺序合并到已有的值上
+func (db *DB) fullMerge(key []byte, existing []byte, operands [][]byte) ([]byte, error) {
+	if db.options.MergeOperator == nil {
+		return nil, ErrMergeOperatorNotSet
+	}
+	for i, j := 0, len(operands)-1; i < j; i, j = i+1, j-1 {
+		operands[i], operands[j] = operands[j], operands[i]
+	}
+	return db.options.MergeOperator.Merge(key, existing, operands)
+}
@@ -0,0 +1,107 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 计数器，操作数为需要累加的值
+type counterMergeOperator struct{}
+
+func (counterMergeOperator) Merge(key []byte, existing []byte, operands [][]byte) ([]byte, error) {
+	var sum int
+	if existing != nil {
+		n, err := strconv.Atoi(string(existing))
+		if err != nil {
+			return nil, err
+		}
+		sum = n
+	}
+	for _, operand := range operands {
+		n, err := strconv.Atoi(string(operand))
+		if err != nil {
+			return nil, err
+		}
+		sum += n
+	}
+	return []byte(strconv.Itoa(sum)), nil
+}
+
+func TestDB_MergeValue(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-value")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.MergeValue(utils.GetTestKey(1), []byte("1"))
+	assert.Equal(t, ErrMergeOperatorNotSet, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	opts.MergeOperator = counterMergeOperator{}
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	//没有初始值的key
+	for i := 0; i < 100; i++ {
+		err := db.MergeValue(utils.GetTestKey(1), []byte("1"))
+		assert.Nil(t, err)
+	}
+	//在已有值上合并
+	err = db.Put(utils.GetTestKey(2), []byte("10"))
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err := db.MergeValue(utils.GetTestKey(2), []byte("2"))
+		assert.Nil(t, err)
+	}
+	//删除之后重新开始计数
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	err = db.MergeValue(utils.GetTestKey(1), []byte("5"))
+	assert.Nil(t, err)
+
+	check := func(db *DB) {
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("5"), val)
+		val, err = db.Get(utils.GetTestKey(2))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("210"), val)
+	}
+	check(db)
+
+	//重启之后从数据文件中重建操作数的链表
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	check(db)
+
+	//merge之后操作数被合并为完整的值
+	err = db.Merge()
+	assert.Nil(t, err)
+	check(db)
+	err = db.MergeValue(utils.GetTestKey(2), []byte("-10"))
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("200"), val)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	val, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("200"), val)
+	err = db.Close()
+	assert.Nil(t, err)
+}
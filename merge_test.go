@@ -0,0 +1,165 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Merge_Online(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-online")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	//重复写入，产生无效数据
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	sizeBefore, _ := utils.DirSize(dir)
+	filesBefore := db.Stat().DataFileNum
+
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	//不需要重启，旧的数据文件已经被替换
+	sizeAfter, _ := utils.DirSize(dir)
+	assert.Less(t, sizeAfter, sizeBefore)
+	assert.Less(t, db.Stat().DataFileNum, filesBefore)
+	assert.Equal(t, int64(0), db.Stat().ReclaimableSize)
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+
+	//merge之后继续写入，重启之后数据依然有效
+	err = db.Put(utils.GetTestKey(1), utils.GetTestKey(1001))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer db2.Close()
+	assert.Equal(t, 1000, len(db2.ListKeys()))
+	val, err := db2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1001), val)
+	val, err = db2.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(999), val)
+}
+
+func TestDB_Merge_FreshFileIds(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-fids")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	maxFidBefore := db.activeFile.FileId
+
+	//merge期间继续写入，写入的数据在merge之后的数据文件中仍然是最新的
+	expected := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		expected[string(utils.GetTestKey(i))] = utils.GetTestKey(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			value := utils.RandomValue(16)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), value))
+			expected[string(utils.GetTestKey(i))] = value
+		}
+	}()
+	assert.Nil(t, db.Merge())
+	<-done
+
+	//merge之后的数据文件使用新的文件id，不会和被merge的文件重复
+	for fid := range db.olderFiles {
+		if fid < db.mergeInfo.nonMergeFileId {
+			t.Fatalf("merged data file %d was not removed", fid)
+		}
+		if db.mergeInfo.isMergeFile(fid) {
+			assert.Greater(t, fid, maxFidBefore)
+		}
+	}
+	assert.Greater(t, db.activeFile.FileId, db.mergeInfo.baseFileId+db.mergeInfo.fileNum-1)
+	for key, value := range expected {
+		val, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+	assert.Nil(t, db.Close())
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer db2.Close()
+	assert.Equal(t, 1000, len(db2.ListKeys()))
+	for key, value := range expected {
+		val, err := db2.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
+
+func TestDB_Merge_Iterator(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-iterator")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+
+	//迭代器引用了创建时的数据文件，merge删除旧的数据文件之后仍然可以读取
+	iterator := db.NewIterator(DefalutIteratorOptinos)
+	assert.Nil(t, db.Merge())
+	var count int
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		value, err := iterator.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, iterator.Key(), value)
+		count++
+	}
+	assert.Equal(t, 1000, count)
+	iterator.Close()
+	assert.Empty(t, db.fileRefs)
+	assert.Empty(t, db.obsoleteFiles)
+	assert.Nil(t, db.Close())
+}
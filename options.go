@@ -1,15 +1,51 @@
 package bitcask_go
 
-import "os"
+import (
+	"os"
+	"time"
+)
 
 type Options struct {
-	DirPath            string      //数据哭数据目录
-	DataFileSize       int64       //数据文件的大小
-	SyncWrites         bool        //每次写数据是否持久化
-	BytesPerSync       uint        //累计写到多少字节后进行持久化
-	IndexType          IndexerType //索引类型
-	MMapAtStartup      bool        //启动时是否使用mmap加载数据
-	DataFileMergeRatio float32     //数据文件合并的数据
+	DirPath            string        //数据哭数据目录
+	DataFileSize       int64         //数据文件的大小
+	SyncWrites         bool          //每次写数据是否持久化
+	BytesPerSync       uint          //累计写到多少字节后进行持久化
+	IndexType          IndexerType   //索引类型
+	MMapAtStartup      bool          //启动时是否使用mmap加载数据
+	DataFileMergeRatio float32       //数据文件合并的数据
+	MergeOperator      MergeOperator //MergeValue使用的合并操作，为空时不能使用MergeValue
+	//后台自动merge的检查间隔，为0表示不开启自动merge
+	AutoMergeInterval time.Duration
+	//允许自动merge的时间段，为距离当天零点的时间，开始大于结束表示跨越零点，都为0表示不限制
+	AutoMergeWindowStart time.Duration
+	AutoMergeWindowEnd   time.Duration
+	//自动merge需要的最少可回收数据量，字节为单位
+	AutoMergeMinReclaimSize int64
+	//自动merge失败时调用，为空时记录到标准日志中，失败之后重试的间隔会成倍增加
+	AutoMergeErrorHook func(err error)
+	//启动时并行解码数据文件的数量，小于等于0表示使用CPU核数
+	IndexLoadParallelism int
+	//启动时截断了数据文件中不完整或者损坏的数据之后调用，为空时记录到标准日志中
+	RecoveryHook func(info RecoveryInfo)
+	//数据文件中间有损坏的记录时，丢弃这条记录之后的数据，默认打开数据库会返回错误
+	TruncateCorruptedFiles bool
+	//是否使用flate压缩写入的value，压缩和未压缩的记录可以共存
+	Compression bool
+	//需要压缩的value的最小长度，字节为单位
+	CompressionMinSize int
+	//加密数据文件、hint文件等记录的AES密钥，长度为16、24或32字节，为空表示新写入的记录不加密
+	//B+树索引文件不会加密，配置了密钥时不能使用B+树索引
+	EncryptionKey []byte
+	//之前使用的密钥，只用于读取，merge之后所有的数据会使用EncryptionKey重新加密
+	PreviousEncryptionKeys [][]byte
+	//value长度大于等于此值时存储到单独的blob文件中，数据文件中只保存blob记录的位置，为0表示不分离
+	BlobValueThreshold int
+	//blob文件的大小
+	BlobFileSize int64
+	//按照value的位置缓存读取到的value，缓存可以使用的内存大小，字节为单位，为0表示不缓存
+	ReadCacheSize int64
+	//B+树索引使用布隆过滤器快速判断key不存在，此值为过滤器的误判率，为0表示不使用
+	BloomFilterFalsePositiveRate float64
 }
 
 // IteratorOptions索引迭代器配置项
@@ -18,6 +54,18 @@ type IteratorOptions struct {
 	Prefix []byte
 	//是否反向遍历，默认为false是正向
 	Reverse bool
+	//遍历的下界，为空表示没有下界，默认包含下界
+	LowerBound []byte
+	//是否不包含下界
+	ExcludeLowerBound bool
+	//遍历的上界，为空表示没有上界，默认不包含上界
+	UpperBound []byte
+	//是否包含上界
+	IncludeUpperBound bool
+	//只遍历key，Value不会读取数据文件
+	KeysOnly bool
+	//最多遍历的key数量，为0表示不限制
+	Limit int
 }
 
 // WriteBatchOptions批量配置项
@@ -27,6 +75,14 @@ type WriteBatchOptions struct {
 	//提交时查看sync持久化
 	SyncWrites bool
 }
+
+// FsckOptions离线检查数据目录的配置项
+type FsckOptions struct {
+	//数据目录使用的密钥，为空时加密的记录只校验crc，无法解密
+	EncryptionKey []byte
+	//之前使用的密钥，需要和打开数据目录时的配置相同
+	PreviousEncryptionKeys [][]byte
+}
 type IndexerType = int8
 
 const (
@@ -34,7 +90,7 @@ const (
 	BTree IndexerType = iota + 1
 	//ART索引类型
 	ART
-	//B+树索引，将索引存储到磁盘上
+	//B+树索引，将索引存储到磁盘上，不支持快照和事务
 	BPlusTree
 )
 
@@ -46,6 +102,8 @@ var DefaultOptions = Options{
 	IndexType:          BTree,
 	MMapAtStartup:      true,
 	DataFileMergeRatio: 0.5,
+	CompressionMinSize: 128,
+	BlobFileSize:       256 * 1024 * 1024,
 }
 
 var DefalutIteratorOptinos = IteratorOptions{
@@ -57,3 +115,5 @@ var DefaultWriteBatchOptions = WriteBatchOptions{
 	MaxBatchNum: 10000,
 	SyncWrites:  true,
 }
+
+var DefaultFsckOptions = FsckOptions{}
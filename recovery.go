@@ -0,0 +1,124 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"io"
+	"log"
+	"os"
+)
+
+// 记录的长度损坏时，在损坏位置之后逐字节查找有效记录的最大范围
+const recoveryScanWindow = 1024 * 1024
+
+// RecoveryInfo 启动时从数据文件中丢弃的数据
+type RecoveryInfo struct {
+	Fid    uint32 //数据文件id
+	Offset int64  //丢弃的数据在文件中的起始位置，即最后一条有效记录的末尾
+	Size   int64  //丢弃的数据大小，字节为单位
+	Err    error  //读取第一条丢弃的记录时的错误
+}
+
+// 数据文件中有不完整或者损坏的记录时，将文件截断到最后一条有效记录的末尾
+// 活跃文件末尾的不完整记录是写入过程中崩溃导致的，之后还有有效记录说明是文件中间的数据损坏，不会截断
+// 旧的数据文件需要配置TruncateCorruptedFiles才会截断，配置之后文件中间损坏也会丢弃之后的数据
+func (db *DB) truncateDataFile(dataFile *data.DataFile, isActiveFile bool, offset int64, cause error) error {
+	if cause != io.ErrUnexpectedEOF && cause != data.ErrInvalidCRC && cause != data.ErrInvalidCompressedValue {
+		return cause
+	}
+	if !isActiveFile && !db.options.TruncateCorruptedFiles {
+		return cause
+	}
+	size, err := dataFile.IoManager.Size()
+	if err != nil {
+		return err
+	}
+	if !db.options.TruncateCorruptedFiles && hasValidLogRecord(dataFile, offset, size) {
+		return ErrDataDirectoryCorrupted
+	}
+	if err := truncateFile(data.GetDataFileName(db.options.DirPath, dataFile.FileId), offset); err != nil {
+		return err
+	}
+	//截断之后是一个新的文件，需要重新打开
+	if err := dataFile.SetIOManager(db.options.DirPath, fio.StandardFIO); err != nil {
+		return err
+	}
+	//hint文件和截断之后的数据文件不一致，需要删除
+	hintFileName := data.GetDataHintFileName(db.options.DirPath, dataFile.FileId)
+	if err := os.Remove(hintFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	info := RecoveryInfo{
+		Fid:    dataFile.FileId,
+		Offset: offset,
+		Size:   size - offset,
+		Err:    cause,
+	}
+	//没有配置回调时记录到日志中，丢弃的数据不会被忽略
+	if db.options.RecoveryHook != nil {
+		db.options.RecoveryHook(info)
+	} else {
+		log.Printf("bitcask: truncated data file %d at offset %d, discarded %d bytes: %v",
+			info.Fid, info.Offset, info.Size, info.Err)
+	}
+	return nil
+}
+
+// 将文件截断到size，先拷贝前size个字节到临时文件再重命名替换原文件
+// 数据文件可能和检查点共享硬链接，不能原地截断，否则检查点中的文件也会被修改
+func truncateFile(fileName string, size int64) error {
+	srcFile, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	tmpName := fileName + ".truncate"
+	tmpFile, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fio.DataFileParm)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tmpFile, srcFile, size)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, fileName)
+}
+
+// 判断文件中offset处损坏的记录之后是否还有可以解析的有效记录，写入过程中崩溃只会在文件末尾留下不完整的记录
+// 记录的长度没有损坏时之后的记录紧接在损坏的记录之后，否则只在recoveryScanWindow范围内逐字节查找
+func hasValidLogRecord(dataFile *data.DataFile, offset int64, size int64) bool {
+	if recordSize, err := dataFile.ReadLogRecordSize(offset); err == nil && offset+recordSize < size {
+		if _, _, err := dataFile.ReadLogRecord(offset + recordSize); err == nil {
+			return true
+		}
+	}
+	end := min(size, offset+1+recoveryScanWindow)
+	for start := offset + 1; start < end; start++ {
+		if _, _, err := dataFile.ReadLogRecord(start); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// B+树索引启动时不会读取数据文件，需要单独检查活跃文件的末尾并设置写入的位置
+func (db *DB) recoverActiveFile() error {
+	if db.activeFile == nil {
+		return nil
+	}
+	decoded := db.decodeDataFile(db.activeFile, true)
+	if decoded.err != nil {
+		if err := db.truncateDataFile(db.activeFile, true, decoded.size, decoded.err); err != nil {
+			return err
+		}
+	}
+	db.activeFile.WriteOff = decoded.size
+	return nil
+}
@@ -0,0 +1,217 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/fio"
+	"bitcask-go/utils"
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_RecoverTornWrite(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-recover-torn")
+	opts.DirPath = dir
+	var infos []RecoveryInfo
+	opts.RecoveryHook = func(info RecoveryInfo) {
+		infos = append(infos, info)
+	}
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	//模拟写入过程中崩溃，活跃文件末尾只写入了部分记录
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeq(utils.GetTestKey(100), nonTransactionSeqNo),
+		Value: utils.RandomValue(64),
+	})
+	dataFileName := data.GetDataFileName(dir, 0)
+	sizeBefore := fileSize(t, dataFileName)
+	appendFile(t, dataFileName, encRecord[:len(encRecord)/2])
+
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []RecoveryInfo{{Fid: 0, Offset: sizeBefore, Size: int64(len(encRecord) / 2), Err: io.ErrUnexpectedEOF}}, infos)
+	assert.Equal(t, sizeBefore, fileSize(t, dataFileName))
+	assert.Equal(t, 100, len(db2.ListKeys()))
+	//继续写入的数据在重启之后仍然有效
+	assert.Nil(t, db2.Put(utils.GetTestKey(100), utils.GetTestKey(100)))
+	assert.Nil(t, db2.Close())
+
+	//末尾的记录校验失败
+	infos = nil
+	sizeBefore = fileSize(t, dataFileName)
+	encRecord[len(encRecord)-1] ^= 0xff
+	appendFile(t, dataFileName, encRecord)
+	db3, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []RecoveryInfo{{Fid: 0, Offset: sizeBefore, Size: int64(len(encRecord)), Err: data.ErrInvalidCRC}}, infos)
+	assert.Equal(t, 101, len(db3.ListKeys()))
+	val, err := db3.Get(utils.GetTestKey(100))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(100), val)
+	assert.Nil(t, db3.Close())
+}
+
+func TestDB_RecoverCorruptedActiveFile(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-recover-active")
+	opts.DirPath = dir
+	var infos []RecoveryInfo
+	opts.RecoveryHook = func(info RecoveryInfo) {
+		infos = append(infos, info)
+	}
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	//活跃文件中间的记录损坏，之后的记录仍然有效，不能当作末尾的不完整记录截断
+	dataFileName := data.GetDataFileName(dir, 0)
+	buf, err := os.ReadFile(dataFileName)
+	assert.Nil(t, err)
+	buf[len(buf)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(dataFileName, buf, 0644))
+	_, err = Open(opts)
+	assert.Equal(t, ErrDataDirectoryCorrupted, err)
+	assert.Nil(t, infos)
+	assert.Equal(t, int64(len(buf)), fileSize(t, dataFileName))
+}
+
+func TestDB_RecoverCorruptedOlderFile(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-recover-corrupted")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	//旧的数据文件中间的记录损坏
+	dataFileName := data.GetDataFileName(dir, 0)
+	buf, err := os.ReadFile(dataFileName)
+	assert.Nil(t, err)
+	buf[len(buf)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(dataFileName, buf, 0644))
+	assert.Nil(t, os.Remove(data.GetDataHintFileName(dir, 0)))
+	_, err = Open(opts)
+	assert.Equal(t, data.ErrInvalidCRC, err)
+
+	//配置之后丢弃损坏位置之后的数据
+	var infos []RecoveryInfo
+	opts.TruncateCorruptedFiles = true
+	opts.RecoveryHook = func(info RecoveryInfo) {
+		infos = append(infos, info)
+	}
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(infos))
+	assert.Equal(t, uint32(0), infos[0].Fid)
+	assert.Equal(t, int64(len(buf)), infos[0].Offset+infos[0].Size)
+	assert.Less(t, len(db2.ListKeys()), 1000)
+	assert.Nil(t, db2.Close())
+}
+
+func TestDB_RecoverCorruptedOlderFile_Checkpoint(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-recover-checkpoint")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	checkpointDir, _ := os.MkdirTemp("", "bitcask-go-recover-checkpoint-dest")
+	defer os.RemoveAll(checkpointDir)
+	assert.Nil(t, db.Checkpoint(checkpointDir))
+	assert.Nil(t, db.Close())
+
+	//旧的数据文件和检查点共享硬链接，末尾的数据损坏
+	dataFileName := data.GetDataFileName(dir, 0)
+	appendFile(t, dataFileName, []byte("corrupted"))
+	assert.Nil(t, os.Remove(data.GetDataHintFileName(dir, 0)))
+	size := fileSize(t, data.GetDataFileName(checkpointDir, 0))
+
+	//截断数据库中的文件不会修改检查点中的文件
+	opts.TruncateCorruptedFiles = true
+	opts.RecoveryHook = func(info RecoveryInfo) {}
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(db2.ListKeys()))
+	assert.Nil(t, db2.Put(utils.GetTestKey(1000), utils.RandomValue(64)))
+	assert.Nil(t, db2.Close())
+	assert.Equal(t, size-int64(len("corrupted")), fileSize(t, dataFileName))
+	assert.Equal(t, size, fileSize(t, data.GetDataFileName(checkpointDir, 0)))
+}
+
+func TestHasValidLogRecord(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-recover-scan")
+	defer os.RemoveAll(dir)
+	dataFile, err := data.OpenDataFile(dir, 0, fio.StandardFIO)
+	assert.Nil(t, err)
+	defer dataFile.Close()
+
+	encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeq(utils.GetTestKey(1), nonTransactionSeqNo),
+		Value: utils.RandomValue(64),
+	})
+	corrupted := append([]byte{}, encRecord...)
+	corrupted[len(corrupted)-1] ^= 0xff
+
+	//value损坏时直接检查紧接在之后的记录
+	assert.Nil(t, dataFile.Write(corrupted))
+	size := int64(len(corrupted))
+	assert.False(t, hasValidLogRecord(dataFile, 0, size))
+	assert.Nil(t, dataFile.Write(encRecord))
+	size += int64(len(encRecord))
+	assert.True(t, hasValidLogRecord(dataFile, 0, size))
+
+	//记录的长度损坏时只在一定范围内查找
+	assert.Nil(t, dataFile.Write(bytes.Repeat([]byte{0xff}, recoveryScanWindow+1)))
+	assert.Nil(t, dataFile.Write(encRecord))
+	size += recoveryScanWindow + 1 + int64(len(encRecord))
+	assert.True(t, hasValidLogRecord(dataFile, 1, size))
+	assert.False(t, hasValidLogRecord(dataFile, int64(len(corrupted)+len(encRecord)), size))
+}
+
+func fileSize(t *testing.T, fileName string) int64 {
+	fileInfo, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	return fileInfo.Size()
+}
+
+func appendFile(t *testing.T, fileName string, buf []byte) {
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write(buf)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+}
@@ -0,0 +1,277 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// SelectiveMerge 只merge无效数据占比达到garbageRatio的旧数据文件，其余的数据文件和索引保持不变
+// 文件中的有效数据会重写到活跃文件中，之后在变更流中会再次出现，merge的文件之前的变更不再可以读取
+// 包含范围删除的文件和以跨文件事务开头的文件不会被merge，需要使用Merge清理
+func (db *DB) SelectiveMerge(garbageRatio float32) error {
+	db.mu.Lock()
+	//如果数据库为空，则直接返回
+	if db.activeFile == nil {
+		db.mu.Unlock()
+		return nil
+	}
+	//如果merge正在进行中，则直接返回
+	if db.isMergeing {
+		db.mu.Unlock()
+		return ErrMergeIsProgress
+	}
+	//找出无效数据占比达到阈值的旧数据文件
+	var candidates []uint32
+	for fid, dataFile := range db.olderFiles {
+		size, err := dataFile.IoManager.Size()
+		if err != nil {
+			db.mu.Unlock()
+			return err
+		}
+		var reclaimableSize int64
+		if stat := db.fileStats[fid]; stat != nil {
+			reclaimableSize = stat.reclaimableSize
+		}
+		if size > 0 && float32(reclaimableSize)/float32(size) >= garbageRatio {
+			candidates = append(candidates, fid)
+		}
+	}
+	db.isMergeing = true
+	db.mu.Unlock()
+	defer func() {
+		db.mu.Lock()
+		db.isMergeing = false
+		db.mu.Unlock()
+	}()
+
+	//依次处理每个文件，处理单个文件期间阻塞写入
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i] < candidates[j]
+	})
+	for _, fid := range candidates {
+		db.mu.Lock()
+		err := db.compactDataFile(fid)
+		db.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 将数据文件中的有效数据重写到活跃文件中，然后删除这个数据文件
+// 在访问此方法前必须得有互斥锁
+func (db *DB) compactDataFile(fid uint32) error {
+	dataFile := db.olderFiles[fid]
+	if dataFile == nil {
+		return nil
+	}
+	if ok, err := canCompactDataFile(dataFile); err != nil || !ok {
+		return err
+	}
+	now := time.Now().UnixNano()
+	//已经检查过合并操作数链表的key
+	checked := make(map[uint32]map[string]struct{})
+	var offset int64 = 0
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		recordOffset := offset
+		offset += size
+		//事务完成的标记在文件中的事务记录重写之后不再需要
+		if logRecord.Type == data.LogRecordTxnFinished {
+			continue
+		}
+		realKey, _ := parseLogRecordKey(logRecord.Key)
+		cf := db.families[logRecord.FamilyId]
+		if cf == nil {
+			return ErrDataDirectoryCorrupted
+		}
+		logRecordPos := cf.index.Get(realKey)
+		//删除的标记需要保留，否则之前数据文件中的旧数据会在重启之后重新生效
+		if logRecord.Type == data.LogRecordDeleted {
+			if logRecordPos == nil {
+				if err := db.rewriteDeleted(cf, realKey); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if logRecordPos == nil {
+			continue
+		}
+		if logRecordPos.Fid != fid || logRecordPos.Offset != recordOffset {
+			//之前的记录可能仍然被合并操作数的链表引用，需要将链表合并为完整的值
+			keys := checked[cf.id]
+			if keys == nil {
+				keys = make(map[string]struct{})
+				checked[cf.id] = keys
+			}
+			if _, ok := keys[string(realKey)]; ok {
+				continue
+			}
+			keys[string(realKey)] = struct{}{}
+			chain, err := db.mergeOperandChain(logRecordPos)
+			if err != nil {
+				return err
+			}
+			for _, pos := range chain[1:] {
+				if pos.Fid == fid {
+					if err := db.collapseMergeOperands(cf, realKey, chain); err != nil {
+						return err
+					}
+					break
+				}
+			}
+			continue
+		}
+		//已经过期的数据不再重写，写入删除的标记
+		if logRecord.IsExpired(now) {
+			cf.index.Delete(realKey)
+			if err := db.rewriteDeleted(cf, realKey); err != nil {
+				return err
+			}
+			continue
+		}
+		if logRecord.Type == data.LogRecordMergeOperand {
+			chain, err := db.mergeOperandChain(logRecordPos)
+			if err != nil {
+				return err
+			}
+			if err := db.collapseMergeOperands(cf, realKey, chain); err != nil {
+				return err
+			}
+			continue
+		}
+		//清除事务标记，重写到活跃文件中
+		logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
+		pos, err := db.appendLogRecord(logRecord)
+		if err != nil {
+			return err
+		}
+		cf.index.Put(realKey, pos)
+		db.markLive(pos)
+	}
+
+	//重写的数据持久化之后才能删除数据文件
+	if err := db.activeFile.Sync(); err != nil {
+		return err
+	}
+	//merge生成的文件中没有变更，删除之后不影响读取变更
+	if fid >= db.mergeHorizon && !db.mergeInfo.isMergeFile(fid) {
+		if err := db.writeChangesHorizon(fid + 1); err != nil {
+			return err
+		}
+		db.mergeHorizon = fid + 1
+	}
+	delete(db.olderFiles, fid)
+	if err := db.closeObsoleteFile(dataFile); err != nil {
+		return err
+	}
+	if err := os.Remove(data.GetDataFileName(db.options.DirPath, fid)); err != nil {
+		return err
+	}
+	hintFileName := data.GetDataHintFileName(db.options.DirPath, fid)
+	if err := os.Remove(hintFileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	db.removeFileStats([]uint32{fid})
+	return nil
+}
+
+// 判断数据文件是否可以单独merge
+// 范围删除的记录重写之后会删除之后写入的数据，以跨文件事务开头的文件删除之后之前文件中的事务无法完成
+func canCompactDataFile(dataFile *data.DataFile) (bool, error) {
+	var offset int64 = 0
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				return true, nil
+			}
+			return false, err
+		}
+		if logRecord.Type == data.LogRecordRangeDeleted {
+			return false, nil
+		}
+		if offset == 0 {
+			if _, seqNo := parseLogRecordKey(logRecord.Key); seqNo != nonTransactionSeqNo {
+				return false, nil
+			}
+		}
+		offset += size
+	}
+}
+
+// 读取合并操作数的链表中所有记录的位置，第一个为索引中的位置
+// 在访问此方法前必须得有互斥锁
+func (db *DB) mergeOperandChain(logRecordPos *data.LogRecordPos) ([]*data.LogRecordPos, error) {
+	chain := []*data.LogRecordPos{logRecordPos}
+	for {
+		dataFile := db.getDataFile(logRecordPos.Fid)
+		if dataFile == nil {
+			return nil, ErrDataFileNotFound
+		}
+		logRecord, _, err := dataFile.ReadLogRecord(logRecordPos.Offset)
+		if err != nil {
+			return nil, err
+		}
+		if logRecord.Type != data.LogRecordMergeOperand {
+			return chain, nil
+		}
+		if logRecordPos, _ = data.DecodeMergeOperand(logRecord.Value); logRecordPos == nil {
+			return chain, nil
+		}
+		chain = append(chain, logRecordPos)
+	}
+}
+
+// 将合并操作数的链表合并为完整的值写入活跃文件
+// 在访问此方法前必须得有互斥锁
+func (db *DB) collapseMergeOperands(cf *ColumnFamily, key []byte, chain []*data.LogRecordPos) error {
+	value, err := db.readValue(db.getDataFile, db.getBlobFile, chain[0])
+	if err == ErrKeyNotFound {
+		cf.index.Delete(key)
+		db.markChainStale(chain)
+		return db.rewriteDeleted(cf, key)
+	}
+	if err != nil {
+		return err
+	}
+	pos, err := db.appendLogRecord(&data.LogRecord{
+		Key:      logRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Value:    value,
+		Type:     data.LogRecordNormal,
+		FamilyId: cf.id,
+	})
+	if err != nil {
+		return err
+	}
+	cf.index.Put(key, pos)
+	db.markChainStale(chain)
+	db.markLive(pos)
+	return nil
+}
+
+// 在活跃文件中写入删除的标记
+// 在访问此方法前必须得有互斥锁
+func (db *DB) rewriteDeleted(cf *ColumnFamily, key []byte) error {
+	pos, err := db.appendLogRecord(&data.LogRecord{
+		Key:      logRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Type:     data.LogRecordDeleted,
+		FamilyId: cf.id,
+	})
+	if err != nil {
+		return err
+	}
+	db.markGarbage(pos)
+	return nil
+}
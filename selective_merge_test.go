@@ -0,0 +1,84 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_SelectiveMerge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-selective-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.MergeOperator = counterMergeOperator{}
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	counter := []byte("counter")
+	assert.Nil(t, db.Put(counter, []byte("10")))
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	//第一个数据文件中的数据几乎都变为无效数据
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	for i := 300; i < 400; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+	//操作数引用第一个数据文件中的值
+	assert.Nil(t, db.MergeValue(counter, []byte("5")))
+
+	before := db.Stat().FileStats
+	assert.Greater(t, float32(before[0].ReclaimableSize)/float32(before[0].Size), float32(0.5))
+	assert.Less(t, float32(before[1].ReclaimableSize)/float32(before[1].Size), float32(0.5))
+
+	err = db.SelectiveMerge(0.5)
+	assert.Nil(t, err)
+
+	//只有第一个数据文件被merge了，其余的文件保持不变
+	after := db.Stat().FileStats
+	assert.NotEqual(t, before[0].Fid, after[0].Fid)
+	assert.Equal(t, before[1], after[0])
+	assert.Equal(t, ChangePosition{Fid: before[0].Fid + 1}, db.ChangesHorizon())
+
+	check := func(db *DB) {
+		assert.Equal(t, 701, len(db.ListKeys()))
+		val, err := db.Get(counter)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("15"), val)
+		for i := 0; i < 1000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			switch {
+			case i < 300:
+				assert.Equal(t, ErrKeyNotFound, err)
+			case i < 400:
+				assert.Nil(t, err)
+				assert.Equal(t, utils.GetTestKey(i), val)
+			default:
+				assert.Nil(t, err)
+				assert.NotNil(t, val)
+			}
+		}
+	}
+	check(db)
+
+	//重启之后数据依然有效
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer db2.Close()
+	check(db2)
+	//重启之后被删除的数据文件中的变更依然不可读取
+	assert.Equal(t, ChangePosition{Fid: before[0].Fid + 1}, db2.ChangesHorizon())
+	it := db2.ChangesSince(ChangePosition{Fid: before[0].Fid})
+	assert.False(t, it.Next())
+	assert.Equal(t, ErrChangesUnavailable, it.Err())
+	it.Close()
+}
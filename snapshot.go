@@ -0,0 +1,117 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/index"
+	"sync"
+	"time"
+)
+
+// Snapshot 数据库某一时刻的只读快照
+// 快照会引用创建时的数据文件，在Release之前merge不会关闭这些文件
+type Snapshot struct {
+	mu       *sync.RWMutex
+	db       *DB
+	seqNo    uint64                    //创建快照时的事务序列号
+	index    index.Indexer             //创建快照时的索引
+	files    map[uint32]*data.DataFile //创建快照时的数据文件
+	blobs    map[uint32]*data.DataFile //创建快照时的blob文件
+	released bool                      //快照是否已经释放
+}
+
+// NewSnapshot创建当前时刻的快照，使用完毕之后需要调用Release释放
+// 快照复制的是索引的写时复制副本，B+树索引不支持快照
+func (db *DB) NewSnapshot() *Snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.newSnapshot()
+}
+
+// 创建当前时刻的快照
+// 在访问此方法前必须得有互斥锁
+func (db *DB) newSnapshot() *Snapshot {
+	if db.options.IndexType == BPlusTree {
+		panic("cannot use snapshot with B+ tree index")
+	}
+	return &Snapshot{
+		mu:    new(sync.RWMutex),
+		db:    db,
+		seqNo: db.seqNo,
+		index: db.index.Clone(),
+		files: db.pinDataFiles(),
+		blobs: db.pinBlobFiles(),
+	}
+}
+
+// SeqNo创建快照时的事务序列号
+func (s *Snapshot) SeqNo() uint64 {
+	return s.seqNo
+}
+
+// Get根据key读取快照中的数据
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	logRecordPos := s.index.Get(key)
+	if logRecordPos == nil {
+		return nil, ErrKeyNotFound
+	}
+	return s.getValueByPosition(logRecordPos)
+}
+
+// NewIterator初始化快照的迭代器
+func (s *Snapshot) NewIterator(opts IteratorOptions) *Iterator {
+	return &Iterator{
+		db:        s.db,
+		snapshot:  s,
+		indexIter: s.index.Iterator(opts.Reverse),
+		options:   opts,
+	}
+}
+
+// Fold获取快照中所有的数据，并执行用户指定的操作，函数返回false时停止遍历
+func (s *Snapshot) Fold(fn func(key []byte, value []byte) bool) error {
+	iterator := s.index.Iterator(false)
+	defer iterator.Close()
+	now := time.Now().UnixNano()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if iterator.Value().IsExpired(now) {
+			continue
+		}
+		value, err := s.getValueByPosition(iterator.Value())
+		if err != nil {
+			return err
+		}
+		if !fn(iterator.Key(), value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Release释放快照，之后快照不能再被使用
+func (s *Snapshot) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	s.db.unpinFiles(s.files, s.blobs)
+	s.files, s.blobs = nil, nil
+}
+
+// 从快照引用的数据文件中读取value
+func (s *Snapshot) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.released {
+		return nil, ErrSnapshotReleased
+	}
+	return s.db.readValue(func(fid uint32) *data.DataFile {
+		return s.files[fid]
+	}, func(fid uint32) *data.DataFile {
+		return s.blobs[fid]
+	}, logRecordPos)
+}
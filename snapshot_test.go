@@ -0,0 +1,161 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot_Get_Iterator(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 10; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	snap := db.NewSnapshot()
+
+	//创建快照之后的修改对快照不可见
+	err = db.Put(utils.GetTestKey(1), []byte("new-value"))
+	assert.Nil(t, err)
+	err = db.Delete(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(10), utils.GetTestKey(10))
+	assert.Nil(t, err)
+
+	val, err := snap.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1), val)
+	val, err = snap.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(2), val)
+	_, err = snap.Get(utils.GetTestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	var count int
+	iter := snap.NewIterator(DefalutIteratorOptinos)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		val, err := iter.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, iter.Key(), val)
+		count++
+	}
+	iter.Close()
+	assert.Equal(t, 10, count)
+
+	count = 0
+	err = snap.Fold(func(key []byte, value []byte) bool {
+		assert.Equal(t, key, value)
+		count++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 10, count)
+
+	snap.Release()
+	_, err = snap.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrSnapshotReleased, err)
+}
+
+func TestSnapshot_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	snap := db.NewSnapshot()
+	for i := 0; i < 500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	//merge替换掉的数据文件在快照释放之前仍然可以读取
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.NotEmpty(t, db.obsoleteFiles)
+	var count int
+	err = snap.Fold(func(key []byte, value []byte) bool {
+		assert.Equal(t, key, value)
+		count++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, count)
+
+	snap.Release()
+	assert.Empty(t, db.obsoleteFiles)
+	assert.Equal(t, 500, len(db.ListKeys()))
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestSnapshot_Merge_ReleaseOlder(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-merge-release")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	oldSnap := db.NewSnapshot()
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.NotEmpty(t, db.obsoleteFiles)
+
+	//merge之后创建的快照不会引用被替换掉的文件，旧的快照释放之后就可以关闭
+	newSnap := db.NewSnapshot()
+	oldSnap.Release()
+	assert.Empty(t, db.obsoleteFiles)
+	value, err := newSnap.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.NotNil(t, value)
+
+	newSnap.Release()
+	assert.Empty(t, db.fileRefs)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestSnapshot_BPlusTree(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-bptree")
+	opts.DirPath = dir
+	opts.IndexType = BPlusTree
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	defer db.Close()
+
+	//B+树索引不支持快照和事务
+	assert.Panics(t, func() { db.NewSnapshot() })
+	assert.Panics(t, func() { db.Begin() })
+}
@@ -0,0 +1,220 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 流式写入的value暂存的目录，写入完成之后移动到数据目录中，重启时删除写入过程中被中断的文件
+const streamStagingDirName = "stream-staging"
+
+// 小于这个长度的流式写入的value直接读取到内存中写入，不需要单独的blob文件
+const streamStagingMinSize = 64 * 1024
+
+// PutStream 写入key，value从r中读取size个字节，value不需要完整地加载到内存中
+// 较大的value不压缩，先写入单独的blob文件，读取r期间不会阻塞其他的读写，配置了密钥时value分块加密
+// 订阅者收到的写入事件中不包含value
+func (db *DB) PutStream(key []byte, r io.Reader, size int64) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	logRecord := &data.LogRecord{
+		Key:      logRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Type:     data.LogRecordNormal,
+		FamilyId: db.defaultFamily.id,
+	}
+	//记录的长度需要能够保存在索引的位置信息中
+	if size < 0 || data.StreamLogRecordSize(logRecord, size, db.cipher) > math.MaxUint32 {
+		return ErrInvalidValueSize
+	}
+	if size < streamStagingMinSize {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		return db.Put(key, value)
+	}
+	blobFile, err := db.stageStream(logRecord, r, size)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stagingName := data.GetBlobFileName(filepath.Join(db.options.DirPath, streamStagingDirName), blobFile.FileId)
+	if err := os.Rename(stagingName, data.GetBlobFileName(db.options.DirPath, blobFile.FileId)); err != nil {
+		_ = blobFile.Close()
+		_ = os.Remove(stagingName)
+		return err
+	}
+	db.blobFiles[blobFile.FileId] = blobFile
+	blobPos := &data.LogRecordPos{Fid: blobFile.FileId, Offset: 0, Size: uint32(blobFile.WriteOff)}
+	pos, err := db.appendLogRecord(&data.LogRecord{
+		Key:      logRecord.Key,
+		Value:    data.EncodeLogRecordPos(blobPos),
+		Type:     logRecord.Type,
+		FamilyId: logRecord.FamilyId,
+		Blob:     true,
+	})
+	if err != nil {
+		//没有被引用的blob文件可以被回收
+		db.blobStats[blobFile.FileId] = &fileStat{reclaimableSize: blobFile.WriteOff}
+		return err
+	}
+	db.markLive(pos)
+	if oldPos := db.defaultFamily.index.Put(key, pos); oldPos != nil {
+		db.markStale(oldPos)
+	}
+	db.notifyWrite(db.defaultFamily.id, &WatchEvent{Type: WatchPut, Key: key})
+	return nil
+}
+
+// 将流式写入的value写入到暂存目录中单独的blob文件，读取r期间不持有锁
+// 写入失败时删除暂存的文件
+func (db *DB) stageStream(logRecord *data.LogRecord, r io.Reader, size int64) (*data.DataFile, error) {
+	db.mu.Lock()
+	fid := db.nextBlobFileId
+	db.nextBlobFileId++
+	db.mu.Unlock()
+
+	stagingDir := filepath.Join(db.options.DirPath, streamStagingDirName)
+	if err := os.MkdirAll(stagingDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	blobFile, err := data.OpenBlobFile(stagingDir, fid)
+	if err != nil {
+		return nil, err
+	}
+	blobFile.Cipher = db.cipher
+	err = blobFile.WriteLogRecordStream(logRecord, r, size)
+	//blob记录需要在指向它的记录之前持久化
+	if err == nil && db.options.SyncWrites {
+		err = blobFile.Sync()
+	}
+	if err != nil {
+		_ = blobFile.Close()
+		_ = os.Remove(data.GetBlobFileName(stagingDir, fid))
+		return nil, err
+	}
+	return blobFile, nil
+}
+
+// GetReader 返回key对应的value的读取器，value直接从数据文件中流式读取，读取到末尾时校验crc
+// 压缩、加密或者由合并操作数组成的value需要完整读取到内存中，读取器使用完之后需要关闭
+func (db *DB) GetReader(key []byte) (io.ReadCloser, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	db.mu.Lock()
+	logRecordPos := db.defaultFamily.index.Get(key)
+	if logRecordPos == nil {
+		db.mu.Unlock()
+		return nil, ErrKeyNotFound
+	}
+	if logRecordPos.IsExpired(time.Now().UnixNano()) {
+		if _, ok := db.defaultFamily.index.Delete(key); ok {
+			db.markStale(logRecordPos)
+		}
+		db.mu.Unlock()
+		return nil, ErrKeyNotFound
+	}
+	//读取期间merge替换掉的文件不会被关闭
+	files, blobFiles := db.pinDataFiles(), db.pinBlobFiles()
+	db.mu.Unlock()
+
+	reader, err := db.openValueReader(files, blobFiles, logRecordPos)
+	if err != nil {
+		db.unpinFiles(files, blobFiles)
+		return nil, err
+	}
+	return &valueReadCloser{Reader: reader, db: db, files: files, blobs: blobFiles}, nil
+}
+
+// 打开位置信息对应的value的读取器，不能流式读取的value完整读取之后返回
+func (db *DB) openValueReader(files map[uint32]*data.DataFile, blobFiles map[uint32]*data.DataFile,
+	logRecordPos *data.LogRecordPos) (io.Reader, error) {
+	readFull := func() (io.Reader, error) {
+		value, err := db.readValue(func(fid uint32) *data.DataFile {
+			return files[fid]
+		}, func(fid uint32) *data.DataFile {
+			return blobFiles[fid]
+		}, logRecordPos)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(value), nil
+	}
+	dataFile := files[logRecordPos.Fid]
+	if dataFile == nil {
+		return nil, ErrDataFileNotFound
+	}
+	logRecord, reader, err := dataFile.OpenValueReader(logRecordPos.Offset)
+	var posBuf []byte
+	if err == data.ErrValueNotStreamable {
+		//加密的blob记录的位置很短，完整读取之后仍然可以流式读取blob文件中的value
+		if logRecord, _, err = dataFile.ReadLogRecord(logRecordPos.Offset); err != nil {
+			return nil, err
+		}
+		if !logRecord.Blob {
+			return readFull()
+		}
+		posBuf = logRecord.Value
+	}
+	if err != nil {
+		return nil, err
+	}
+	if logRecord.Type == data.LogRecordMergeOperand {
+		return readFull()
+	}
+	if !logRecord.Blob {
+		return reader, nil
+	}
+	//value存储在blob文件中，记录中只有blob记录的位置
+	if posBuf == nil {
+		if posBuf, err = io.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	}
+	blobPos := data.DecodeLogRecordPos(posBuf)
+	blobFile := blobFiles[blobPos.Fid]
+	if blobFile == nil {
+		return nil, ErrDataFileNotFound
+	}
+	blobRecord, reader, err := blobFile.OpenValueReader(blobPos.Offset)
+	if err == data.ErrValueNotStreamable {
+		return readFull()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !isBlobRecordOf(blobRecord, logRecord) {
+		return nil, ErrBlobRecordMismatch
+	}
+	return reader, nil
+}
+
+// GetReader返回的读取器，关闭时释放对数据文件的引用
+type valueReadCloser struct {
+	io.Reader
+	db     *DB
+	files  map[uint32]*data.DataFile //引用的数据文件
+	blobs  map[uint32]*data.DataFile //引用的blob文件
+	closed bool
+}
+
+func (r *valueReadCloser) Close() error {
+	if !r.closed {
+		r.closed = true
+		r.db.unpinFiles(r.files, r.blobs)
+		r.files, r.blobs = nil, nil
+	}
+	return nil
+}
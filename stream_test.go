@@ -0,0 +1,221 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/utils"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_PutStream(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-stream")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+
+	value := bytes.Repeat([]byte("bitcask-go"), 30000)
+	err = db.PutStream(utils.GetTestKey(1), bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+	err = db.PutStream(nil, bytes.NewReader(value), int64(len(value)))
+	assert.Equal(t, ErrKeyIsEmpty, err)
+	err = db.PutStream(utils.GetTestKey(2), bytes.NewReader(value), -1)
+	assert.Equal(t, ErrInvalidValueSize, err)
+
+	//数据不足时写入失败，之后的写入不受影响
+	err = db.PutStream(utils.GetTestKey(2), bytes.NewReader(value[:100]), int64(len(value)))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(3), utils.GetTestKey(3)))
+
+	reader, err := db.GetReader(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	buf, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, value, buf)
+	assert.Nil(t, reader.Close())
+
+	//普通写入的value同样可以流式读取
+	reader, err = db.GetReader(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	buf, err = io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(3), buf)
+	assert.Nil(t, reader.Close())
+
+	_, err = db.GetReader(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	//重启之后数据仍然有效
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+	val, err = db.Get(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(3), val)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_GetReader_Blob(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-stream-blob")
+	opts.DirPath = dir
+	opts.BlobValueThreshold = 1024
+	opts.Compression = true
+	opts.MergeOperator = appendMergeOperator{}
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+
+	//流式写入的较大value存储在blob文件中
+	value := blobTestValue(1, 100*1024)
+	err = db.PutStream(utils.GetTestKey(1), bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, countBlobFiles(t, dir))
+	reader, err := db.GetReader(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	buf, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, value, buf)
+	assert.Nil(t, reader.Close())
+
+	//压缩存储和合并操作数组成的value完整读取之后返回
+	assert.Nil(t, db.Put(utils.GetTestKey(2), value))
+	assert.Nil(t, db.MergeValue(utils.GetTestKey(2), []byte("tail")))
+	reader, err = db.GetReader(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	buf, err = io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, append(value, []byte("tail")...), buf)
+	assert.Nil(t, reader.Close())
+
+	//读取期间merge不会关闭正在读取的文件
+	reader, err = db.GetReader(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Nil(t, db.MergeBlobFiles(0))
+	buf, err = io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, value, buf)
+	assert.Nil(t, reader.Close())
+
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+	assert.Nil(t, db.Close())
+}
+
+// 读取时阻塞，直到unblock被关闭
+type blockingReader struct {
+	r       io.Reader
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (br *blockingReader) Read(p []byte) (int, error) {
+	select {
+	case <-br.started:
+	default:
+		close(br.started)
+	}
+	<-br.unblock
+	return br.r.Read(p)
+}
+
+func TestDB_PutStream_Concurrent(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-stream-concurrent")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+
+	//读取value期间其他的读写不会被阻塞
+	value := bytes.Repeat([]byte("bitcask-go"), 30000)
+	reader := &blockingReader{r: bytes.NewReader(value), started: make(chan struct{}), unblock: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		done <- db.PutStream(utils.GetTestKey(1), reader, int64(len(value)))
+	}()
+	<-reader.started
+	assert.Nil(t, db.Put(utils.GetTestKey(2), utils.GetTestKey(2)))
+	val, err := db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(2), val)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	close(reader.unblock)
+	assert.Nil(t, <-done)
+
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_PutStream_Encryption(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-stream-encryption")
+	opts.DirPath = dir
+	opts.EncryptionKey = bytes.Repeat([]byte("k"), 32)
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+
+	value := bytes.Repeat([]byte("bitcask-go"), 30000)
+	err = db.PutStream(utils.GetTestKey(1), bytes.NewReader(value), int64(len(value)))
+	assert.Nil(t, err)
+	err = db.PutStream(utils.GetTestKey(2), bytes.NewReader([]byte("small")), 5)
+	assert.Nil(t, err)
+	reader, err := db.GetReader(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	//加密的value逐个分块解密，不会完整读取到内存中
+	_, ok := reader.(*valueReadCloser).Reader.(*data.ValueReader)
+	assert.True(t, ok)
+	var buf []byte
+	readBuf := make([]byte, 4096)
+	for {
+		n, err := reader.Read(readBuf)
+		buf = append(buf, readBuf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, value, buf)
+	assert.Nil(t, reader.Close())
+
+	//文件中不包含明文
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		fileData, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(fileData, []byte("bitcask-go")))
+	}
+
+	//重启之后数据仍然有效
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+	val, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("small"), val)
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	bitcask "bitcask-go"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// 离线检查bitcask数据目录，以JSON格式输出检查结果
+// 用法：fsck -dir <数据目录> [-repair <修复之后的数据目录>] [-key <十六进制密钥>] [-previous-keys <十六进制密钥,...>]
+func main() {
+	dirPath := flag.String("dir", "", "the database directory to check")
+	repairPath := flag.String("repair", "", "salvage valid records into this directory")
+	key := flag.String("key", "", "hex encoded encryption key of the database")
+	previousKeys := flag.String("previous-keys", "", "comma separated hex encoded previous encryption keys")
+	flag.Parse()
+	if *dirPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := bitcask.DefaultFsckOptions
+	var err error
+	if opts.EncryptionKey, err = hex.DecodeString(*key); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid key:", err)
+		os.Exit(2)
+	}
+	if *previousKeys != "" {
+		for _, previousKey := range strings.Split(*previousKeys, ",") {
+			decoded, err := hex.DecodeString(previousKey)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "invalid previous key:", err)
+				os.Exit(2)
+			}
+			opts.PreviousEncryptionKeys = append(opts.PreviousEncryptionKeys, decoded)
+		}
+	}
+
+	var report *bitcask.FsckReport
+	if *repairPath != "" {
+		report, err = bitcask.FsckRepair(*dirPath, *repairPath, opts)
+	} else {
+		report, err = bitcask.Fsck(*dirPath, opts)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fsck failed:", err)
+		os.Exit(2)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		fmt.Fprintln(os.Stderr, "fsck failed:", err)
+		os.Exit(2)
+	}
+	//发现问题时返回非零的退出码
+	if !report.Healthy {
+		os.Exit(1)
+	}
+}
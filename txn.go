@@ -0,0 +1,372 @@
+package bitcask_go
+
+import (
+	"bitcask-go/data"
+	"bitcask-go/index"
+	"bytes"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Txn 基于快照隔离的事务
+// 读取事务开始时刻的索引快照，写入暂存在内存中，提交时进行乐观冲突检测
+type Txn struct {
+	mu            *sync.Mutex
+	db            *DB
+	snapshot      *Snapshot                  //事务开始时的快照
+	startVersion  uint64                     //事务开始时的写入版本号
+	readKeys      map[string]struct{}        //事务中读取过的key
+	pendingWrites map[string]*data.LogRecord //暂存用户写入的数据
+	finished      bool                       //事务是否已经提交或回滚
+}
+
+// Begin开启一个新的事务，事务基于快照，B+树索引不支持事务
+func (db *DB) Begin() *Txn {
+	if db.options.IndexType == BPlusTree {
+		panic("cannot use transaction with B+ tree index")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.activeTxns[db.writeVersion]++
+	return &Txn{
+		mu:            new(sync.Mutex),
+		db:            db,
+		snapshot:      db.newSnapshot(),
+		startVersion:  db.writeVersion,
+		readKeys:      make(map[string]struct{}),
+		pendingWrites: make(map[string]*data.LogRecord),
+	}
+}
+
+// ReadSeqNo事务读取的快照对应的序列号
+func (txn *Txn) ReadSeqNo() uint64 {
+	return txn.snapshot.SeqNo()
+}
+
+// Get读取数据，可以读到事务自身的写入
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return nil, ErrTxnFinished
+	}
+	//优先读取事务中暂存的数据
+	if record := txn.pendingWrites[string(key)]; record != nil {
+		if record.Type == data.LogRecordDeleted {
+			return nil, ErrKeyNotFound
+		}
+		return record.Value, nil
+	}
+	txn.readKeys[string(key)] = struct{}{}
+	return txn.snapshot.Get(key)
+}
+
+// Put在事务中写数据
+func (txn *Txn) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return ErrTxnFinished
+	}
+	txn.pendingWrites[string(key)] = &data.LogRecord{Key: key, Value: value, Type: data.LogRecordNormal}
+	return nil
+}
+
+// Delete在事务中删除数据
+func (txn *Txn) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return ErrTxnFinished
+	}
+	//快照中不存在则只需要清除暂存的写入
+	txn.readKeys[string(key)] = struct{}{}
+	if txn.snapshot.index.Get(key) == nil {
+		delete(txn.pendingWrites, string(key))
+		return nil
+	}
+	txn.pendingWrites[string(key)] = &data.LogRecord{Key: key, Type: data.LogRecordDeleted}
+	return nil
+}
+
+// Commit提交事务
+// 如果事务读取或写入的key在事务开始之后被其他写入修改过，则返回ErrTxnConflict
+func (txn *Txn) Commit() error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return ErrTxnFinished
+	}
+	defer txn.release()
+	//只读事务读到的一定是一致的快照，不需要检测冲突
+	if len(txn.pendingWrites) == 0 {
+		return nil
+	}
+	if uint(len(txn.pendingWrites)) > DefaultWriteBatchOptions.MaxBatchNum {
+		return ErrExceedMaxBatchNum
+	}
+
+	//加锁保证冲突检测和事务提交的串形化
+	txn.db.mu.Lock()
+	defer txn.db.mu.Unlock()
+	//key的版本号大于事务开始时的版本号，说明事务开始之后被修改过
+	for key := range txn.readKeys {
+		if txn.db.keyVersions[key] > txn.startVersion {
+			return ErrTxnConflict
+		}
+	}
+	for key := range txn.pendingWrites {
+		if txn.db.keyVersions[key] > txn.startVersion {
+			return ErrTxnConflict
+		}
+	}
+	return txn.db.commitTxnRecords(txn.pendingWrites, txn.db.options.SyncWrites)
+}
+
+// Rollback回滚事务，丢弃暂存的写入
+func (txn *Txn) Rollback() {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.finished {
+		return
+	}
+	txn.release()
+}
+
+// NewIterator初始化事务迭代器，遍历快照和事务中暂存的数据
+func (txn *Txn) NewIterator(opts IteratorOptions) *TxnIterator {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	//暂存的数据按照遍历的顺序排序
+	var pending []*data.LogRecord
+	for _, record := range txn.pendingWrites {
+		pending = append(pending, record)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if opts.Reverse {
+			return bytes.Compare(pending[i].Key, pending[j].Key) > 0
+		}
+		return bytes.Compare(pending[i].Key, pending[j].Key) < 0
+	})
+	iter := &TxnIterator{
+		txn:       txn,
+		indexIter: txn.snapshot.index.Iterator(opts.Reverse),
+		pending:   pending,
+		options:   opts,
+	}
+	iter.Rewind()
+	return iter
+}
+
+// 结束事务，释放快照
+func (txn *Txn) release() {
+	txn.finished = true
+	txn.pendingWrites = nil
+	txn.db.mu.Lock()
+	txn.db.endTxn(txn.startVersion)
+	txn.db.mu.Unlock()
+	txn.snapshot.Release()
+}
+
+// 开始一次用户写入，返回新的写入版本号，同一个WriteBatch或事务中的key使用相同的版本号
+// 在访问此方法前必须得有互斥锁
+func (db *DB) nextWriteVersion() uint64 {
+	db.writeVersion++
+	return db.writeVersion
+}
+
+// 记录key在当前的写入版本被用户写入修改，有事务未结束时用于提交时的冲突检测
+// merge等不改变key的值的重写不需要记录
+// 在访问此方法前必须得有互斥锁
+func (db *DB) recordKeyWrite(familyId uint32, key []byte) {
+	//事务只会读写默认列族
+	if familyId != db.defaultFamily.id || len(db.activeTxns) == 0 {
+		return
+	}
+	db.keyVersions[string(key)] = db.writeVersion
+}
+
+// 事务结束，清理不会再被用于冲突检测的key版本号
+// 在访问此方法前必须得有互斥锁
+func (db *DB) endTxn(startVersion uint64) {
+	db.activeTxns[startVersion]--
+	if db.activeTxns[startVersion] > 0 {
+		return
+	}
+	delete(db.activeTxns, startVersion)
+	if len(db.activeTxns) == 0 {
+		db.keyVersions = make(map[string]uint64)
+		return
+	}
+	//只有比最早的事务更新的版本号才需要保留
+	minVersion := uint64(math.MaxUint64)
+	for version := range db.activeTxns {
+		if version < minVersion {
+			minVersion = version
+		}
+	}
+	if minVersion < startVersion {
+		return
+	}
+	for key, version := range db.keyVersions {
+		if version <= minVersion {
+			delete(db.keyVersions, key)
+		}
+	}
+}
+
+// TxnIterator事务迭代器，合并快照中的数据和事务中暂存的写入
+type TxnIterator struct {
+	txn         *Txn
+	indexIter   index.Iterator     //快照索引迭代器
+	pending     []*data.LogRecord  //排好序的暂存数据
+	pendIndex   int                //当前遍历到的暂存数据下标
+	options     IteratorOptions    //迭代器配置项
+	fromIndex   bool               //当前位置是否来自快照索引
+	fromPending bool               //当前位置是否来自暂存数据
+	currKey     []byte             //当前位置的key
+	currRecord  *data.LogRecord    //当前位置的暂存数据
+	currPos     *data.LogRecordPos //当前位置的索引信息
+	count       int                //已经遍历的key数量
+}
+
+// Rewind重新回到迭代器的起点，即第一个数据
+func (it *TxnIterator) Rewind() {
+	if start := it.options.startKey(); start != nil {
+		it.Seek(start)
+		return
+	}
+	it.count = 0
+	it.indexIter.Rewind()
+	it.pendIndex = 0
+	it.skipToNext()
+}
+
+// Seek根据传入的key查询到第一个大于（或小于）等于的目标key，根据从这个key开始遍历
+func (it *TxnIterator) Seek(key []byte) {
+	it.count = 0
+	key = it.options.clampSeekKey(key)
+	it.indexIter.Seek(key)
+	it.pendIndex = sort.Search(len(it.pending), func(i int) bool {
+		if it.options.Reverse {
+			return bytes.Compare(it.pending[i].Key, key) <= 0
+		}
+		return bytes.Compare(it.pending[i].Key, key) >= 0
+	})
+	it.skipToNext()
+}
+
+// Next跳转到下一个key
+func (it *TxnIterator) Next() {
+	it.count++
+	if it.fromIndex {
+		it.indexIter.Next()
+	}
+	if it.fromPending {
+		it.pendIndex++
+	}
+	it.skipToNext()
+}
+
+// Valid是否有效，即是否已经遍历了所有的key，用于退出遍历
+func (it *TxnIterator) Valid() bool {
+	if it.options.Limit > 0 && it.count >= it.options.Limit {
+		return false
+	}
+	return it.fromIndex || it.fromPending
+}
+
+// Key当前遍历位置的key数据
+func (it *TxnIterator) Key() []byte {
+	return it.currKey
+}
+
+// Value当前遍历位置的Value数据，KeysOnly为true时返回nil
+func (it *TxnIterator) Value() ([]byte, error) {
+	if it.options.KeysOnly {
+		return nil, nil
+	}
+	if it.fromPending {
+		return it.currRecord.Value, nil
+	}
+	it.txn.mu.Lock()
+	defer it.txn.mu.Unlock()
+	if it.txn.finished {
+		return nil, ErrTxnFinished
+	}
+	it.txn.readKeys[string(it.currKey)] = struct{}{}
+	return it.txn.snapshot.getValueByPosition(it.currPos)
+}
+
+// Close关闭迭代器，释放相关资源
+func (it *TxnIterator) Close() {
+	it.indexIter.Close()
+	it.pending = nil
+}
+
+// 找到下一个有效的位置，相同的key以暂存数据为准，跳过事务中删除的key
+func (it *TxnIterator) skipToNext() {
+	now := time.Now().UnixNano()
+	for {
+		indexValid := false
+		for ; it.indexIter.Valid(); it.indexIter.Next() {
+			skip, stop := it.options.checkKey(it.indexIter.Key())
+			if stop {
+				break
+			}
+			if !skip && !it.indexIter.Value().IsExpired(now) {
+				indexValid = true
+				break
+			}
+		}
+		pendValid := false
+		for ; it.pendIndex < len(it.pending); it.pendIndex++ {
+			skip, stop := it.options.checkKey(it.pending[it.pendIndex].Key)
+			if stop {
+				break
+			}
+			if !skip {
+				pendValid = true
+				break
+			}
+		}
+		it.fromIndex, it.fromPending = false, false
+		if !indexValid && !pendValid {
+			return
+		}
+		if indexValid && pendValid {
+			cmp := bytes.Compare(it.indexIter.Key(), it.pending[it.pendIndex].Key)
+			if it.options.Reverse {
+				cmp = -cmp
+			}
+			it.fromIndex, it.fromPending = cmp <= 0, cmp >= 0
+		} else {
+			it.fromIndex, it.fromPending = indexValid, pendValid
+		}
+		if !it.fromPending {
+			it.currKey, it.currPos = it.indexIter.Key(), it.indexIter.Value()
+			return
+		}
+		record := it.pending[it.pendIndex]
+		if record.Type != data.LogRecordDeleted {
+			it.currKey, it.currRecord = record.Key, record
+			return
+		}
+		//事务中已经删除的key，跳过
+		if it.fromIndex {
+			it.indexIter.Next()
+		}
+		it.pendIndex++
+	}
+}
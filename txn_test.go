@@ -0,0 +1,197 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxn_Get_Put_Delete(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(1), utils.GetTestKey(1))
+	assert.Nil(t, err)
+
+	txn := db.Begin()
+	//读到事务自身的写入
+	err = txn.Put(utils.GetTestKey(2), utils.GetTestKey(2))
+	assert.Nil(t, err)
+	val, err := txn.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(2), val)
+	err = txn.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_, err = txn.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	//提交之前其他读取看不到事务的写入
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1), val)
+
+	err = txn.Commit()
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(2), val)
+	assert.Equal(t, ErrTxnFinished, txn.Commit())
+
+	//重启之后事务的数据依然有效
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(opts)
+	assert.Nil(t, err)
+	defer db2.Close()
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db2.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(2), val)
+}
+
+func TestTxn_Snapshot_Conflict(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-conflict")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+
+	txn1 := db.Begin()
+	txn2 := db.Begin()
+	val, err := txn1.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+
+	//txn2先提交，修改了txn1读取过的key
+	err = txn2.Put(utils.GetTestKey(1), []byte("v2"))
+	assert.Nil(t, err)
+	err = txn2.Commit()
+	assert.Nil(t, err)
+
+	//txn1仍然读取事务开始时的快照
+	val, err = txn1.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	err = txn1.Put(utils.GetTestKey(2), []byte("v1"))
+	assert.Nil(t, err)
+	err = txn1.Commit()
+	assert.Equal(t, ErrTxnConflict, err)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	//非事务写入同样会产生冲突
+	txn3 := db.Begin()
+	err = txn3.Put(utils.GetTestKey(1), []byte("v3"))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(1), []byte("v4"))
+	assert.Nil(t, err)
+	assert.Equal(t, ErrTxnConflict, txn3.Commit())
+
+	//没有冲突的事务可以正常提交
+	txn4 := db.Begin()
+	err = txn4.Put(utils.GetTestKey(3), []byte("v1"))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(4), []byte("v1"))
+	assert.Nil(t, err)
+	assert.Nil(t, txn4.Commit())
+}
+
+func TestTxn_Merge_Conflict(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	defer db.Close()
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	//merge只会移动数据的位置，不会导致冲突
+	txn := db.Begin()
+	_, err = txn.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	err = txn.Put(utils.GetTestKey(2), []byte("v1"))
+	assert.Nil(t, err)
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.Nil(t, txn.Commit())
+
+	//范围删除了事务读取过的key，提交时冲突
+	txn2 := db.Begin()
+	_, err = txn2.Get(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	err = txn2.Put(utils.GetTestKey(4), []byte("v1"))
+	assert.Nil(t, err)
+	err = db.DeleteRange(utils.GetTestKey(3), utils.GetTestKey(4))
+	assert.Nil(t, err)
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.Equal(t, ErrTxnConflict, txn2.Commit())
+	assert.Empty(t, db.activeTxns)
+	assert.Empty(t, db.keyVersions)
+}
+
+func TestTxn_Iterator(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-iterator")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	_ = db.Put([]byte("a1"), []byte("a1"))
+	_ = db.Put([]byte("a3"), []byte("a3"))
+	_ = db.Put([]byte("b1"), []byte("b1"))
+
+	txn := db.Begin()
+	defer txn.Rollback()
+	_ = txn.Put([]byte("a2"), []byte("a2"))
+	_ = txn.Put([]byte("a3"), []byte("a3-new"))
+	_ = txn.Delete([]byte("a1"))
+	//事务开始之后的写入不可见
+	_ = db.Put([]byte("a4"), []byte("a4"))
+
+	var keys, values []string
+	iter := txn.NewIterator(IteratorOptions{Prefix: []byte("a")})
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		val, err := iter.Value()
+		assert.Nil(t, err)
+		keys = append(keys, string(iter.Key()))
+		values = append(values, string(val))
+	}
+	iter.Close()
+	assert.Equal(t, []string{"a2", "a3"}, keys)
+	assert.Equal(t, []string{"a2", "a3-new"}, values)
+
+	keys = nil
+	iter2 := txn.NewIterator(IteratorOptions{Reverse: true})
+	for iter2.Seek([]byte("a3")); iter2.Valid(); iter2.Next() {
+		keys = append(keys, string(iter2.Key()))
+	}
+	iter2.Close()
+	assert.Equal(t, []string{"a3", "a2"}, keys)
+}
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"hash/crc32"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -67,3 +69,28 @@ func CopyDir(src, dest string, exclude []string) error {
 		return os.WriteFile(filepath.Join(dest, fileName), data, info.Mode())
 	})
 }
+
+// CopyFile 拷贝文件，返回拷贝的数据大小和crc32校验值
+func CopyFile(src, dest string) (int64, uint32, error) {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer srcFile.Close()
+	destFile, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	hash := crc32.NewIEEE()
+	size, err := io.Copy(io.MultiWriter(destFile, hash), srcFile)
+	if err == nil {
+		err = destFile.Sync()
+	}
+	if closeErr := destFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return size, hash.Sum32(), nil
+}
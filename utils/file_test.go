@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"hash/crc32"
 	"os"
 	"path/filepath"
 	"testing"
@@ -22,3 +23,18 @@ func TestAvailableDiskSize(t *testing.T) {
 	assert.Nil(t, err)
 	t.Log(size / 1024 / 1024 / 1024)
 }
+
+func TestCopyFile(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-copy-file")
+	defer os.RemoveAll(dir)
+	src, dest := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+	assert.Nil(t, os.WriteFile(src, []byte("bitcask-go"), 0644))
+
+	size, checksum, err := CopyFile(src, dest)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), size)
+	assert.Equal(t, crc32.ChecksumIEEE([]byte("bitcask-go")), checksum)
+	buf, err := os.ReadFile(dest)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("bitcask-go"), buf)
+}
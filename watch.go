@@ -0,0 +1,158 @@
+package bitcask_go
+
+import (
+	"bytes"
+	"context"
+	"sync"
+)
+
+// 每个订阅者缓存的事件数量，处理过慢时多余的事件会被丢弃
+const watchBufferSize = 1024
+
+type WatchEventType = byte
+
+const (
+	// WatchPut key被写入，Value为新的值
+	WatchPut WatchEventType = iota
+	// WatchDelete key被删除
+	WatchDelete
+	// WatchDeleteRange [Key,Value)范围内的key被删除，Value为空表示没有上界
+	WatchDeleteRange
+	// WatchMerge key写入了一个合并操作数，Value为操作数
+	WatchMerge
+	// WatchOverflow 订阅者处理过慢，之前的部分事件被丢弃了，需要重新读取数据
+	WatchOverflow
+)
+
+// WatchEvent 数据变更事件
+type WatchEvent struct {
+	Type  WatchEventType
+	Key   []byte
+	Value []byte
+	SeqNo uint64 //写入的序号，按照写入的顺序递增，同一个WriteBatch或事务中的事件相同，只在本次打开期间有效
+}
+
+// 订阅者
+type watcher struct {
+	familyId     uint32
+	prefix       []byte
+	ch           chan *WatchEvent
+	lastOverflow bool //最后放入的事件是否是溢出信号
+}
+
+// 订阅者列表
+type watchers struct {
+	mu     *sync.Mutex
+	list   map[*watcher]struct{}
+	closed chan struct{} //数据库关闭之后被关闭
+}
+
+func newWatchers() *watchers {
+	return &watchers{
+		mu:     new(sync.Mutex),
+		list:   make(map[*watcher]struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+// Watch 订阅key以prefix为前缀的数据变更，ctx结束或者数据库关闭之后channel会被关闭
+// 数据过期不会产生事件
+func (db *DB) Watch(ctx context.Context, prefix []byte) <-chan *WatchEvent {
+	return db.watch(ctx, db.defaultFamily, prefix)
+}
+
+// 订阅指定列族的数据变更
+func (db *DB) watch(ctx context.Context, cf *ColumnFamily, prefix []byte) <-chan *WatchEvent {
+	//预留一个位置给溢出信号
+	w := &watcher{
+		familyId: cf.id,
+		prefix:   prefix,
+		ch:       make(chan *WatchEvent, watchBufferSize+1),
+	}
+	db.watchers.mu.Lock()
+	db.watchers.list[w] = struct{}{}
+	db.watchers.mu.Unlock()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-db.watchers.closed:
+		}
+		db.watchers.remove(w)
+	}()
+	return w.ch
+}
+
+// 取消订阅并关闭channel
+func (ws *watchers) remove(w *watcher) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if _, ok := ws.list[w]; ok {
+		delete(ws.list, w)
+		close(w.ch)
+	}
+}
+
+// 关闭所有的订阅
+func (ws *watchers) closeAll() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	select {
+	case <-ws.closed:
+	default:
+		close(ws.closed)
+	}
+	for w := range ws.list {
+		delete(ws.list, w)
+		close(w.ch)
+	}
+}
+
+// 记录单个key的非事务写入并通知订阅者，事件的序号为新的写入版本号
+// 在访问此方法前必须得有互斥锁
+func (db *DB) notifyWrite(familyId uint32, event *WatchEvent) {
+	event.SeqNo = db.nextWriteVersion()
+	db.recordKeyWrite(familyId, event.Key)
+	db.watchers.notify(familyId, event)
+}
+
+// 将事件发送给关心的订阅者，不会阻塞写入
+// 事件中的key和value是调用方的数据，发送之前需要拷贝
+func (ws *watchers) notify(familyId uint32, event *WatchEvent) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	copied := false
+	for w := range ws.list {
+		if w.familyId != familyId || !w.match(event) {
+			continue
+		}
+		if !copied {
+			event = &WatchEvent{Type: event.Type, Key: bytes.Clone(event.Key), Value: bytes.Clone(event.Value), SeqNo: event.SeqNo}
+			copied = true
+		}
+		if len(w.ch) < watchBufferSize {
+			w.ch <- event
+			w.lastOverflow = false
+			continue
+		}
+		//缓存已满，丢弃事件并通知订阅者
+		if !w.lastOverflow {
+			w.ch <- &WatchEvent{Type: WatchOverflow}
+			w.lastOverflow = true
+		}
+	}
+}
+
+// 判断事件是否和订阅的前缀相关
+func (w *watcher) match(event *WatchEvent) bool {
+	if len(w.prefix) == 0 {
+		return true
+	}
+	if event.Type != WatchDeleteRange {
+		return bytes.HasPrefix(event.Key, w.prefix)
+	}
+	//范围删除和前缀的范围有交集
+	if end := prefixEnd(w.prefix); end != nil && bytes.Compare(event.Key, end) >= 0 {
+		return false
+	}
+	return len(event.Value) == 0 || bytes.Compare(event.Value, w.prefix) > 0
+}
@@ -0,0 +1,106 @@
+package bitcask_go
+
+import (
+	"bitcask-go/utils"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB_Watch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := db.Watch(ctx, []byte("user-"))
+
+	err = db.Put([]byte("user-1"), []byte("a"))
+	assert.Nil(t, err)
+	err = db.Put([]byte("order-1"), []byte("b"))
+	assert.Nil(t, err)
+	err = db.Delete([]byte("user-1"))
+	assert.Nil(t, err)
+	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	err = wb.Put([]byte("user-2"), []byte("c"))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	err = db.DeletePrefix([]byte("user-"))
+	assert.Nil(t, err)
+
+	//事件的序列号按照写入的顺序递增
+	event := <-events
+	assert.Equal(t, WatchPut, event.Type)
+	assert.Equal(t, []byte("user-1"), event.Key)
+	assert.Equal(t, []byte("a"), event.Value)
+	lastSeqNo := event.SeqNo
+	assert.Greater(t, lastSeqNo, uint64(0))
+	event = <-events
+	assert.Equal(t, WatchDelete, event.Type)
+	assert.Equal(t, []byte("user-1"), event.Key)
+	assert.Greater(t, event.SeqNo, lastSeqNo)
+	lastSeqNo = event.SeqNo
+	event = <-events
+	assert.Equal(t, WatchPut, event.Type)
+	assert.Equal(t, []byte("user-2"), event.Key)
+	assert.Greater(t, event.SeqNo, lastSeqNo)
+	lastSeqNo = event.SeqNo
+	event = <-events
+	assert.Equal(t, WatchDeleteRange, event.Type)
+	assert.Equal(t, []byte("user-"), event.Key)
+	assert.Greater(t, event.SeqNo, lastSeqNo)
+	assert.Equal(t, db.writeVersion, event.SeqNo)
+
+	//订阅者处理过慢时丢弃事件并发送溢出信号
+	for i := 0; i < watchBufferSize+10; i++ {
+		err := db.Put([]byte("user-"+string(utils.GetTestKey(i))), []byte("v"))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < watchBufferSize; i++ {
+		event := <-events
+		assert.Equal(t, WatchPut, event.Type)
+	}
+	event = <-events
+	assert.Equal(t, WatchOverflow, event.Type)
+
+	//取消订阅之后channel被关闭
+	cancel()
+	_, ok := <-events
+	assert.False(t, ok)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestDB_Watch_CopyAndClose(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch-close")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	events := db.Watch(context.Background(), nil)
+	//写入之后修改调用方的数据不会影响事件
+	key, value := []byte("key-1"), []byte("value-1")
+	err = db.Put(key, value)
+	assert.Nil(t, err)
+	key[0], value[0] = 'x', 'x'
+	event := <-events
+	assert.Equal(t, []byte("key-1"), event.Key)
+	assert.Equal(t, []byte("value-1"), event.Value)
+
+	//数据库关闭之后channel被关闭，不需要取消ctx
+	err = db.Close()
+	assert.Nil(t, err)
+	_, ok := <-events
+	assert.False(t, ok)
+	assert.Empty(t, db.watchers.list)
+}